@@ -7,15 +7,29 @@ import (
 	"client-go/internal/sqlite"
 	"client-go/internal/tcpclient"
 
+	"encoding/hex"
+	"flag"
 	"log"
 	"os"
 
 	"gioui.org/app"
 )
 
+// SERVER_ADDRESS is the address keys of the server are pinned for.
+const SERVER_ADDRESS = "127.0.0.1:4040"
+
 func main() {
 	var err error
 
+	recordingPath := flag.String("record", "", "record the packets exchanged with the server to this file")
+	proxyURL := flag.String("proxy", "", "connect through a socks5://, socks5h:// or http:// proxy")
+	logRequests := flag.Bool("log-requests", false, "log the type, size and latency of every request")
+	useTLS := flag.Bool("tls", false, "connect to the server over TLS and pin its key on first connect")
+	caBundle := flag.String("tls-ca", "", "verify the TLS server with this PEM CA bundle instead of the system pool")
+	useNoise := flag.Bool("noise", false, "encrypt the connection with a Noise handshake, the relay must support it")
+	noiseKey := flag.String("noise-key", "", "hex encoded static key of the relay, pinned on first connect if empty")
+	flag.Parse()
+
 	err = icons.LoadIcons()
 
 	if err != nil {
@@ -24,8 +38,6 @@ func main() {
 
 	log.Printf("Starting client...")
 
-	s := tcpclient.NewTCPServer("127.0.0.1", 4040)
-
 	log.Printf("Opening database...")
 
 	db, err := sqlite.OpenDatabase("test.db")
@@ -33,6 +45,52 @@ func main() {
 		log.Fatalf("Failed to open database: %v", err)
 	}
 
+	var s *tcpclient.TCPServer
+
+	if *useTLS {
+		transport := &tcpclient.TLSTransport{
+			Address:  SERVER_ADDRESS,
+			PinStore: sqlite.ServerPinStore{DB: db},
+		}
+
+		if *caBundle != "" {
+			transport.RootCAs, err = tcpclient.LoadCABundle(*caBundle)
+			if err != nil {
+				log.Fatalf("Failed to load CA bundle: %v", err)
+			}
+		}
+
+		s = tcpclient.NewTCPServerWithTransport(transport)
+	} else {
+		s = tcpclient.NewTCPServer("127.0.0.1", 4040)
+	}
+
+	if *proxyURL != "" {
+		proxy, err := tcpclient.ParseProxy(*proxyURL)
+		if err != nil {
+			log.Fatalf("Invalid proxy: %v", err)
+		}
+
+		err = s.SetProxy(proxy)
+		if err != nil {
+			log.Fatalf("Failed to set proxy: %v", err)
+		}
+	}
+
+	var recorder *tcpclient.Recorder
+	if *recordingPath != "" {
+		recorder, err = tcpclient.CreateRecording(*recordingPath)
+		if err != nil {
+			log.Fatalf("Failed to create recording: %v", err)
+		}
+
+		s.SetRecorder(recorder)
+	}
+
+	if *logRequests {
+		s.AddRequestInterceptor(tcpclient.LoggingInterceptor)
+	}
+
 	log.Printf("Creating client...")
 
 	c := client.NewClient(s, db)
@@ -40,10 +98,34 @@ func main() {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
+	if *useNoise {
+		var relayKey []byte
+		if *noiseKey != "" {
+			relayKey, err = hex.DecodeString(*noiseKey)
+			if err != nil {
+				log.Fatalf("Invalid noise key: %v", err)
+			}
+		}
+
+		err = c.EnableNoise(SERVER_ADDRESS, relayKey)
+		if err != nil {
+			log.Fatalf("Failed to enable noise: %v", err)
+		}
+	}
+
 	appUI := gioui.NewApp()
 
 	go func() {
-		if err := appUI.Loop(c); err != nil {
+		err := appUI.Loop(c)
+
+		// os.Exit skips deferred calls, so the recording is closed here
+		if recorder != nil {
+			if closeErr := recorder.Close(); closeErr != nil {
+				log.Printf("Failed to close recording: %v", closeErr)
+			}
+		}
+
+		if err != nil {
 			log.Fatal(err)
 		}
 		os.Exit(0)
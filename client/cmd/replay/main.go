@@ -0,0 +1,116 @@
+// Command replay feeds a recording made with tcpclient.Recorder back into a
+// client, to reproduce failures seen in a session.
+//
+// The client state is read from, and updated in, the given database, so replay
+// against a copy of the database the session started with.
+package main
+
+import (
+	"client-go/internal/client"
+	"client-go/internal/fakerelay"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	recordingPath := flag.String("recording", "", "recording to replay")
+	dbPath := flag.String("db", "", "copy of the client database")
+	flag.Parse()
+
+	if *recordingPath == "" || *dbPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(*recordingPath)
+	if err != nil {
+		log.Fatalf("Failed to open recording: %v", err)
+	}
+
+	packets, err := tcpclient.ReadRecording(file)
+	file.Close()
+	if err != nil {
+		log.Fatalf("Failed to read recording: %v", err)
+	}
+
+	log.Printf("Replaying %d packets...", len(packets))
+
+	db, err := sqlite.OpenDatabase(*dbPath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+
+	replayer := fakerelay.NewReplayer(packets)
+	s := tcpclient.NewTCPServerWithTransport(replayer.Transport())
+
+	c := client.NewClient(s, db)
+	err = c.LoadClientData()
+	if err != nil {
+		log.Fatalf("Failed to load client data: %v", err)
+	}
+
+	c.ListenIncomingMessages()
+
+	err = s.Connect()
+	if err != nil {
+		log.Fatalf("Failed to connect to replayer: %v", err)
+	}
+	defer s.Close()
+
+	userID, password, err := sqlite.GetLoginData(db)
+	if err != nil {
+		log.Fatalf("Failed to read login data: %v", err)
+	}
+
+	ctx := context.Background()
+
+	// login polls the messages once, which replays the first recorded response
+	err = c.Login(ctx, userID, password)
+	if err != nil {
+		log.Printf("Login was not recorded (%v), continuing with a made up session", err)
+
+		idHash := md5.Sum(userID)
+		c.IDHash = idHash[:]
+
+		token := tcpclient.AuthToken{}
+		rand.Read(token[:])
+
+		s.SetAuthID(idHash)
+		s.SetAuthToken(token)
+	}
+
+	for {
+		messages, err := c.RequestMessages(ctx, nil)
+
+		var serverErr *tcpclient.ServerError
+		if errors.As(err, &serverErr) && serverErr.Reason == "replay_exhausted" {
+			break
+		}
+
+		if tcpclient.IsRetryable(err) {
+			log.Fatalf("Lost connection to replayer: %v", err)
+		}
+
+		if err != nil {
+			log.Printf("Replayed poll of %d messages failed: %v", len(messages), err)
+			continue
+		}
+
+		log.Printf("Replayed poll of %d messages", len(messages))
+	}
+
+	<-replayer.Pushed()
+
+	// pushed messages are handled asynchronously
+	time.Sleep(time.Second)
+
+	log.Printf("Replay finished")
+}
@@ -2,11 +2,13 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"client-go/internal/contact"
@@ -15,39 +17,90 @@ import (
 	"client-go/internal/crypt"
 	"client-go/internal/sqlite"
 	"client-go/internal/tcpclient"
-	"client-go/internal/utils"
 )
 
-type ReceiveMessagePayload struct {
-	ContactIDHash     []byte
-	StartingTimestamp int64
-}
-
-func (m *ReceiveMessagePayload) payload() []byte {
-	if m.ContactIDHash == nil && m.StartingTimestamp == 0 {
-		return nil
-	} else if m.ContactIDHash == nil {
-		return utils.IntToBytes(m.StartingTimestamp)
-	} else {
-		return append(m.ContactIDHash, utils.IntToBytes(m.StartingTimestamp)...)
-	}
-}
-
 type Client struct {
 	IDHash              []byte
 	TCPServer           *tcpclient.TCPServer
 	DB                  *sql.DB
 	KeyPair             crypt.KeyPair
+	SigningKey          crypt.SigningKeyPair
 	contacts            []*contact.Contact
+	contactsMu          sync.Mutex // guards contacts and their sessions, see lockContacts
+	pendingKeyChanges   []KeyChange
 	LastPolledTimestamp int64
+	incoming            *tcpclient.Subscription
+	outboxWake          chan struct{}
+	outboxStop          chan struct{} // closed to stop runOutbox, nil while stopped
+	outboxDone          chan struct{}
+	statusHandler       SendStatusHandler
+	keyChangeHandler    KeyChangeHandler
+	keyChangePolicy     KeyChangePolicy
+	transferProgress    tcpclient.ProgressFunc
+	noise               *tcpclient.NoiseConfig // nil unless EnableNoise was called
+	mu                  sync.Mutex
 }
 
 func NewClient(server *tcpclient.TCPServer, db *sql.DB) *Client {
-	return &Client{
-		TCPServer: server,
-		DB:        db,
-		contacts:  []*contact.Contact{},
+	c := &Client{
+		TCPServer:  server,
+		DB:         db,
+		contacts:   []*contact.Contact{},
+		outboxWake: make(chan struct{}, 1),
 	}
+
+	server.SetReconnectHandler(c.restoreSession)
+	server.SetReauthHandler(c.reauthenticate)
+
+	c.startOutbox()
+
+	return c
+}
+
+// Close stops the outbox and the handling of incoming messages. The server and
+// the database are left to the caller.
+func (c *Client) Close() {
+	c.stopOutbox()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.incoming != nil {
+		c.incoming.Unsubscribe()
+		c.incoming = nil
+	}
+}
+
+// EnableNoise makes the connection to the relay use the Noise encrypted channel,
+// authenticated with the client's identity key, which is loaded if needed. It
+// has to be called before connecting. relayKey pins the relay's static key,
+// when it is nil the key is pinned for address on first connect.
+func (c *Client) EnableNoise(address string, relayKey []byte) error {
+	if !c.KeyPair.IsValid() {
+		err := c.loadKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.noise = &tcpclient.NoiseConfig{
+		StaticKey:    c.KeyPair,
+		Address:      address,
+		RemoteStatic: relayKey,
+		PinStore:     sqlite.ServerPinStore{DB: c.DB},
+	}
+	c.mu.Unlock()
+
+	c.TCPServer.SetNoise(c.noise)
+
+	return nil
+}
+
+// Capabilities returns the protocol version and features negotiated with the
+// server on the current connection.
+func (c *Client) Capabilities() tcpclient.Capabilities {
+	return c.TCPServer.Capabilities()
 }
 
 func (c *Client) LoadClientData() error {
@@ -65,6 +118,9 @@ func (c *Client) LoadClientData() error {
 }
 
 func (c *Client) GetContactIDs() [][]byte {
+	c.lockContacts()
+	defer c.unlockContacts()
+
 	contactIDs := make([][]byte, len(c.contacts))
 	for i, contact := range c.contacts {
 		contactIDs[i] = contact.IDHash
@@ -89,68 +145,90 @@ func (c *Client) loadKeyPair() error {
 
 	c.KeyPair = keypair
 
-	return nil
-}
+	signingKey, err := sqlite.GetUserSigningKey(c.DB)
 
-func (c *Client) Login(userID, password []byte) error {
-	if len(userID) == 0 {
-		return fmt.Errorf("userID cannot be empty")
-	}
+	if err != nil || !signingKey.IsValid() {
+		signingKey, err = crypt.GenerateSigningKeyPair()
+		if err != nil {
+			return err
+		}
 
-	if len(password) == 0 {
-		return fmt.Errorf("password cannot be empty")
+		err = sqlite.SetUserSigningKey(c.DB, signingKey)
+		if err != nil {
+			return err
+		}
 	}
 
-	userIDHash := md5.Sum([]byte(userID))
-	c.IDHash = userIDHash[:]
+	c.SigningKey = signingKey
 
-	response, err := c.TCPServer.SendReceive(tcpclient.ReqKey, c.IDHash)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	nonce := make([]byte, 12)
-	_, err = rand.Read(nonce)
+func (c *Client) Login(ctx context.Context, userID, password []byte) error {
+	err := c.authenticate(ctx, userID, password)
 	if err != nil {
 		return err
 	}
 
-	encryptedPassword, err := crypt.EncryptAES(response.Data, password, nonce)
+	// Logout forgets the contacts
+	err = c.loadContacts()
 	if err != nil {
 		return err
 	}
 
-	payload := append(c.IDHash, nonce...)
-	payload = append(payload, encryptedPassword...)
+	_, err = c.RequestMessages(ctx, nil)
 
-	response, err = c.TCPServer.SendReceive(tcpclient.ReqLogin, payload)
 	if err != nil {
-		return err
+		fmt.Printf("Failed to request messages: %v\n", err)
+		// return err
 	}
 
-	authToken, err := tcpclient.BytesToAuthToken(response.Data)
+	err = c.publishPrekeys(ctx)
 	if err != nil {
-		return err
+		fmt.Printf("Failed to publish prekeys: %v\n", err)
 	}
 
-	c.TCPServer.SetAuthToken(authToken)
-	c.TCPServer.SetAuthID(userIDHash)
-	err = sqlite.SetLoginData(c.DB, userID, password)
+	// after the messages were fetched, contacts may have started new sessions
+	err = c.restartOutdatedSessions(ctx)
 	if err != nil {
-		return err
+		fmt.Printf("Failed to restart outdated sessions: %v\n", err)
 	}
 
-	_, err = c.RequestMessages(nil)
+	return nil
+}
+
+// restoreSession logs in again with the stored credentials after the connection
+// to the server was re-established, and fetches the messages missed meanwhile.
+func (c *Client) restoreSession() error {
+	if c.IDHash == nil {
+		return nil
+	}
+
+	ctx := context.Background()
 
+	err := c.authenticateStored(ctx)
 	if err != nil {
-		fmt.Printf("Failed to request messages: %v\n", err)
-		// return err
+		return err
 	}
 
-	return nil
+	return c.fetchMissedMessages(ctx)
 }
 
-func (c *Client) Signup(userID, password []byte) error {
+// fetchMissedMessages requests the messages received since the last poll,
+// messages already handled are skipped by their ratchet index.
+func (c *Client) fetchMissedMessages(ctx context.Context) error {
+	c.mu.Lock()
+	timestamp := c.LastPolledTimestamp
+	c.mu.Unlock()
+
+	_, err := c.RequestMessages(ctx, &tcpclient.MessagesRequest{
+		Timestamp: timestamp,
+	})
+
+	return err
+}
+
+func (c *Client) authenticate(ctx context.Context, userID, password []byte) error {
 	if len(userID) == 0 {
 		return fmt.Errorf("userID cannot be empty")
 	}
@@ -162,50 +240,129 @@ func (c *Client) Signup(userID, password []byte) error {
 	userIDHash := md5.Sum([]byte(userID))
 	c.IDHash = userIDHash[:]
 
-	response, err := c.TCPServer.SendReceive(tcpclient.ReqKey, c.IDHash)
+	return c.login(ctx, userID, password)
+}
+
+// login requests a new auth token for userID and stores the credentials. It
+// leaves c.IDHash alone, restoring a session must not write it while other
+// goroutines read it.
+func (c *Client) login(ctx context.Context, userID, password []byte) error {
+	userIDHash := md5.Sum([]byte(userID))
+
+	nonce, encryptedPassword, err := c.encryptPassword(ctx, userIDHash[:], password)
 	if err != nil {
 		return err
 	}
 
-	nonce := make([]byte, 12)
-	_, err = rand.Read(nonce)
+	response := tcpclient.AuthResponse{}
+	err = c.TCPServer.Request(ctx, &tcpclient.LoginRequest{
+		IDHash:            userIDHash[:],
+		Nonce:             nonce,
+		EncryptedPassword: encryptedPassword,
+	}, &response)
 	if err != nil {
 		return err
 	}
 
-	encryptedPassword, err := crypt.EncryptAES(response.Data, password, nonce)
+	c.TCPServer.SetAuthToken(response.Token)
+	c.TCPServer.SetAuthID(userIDHash)
+	c.startOutbox()
+
+	return sqlite.SetLoginData(c.DB, userID, password)
+}
+
+// authenticateStored logs in again with the stored credentials.
+func (c *Client) authenticateStored(ctx context.Context) error {
+	userID, password, err := sqlite.GetLoginData(c.DB)
 	if err != nil {
 		return err
 	}
 
-	payload := append(c.IDHash, c.KeyPair.PublicKey...)
-	payload = append(payload, nonce...)
-	payload = append(payload, encryptedPassword...)
+	return c.login(ctx, userID, password)
+}
 
-	response, err = c.TCPServer.SendReceive(tcpclient.ReqSignup, payload)
+// encryptPassword encrypts the password with the key the server hands out for
+// the user's ID hash.
+func (c *Client) encryptPassword(ctx context.Context, userIDHash, password []byte) ([]byte, []byte, error) {
+	key := tcpclient.KeyResponse{}
+	err := c.TCPServer.Request(ctx, &tcpclient.KeyRequest{IDHash: userIDHash}, &key)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, tcpclient.NONCE_LENGTH)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedPassword, err := crypt.EncryptAES(key.Key, password, nonce)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	authToken, err := tcpclient.BytesToAuthToken(response.Data)
+	return nonce, encryptedPassword, nil
+}
+
+func (c *Client) Signup(ctx context.Context, userID, password []byte) error {
+	if len(userID) == 0 {
+		return fmt.Errorf("userID cannot be empty")
+	}
+
+	if len(password) == 0 {
+		return fmt.Errorf("password cannot be empty")
+	}
+
+	userIDHash := md5.Sum([]byte(userID))
+	c.IDHash = userIDHash[:]
 
+	nonce, encryptedPassword, err := c.encryptPassword(ctx, c.IDHash, password)
 	if err != nil {
 		return err
 	}
 
-	c.TCPServer.SetAuthToken(authToken)
+	response := tcpclient.AuthResponse{}
+	err = c.TCPServer.Request(ctx, &tcpclient.SignupRequest{
+		IDHash:            c.IDHash,
+		PublicKey:         c.KeyPair.PublicKey,
+		Nonce:             nonce,
+		EncryptedPassword: encryptedPassword,
+	}, &response)
+	if err != nil {
+		return err
+	}
+
+	c.TCPServer.SetAuthToken(response.Token)
 	c.TCPServer.SetAuthID(userIDHash)
+	c.startOutbox()
+
 	err = sqlite.SetLoginData(c.DB, userID, password)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.publishPrekeys(ctx)
 }
 
+// ListenIncomingMessages handles messages pushed by the server. Calling it again
+// while already listening does nothing.
 func (c *Client) ListenIncomingMessages() {
-	c.TCPServer.RegisterHandler(tcpclient.RecvMessage, func(packet *tcpclient.Packet) {
-		message, err := message.ParseMessageData(c.IDHash, packet.Data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.incoming != nil {
+		return
+	}
+
+	c.incoming = c.TCPServer.RegisterHandler(tcpclient.RecvMessage, func(packet *tcpclient.Packet) {
+		incoming := tcpclient.IncomingMessage{}
+		err := incoming.Decode(packet.Data)
+		if err != nil {
+			fmt.Printf("Failed to decode incoming message: %v\n", err)
+			return
+		}
+
+		message, err := message.ParsePayload(incoming.SenderIDHash, c.IDHash, incoming.Message)
 		if err != nil {
 			fmt.Printf("Failed to parse incoming message: %v\n", err)
 			return
@@ -213,43 +370,55 @@ func (c *Client) ListenIncomingMessages() {
 
 		fmt.Printf("Received message ListenIncomingMessages\n")
 
-		err = c.handleIncomingMessage(message)
+		err = c.handleIncomingMessage(context.Background(), message)
 		if err != nil {
 			fmt.Printf("Failed to handle incoming message: %v\n", err)
 			return
 		}
 	})
+
+	// pushes dropped while the handler was busy are fetched instead
+	c.incoming.SetResyncHandler(func() {
+		err := c.fetchMissedMessages(context.Background())
+		if err != nil {
+			fmt.Printf("Failed to fetch dropped messages: %v\n", err)
+		}
+	})
 }
 
-func (c *Client) RequestMessages(payloadData *ReceiveMessagePayload) ([]*message.Message, error) {
-	if payloadData == nil {
-		payloadData = &ReceiveMessagePayload{}
+func (c *Client) RequestMessages(ctx context.Context, request *tcpclient.MessagesRequest) ([]*message.Message, error) {
+	if request == nil {
+		request = &tcpclient.MessagesRequest{}
 	}
-	payload := payloadData.payload()
 
-	response, err := c.TCPServer.SendReceive(tcpclient.ReqMessages, payload)
+	response := tcpclient.MessagesResponse{}
+	err := c.TCPServer.Request(c.withTransferProgress(ctx), request, &response)
 	if err != nil {
 		return nil, err
 	}
 
+	c.mu.Lock()
 	c.LastPolledTimestamp = time.Now().UnixMicro()
+	c.mu.Unlock()
 
-	if len(response.Data) == 0 {
-		return nil, nil
-	}
+	messages := make([]*message.Message, 0, len(response.Messages))
+	failedIdxs := []int{}
+	for i, incoming := range response.Messages {
+		m, err := message.ParsePayload(incoming.SenderIDHash, c.IDHash, incoming.Message)
+		if err != nil {
+			failedIdxs = append(failedIdxs, i)
+			continue
+		}
 
-	if len(response.Data) < 16 {
-		return nil, fmt.Errorf("invalid message format")
+		messages = append(messages, m)
 	}
 
-	messages, err := message.ParseMessagesData(c.IDHash, response.Data)
-	if err != nil {
-		return messages, fmt.Errorf("failed to parse message data: %v", err)
+	if len(failedIdxs) > 0 {
+		return messages, fmt.Errorf("failed to parse messages at indices: %v", failedIdxs)
 	}
 
-	failedIdxs := []int{}
 	for i := range messages {
-		err = c.handleIncomingMessage(messages[i])
+		err = c.handleIncomingMessage(ctx, messages[i])
 
 		if err != nil {
 			failedIdxs = append(failedIdxs, i)
@@ -264,7 +433,10 @@ func (c *Client) RequestMessages(payloadData *ReceiveMessagePayload) ([]*message
 	return messages, nil
 }
 
-func (c *Client) handleIncomingMessage(message *message.Message) error {
+func (c *Client) handleIncomingMessage(ctx context.Context, message *message.Message) error {
+	c.lockContacts()
+	defer c.unlockContacts()
+
 	senderIDHash := message.SenderIDHash
 
 	if bytes.Equal(senderIDHash, c.IDHash) {
@@ -273,8 +445,18 @@ func (c *Client) handleIncomingMessage(message *message.Message) error {
 
 	mContact := contact.GetContactByIDHash(c.contacts, senderIDHash)
 
+	// messages sent by the client itself never announce a session to it
+	decrypted := false
+	if message.Initial != nil && !bytes.Equal(message.SenderIDHash, c.IDHash) {
+		var err error
+		mContact, decrypted, err = c.acceptSession(senderIDHash, message)
+		if err != nil {
+			return err
+		}
+	}
+
 	if mContact == nil {
-		err := c.addContactByHash(senderIDHash, ratchet.Receiving)
+		err := c.addContactByHash(ctx, senderIDHash, ratchet.Receiving)
 
 		if err != nil {
 			return err
@@ -284,17 +466,19 @@ func (c *Client) handleIncomingMessage(message *message.Message) error {
 	}
 
 	// Decrypt message
-	err := message.Decrypt(mContact.DHRatchet)
-	if err != nil {
-		if strings.Contains(err.Error(), "message index already processed") {
-			return nil
-		}
+	if !decrypted {
+		err := message.Decrypt(mContact.DHRatchet)
+		if err != nil {
+			if strings.Contains(err.Error(), "message index already processed") {
+				return nil
+			}
 
-		return err
+			return err
+		}
 	}
 
 	// Save decrypted message
-	err = sqlite.SaveMessage(c.DB, mContact.DHRatchet.RatchetIndex, message)
+	_, err := sqlite.SaveMessage(c.DB, mContact.DHRatchet.RatchetIndex, message)
 	if err != nil {
 		return err
 	}
@@ -302,6 +486,9 @@ func (c *Client) handleIncomingMessage(message *message.Message) error {
 	return sqlite.UpdateContact(c.DB, mContact)
 }
 
+// SendMessage encrypts a message and queues it in the outbox, it is sent as soon
+// as the session is authenticated. The status of the message is tracked in the
+// outbox, see SetSendStatusHandler.
 func (c *Client) SendMessage(contactIDHash, plainMessage []byte) error {
 	if len(contactIDHash) == 0 {
 		return fmt.Errorf("contactID cannot be empty")
@@ -311,23 +498,52 @@ func (c *Client) SendMessage(contactIDHash, plainMessage []byte) error {
 		return fmt.Errorf("plainMessage cannot be empty")
 	}
 
+	c.lockContacts()
+	defer c.unlockContacts()
+
 	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash[:])
 	if mContact == nil {
 		return fmt.Errorf("contact not found")
 	}
 
-	message := message.NewPlainMessage(c.IDHash, mContact.IDHash, plainMessage)
-	message.Encrypt(mContact.DHRatchet)
+	if mContact.KeyChanged {
+		return ErrKeyChanged
+	}
 
-	payload := append(contactIDHash[:], message.Payload()...)
+	if !mContact.DHRatchet.HasHeaderKeys() {
+		return ErrOutdatedSession
+	}
 
-	_, err := c.TCPServer.SendReceive(tcpclient.SendMessage, payload)
+	msg := message.NewPlainMessage(c.IDHash, mContact.IDHash, plainMessage)
+	err := msg.Encrypt(mContact.DHRatchet)
 	if err != nil {
 		return err
 	}
 
-	sqlite.SaveMessage(c.DB, mContact.DHRatchet.RatchetIndex, message)
-	sqlite.UpdateContact(c.DB, mContact)
+	// the ratchet has moved on, so the message is stored before anything is sent
+	messageID, err := sqlite.SaveMessage(c.DB, mContact.DHRatchet.RatchetIndex, msg)
+	if err != nil {
+		return err
+	}
+
+	err = sqlite.UpdateContact(c.DB, mContact)
+	if err != nil {
+		return err
+	}
+
+	packetID := tcpclient.MessageID{}
+	_, err = rand.Read(packetID[:])
+	if err != nil {
+		return err
+	}
+
+	_, err = sqlite.QueueOutbox(c.DB, messageID, packetID[:], mContact.IDHash, msg.Payload())
+	if err != nil {
+		return err
+	}
+
+	c.notifyStatus(messageID, message.StatusQueued)
+	c.wakeOutbox()
 
 	return nil
 }
@@ -338,42 +554,63 @@ func (c *Client) loadContacts() error {
 		return err
 	}
 
+	loaded := make([]*contact.Contact, len(contacts))
 	for i := range contacts {
-		c.contacts = append(c.contacts, &contacts[i])
+		loaded[i] = &contacts[i]
 	}
+
+	c.lockContacts()
+	c.contacts = loaded
+	c.unlockContacts()
+
 	return nil
 }
 
-func (c *Client) AddContact(contactID []byte) error {
+func (c *Client) AddContact(ctx context.Context, contactID []byte) error {
 	if len(contactID) == 0 {
 		return fmt.Errorf("contactID cannot be empty")
 	}
 
 	contactIDHash := md5.Sum([]byte(contactID))
 
-	return c.addContactByHash(contactIDHash[:], ratchet.Sending)
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	return c.addContactByHash(ctx, contactIDHash[:], ratchet.Sending)
 }
 
-func (c *Client) addContactByHash(contactIDHash []byte, initState ratchet.RatchetState) error {
+// addContactByHash adds a contact with the keys published by the server. It is
+// called with the contacts locked.
+func (c *Client) addContactByHash(ctx context.Context, contactIDHash []byte, initState ratchet.RatchetState) error {
 	if len(contactIDHash) == 0 {
 		return fmt.Errorf("contactIDHash cannot be empty")
 	}
 
 	for _, contact := range c.contacts {
 		if bytes.Equal(contact.IDHash, contactIDHash) {
+			// adding a known contact again checks its keys
+			if initState == ratchet.Sending {
+				return c.refreshContact(ctx, contact)
+			}
+
 			return nil
 		}
 	}
 
-	response, err := c.TCPServer.SendReceive(tcpclient.ReqPubKey, contactIDHash)
+	response := tcpclient.PubKeyResponse{}
+	err := c.TCPServer.Request(ctx, &tcpclient.PubKeyRequest{IDHash: contactIDHash}, &response)
+	if err != nil {
+		return err
+	}
+
+	contact, err := c.newContact(contactIDHash, &response, initState)
 	if err != nil {
 		return err
 	}
 
-	contact := contact.NewContact(contactIDHash[:], c.KeyPair, response.Data, initState)
 	c.contacts = append(c.contacts, contact)
 
-	err = sqlite.AddContact(c.DB, contactIDHash, contact.DHRatchet)
+	err = sqlite.AddContact(c.DB, contact)
 	if err != nil {
 		return err
 	}
@@ -386,7 +623,10 @@ func (c *Client) GetContactChatHistory(contactIDHash []byte) ([]*message.Message
 		return nil, fmt.Errorf("contactIDHash cannot be empty")
 	}
 
+	c.lockContacts()
 	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash[:])
+	c.unlockContacts()
+
 	if mContact == nil {
 		return nil, fmt.Errorf("contact not found")
 	}
@@ -398,3 +638,34 @@ func (c *Client) GetContactChatHistory(contactIDHash []byte) ([]*message.Message
 
 	return messages, nil
 }
+
+// lockContacts locks the contacts and their sessions. Handling a message, sending
+// and key changes hold the lock until the session and the stored contact agree,
+// including the requests for the keys of a new contact.
+func (c *Client) lockContacts() {
+	c.contactsMu.Lock()
+}
+
+// unlockContacts unlocks the contacts and reports the key changes found
+// meanwhile, so the handler may use the client.
+func (c *Client) unlockContacts() {
+	changes := c.pendingKeyChanges
+	c.pendingKeyChanges = nil
+	c.contactsMu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	handler := c.keyChangeHandler
+	c.mu.Unlock()
+
+	if handler == nil {
+		return
+	}
+
+	for _, change := range changes {
+		handler(change)
+	}
+}
@@ -0,0 +1,452 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"client-go/internal/contact/message"
+	"client-go/internal/crypt"
+	"client-go/internal/fakerelay"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+)
+
+// newTestClient connects a client to the relay over an in-memory transport and
+// signs it up as name.
+func newTestClient(t *testing.T, relay *fakerelay.Relay, name string) *Client {
+	return newTestClientWith(t, relay, name, nil)
+}
+
+// newTestClientWith is newTestClient calling setup, if not nil, before the
+// client connects.
+func newTestClientWith(t *testing.T, relay *fakerelay.Relay, name string, setup func(c *Client)) *Client {
+	t.Helper()
+
+	db, err := sqlite.OpenDatabase(filepath.Join(t.TempDir(), name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	server := tcpclient.NewTCPServerWithTransport(relay.Transport())
+	t.Cleanup(server.Close)
+
+	c := NewClient(server, db)
+	t.Cleanup(c.Close)
+
+	if setup != nil {
+		setup(c)
+	}
+
+	err = server.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.LoadClientData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Signup(context.Background(), []byte(name), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ListenIncomingMessages()
+
+	return c
+}
+
+// waitForHistory waits until the chat history with a contact holds want, in
+// order, and nothing else.
+func waitForHistory(t *testing.T, c *Client, contactIDHash []byte, want ...string) {
+	t.Helper()
+
+	var got []string
+	var err error
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		// the contact is only added with its first message
+		var messages []*message.Message
+		messages, err = c.GetContactChatHistory(contactIDHash)
+
+		got = got[:0]
+		for _, m := range messages {
+			got = append(got, string(m.PlainMessage))
+		}
+
+		if slices.Equal(got, want) {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("history %q (%v), want %q", got, err, want)
+}
+
+func TestConversation(t *testing.T) {
+	relay := fakerelay.New()
+	alice := newTestClient(t, relay, "alice")
+	bob := newTestClient(t, relay, "bob")
+
+	var mu sync.Mutex
+	statuses := map[int64]message.SendStatus{}
+	alice.SetSendStatusHandler(func(messageID int64, status message.SendStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		statuses[messageID] = status
+	})
+
+	err := alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var history []string
+	for _, round := range []struct{ sender, text string }{
+		{"alice", "hi bob"},
+		{"alice", "are you there?"},
+		{"bob", "hi alice"},
+		{"alice", "how are you?"},
+		{"bob", "fine"},
+		{"bob", "and you?"},
+	} {
+		sender, receiver := alice, bob
+		if round.sender == "bob" {
+			sender, receiver = bob, alice
+		}
+
+		err := sender.SendMessage(receiver.IDHash, []byte(round.text))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		history = append(history, round.text)
+		waitForHistory(t, bob, alice.IDHash, history...)
+		waitForHistory(t, alice, bob.IDHash, history...)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, status := range statuses {
+		if status != message.StatusSent {
+			t.Errorf("message %d is %s, want %s", id, status, message.StatusSent)
+		}
+	}
+	if len(statuses) != 3 {
+		t.Errorf("got the status of %d messages, want 3", len(statuses))
+	}
+}
+
+func TestFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault fakerelay.Fault
+	}{
+		// the outbox retries once the connection and the session are restored
+		{"disconnect", fakerelay.Fault{Disconnect: true}},
+		// the rejected message holds back the next one until it is retried
+		{"server error", fakerelay.Fault{Error: "unavailable"}},
+		// a slow relay only holds up the messages
+		{"delay", fakerelay.Fault{Delay: 100 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := fakerelay.New()
+			alice := newTestClient(t, relay, "alice")
+			bob := newTestClient(t, relay, "bob")
+
+			err := alice.AddContact(context.Background(), []byte("bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// only the first message sent runs into the fault
+			var faults atomic.Int32
+			relay.SetFault(func(messageType tcpclient.MessageType, data []byte) fakerelay.Fault {
+				if messageType != tcpclient.SendMessage || faults.Add(1) > 1 {
+					return fakerelay.Fault{}
+				}
+				return tt.fault
+			})
+
+			err = alice.SendMessage(bob.IDHash, []byte("first"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = alice.SendMessage(bob.IDHash, []byte("second"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			waitForHistory(t, bob, alice.IDHash, "first", "second")
+
+			if faults.Load() < 2 {
+				t.Fatal("the fault was not injected")
+			}
+		})
+	}
+}
+
+func TestResendAfterTimeout(t *testing.T) {
+	relay := fakerelay.New()
+	alice := newTestClient(t, relay, "alice")
+	bob := newTestClient(t, relay, "bob")
+
+	err := alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the relay stores and pushes the message, but the response never arrives
+	var sends atomic.Int32
+	relay.SetFault(func(messageType tcpclient.MessageType, data []byte) fakerelay.Fault {
+		if messageType != tcpclient.SendMessage || sends.Add(1) > 1 {
+			return fakerelay.Fault{}
+		}
+		return fakerelay.Fault{Drop: true}
+	})
+
+	err = alice.SendMessage(bob.IDHash, []byte("once"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForOutbox := func(done func(entries []sqlite.OutboxEntry) bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(2 * tcpclient.DEFAULT_REQUEST_TIMEOUT)
+		for time.Now().Before(deadline) {
+			entries, err := sqlite.GetQueuedOutbox(alice.DB)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done(entries) {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatal("outbox did not get there")
+	}
+
+	// the attempt times out and is retried
+	waitForOutbox(func(entries []sqlite.OutboxEntry) bool {
+		return len(entries) == 1 && entries[0].Attempts == 1
+	})
+	alice.wakeOutbox()
+	waitForOutbox(func(entries []sqlite.OutboxEntry) bool {
+		return len(entries) == 0
+	})
+
+	if sends.Load() != 2 {
+		t.Fatalf("message sent %d times, want 2", sends.Load())
+	}
+
+	messages, err := bob.RequestMessages(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("relay delivered %d messages, want 1", len(messages))
+	}
+
+	waitForHistory(t, bob, alice.IDHash, "once")
+}
+
+func TestLogout(t *testing.T) {
+	relay := fakerelay.New()
+	alice := newTestClient(t, relay, "alice")
+	bob := newTestClient(t, relay, "bob")
+
+	err := alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alice.Logout(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice.mu.Lock()
+	stopped := alice.outboxStop == nil
+	alice.mu.Unlock()
+	if !stopped {
+		t.Fatal("outbox still running after logout")
+	}
+
+	if n := len(alice.GetContactIDs()); n != 0 {
+		t.Fatalf("%d contacts still loaded after logout", n)
+	}
+
+	// logging in again starts the outbox and loads the contacts again
+	err = alice.Login(context.Background(), []byte("alice"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice.ListenIncomingMessages()
+
+	err = alice.SendMessage(bob.IDHash, []byte("back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForHistory(t, bob, alice.IDHash, "back")
+}
+
+func TestLogoutAndWipe(t *testing.T) {
+	relay := fakerelay.New()
+	alice := newTestClient(t, relay, "alice")
+	bob := newTestClient(t, relay, "bob")
+
+	err := alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alice.SendMessage(bob.IDHash, []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForHistory(t, bob, alice.IDHash, "hi")
+
+	publicKey := slices.Clone(alice.KeyPair.PublicKey)
+
+	err = alice.LogoutAndWipe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Equal(alice.KeyPair.PublicKey, publicKey) {
+		t.Fatal("key pair kept after wipe")
+	}
+
+	// nothing comes back with the next login either
+	err = alice.LoadClientData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(alice.GetContactIDs()); n != 0 {
+		t.Fatalf("%d contacts left after wipe", n)
+	}
+	if _, err := alice.GetContactChatHistory(bob.IDHash); err == nil {
+		t.Fatal("chat history left after wipe")
+	}
+}
+
+func TestNoise(t *testing.T) {
+	relayKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := fakerelay.New()
+	relay.SetNoiseKey(relayKey)
+
+	enableNoise := func(relayKey []byte) func(c *Client) {
+		return func(c *Client) {
+			err := c.EnableNoise("relay:4040", relayKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// alice knows the relay key, bob pins it on first connect
+	alice := newTestClientWith(t, relay, "alice", enableNoise(relayKey.PublicKey))
+	bob := newTestClientWith(t, relay, "bob", enableNoise(nil))
+
+	pin, err := sqlite.ServerPinStore{DB: bob.DB}.GetPin("noise:relay:4040")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pin, relayKey.PublicKey) {
+		t.Fatalf("pinned %x, want the relay key %x", pin, relayKey.PublicKey)
+	}
+
+	err = alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = alice.SendMessage(bob.IDHash, []byte("over noise"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForHistory(t, bob, alice.IDHash, "over noise")
+
+	// a relay presenting another key is refused
+	otherKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sqlite.OpenDatabase(filepath.Join(t.TempDir(), "carol.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	server := tcpclient.NewTCPServerWithTransport(relay.Transport())
+	defer server.Close()
+
+	carol := NewClient(server, db)
+	defer carol.Close()
+
+	err = carol.EnableNoise("relay:4040", otherKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pinErr *tcpclient.PinMismatchError
+	err = server.Connect()
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("connecting to a relay with another key: got %v, want a PinMismatchError", err)
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	relay := fakerelay.New()
+	alice := newTestClient(t, relay, "alice")
+	bob := newTestClient(t, relay, "bob")
+
+	var mu sync.Mutex
+	var done, total int
+	alice.SetTransferProgressHandler(func(d, n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		done, total = d, n
+	})
+
+	err := alice.AddContact(context.Background(), []byte("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sent in chunks, pushed in chunks
+	text := string(bytes.Repeat([]byte("long message "), tcpclient.MAX_MESSAGE_SIZE/10))
+	err = alice.SendMessage(bob.IDHash, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForHistory(t, bob, alice.IDHash, text)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if total < 2 || done != total {
+		t.Fatalf("progress reported %d of %d chunks", done, total)
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"client-go/internal/contact"
+	"client-go/internal/crypt"
+	"client-go/internal/sqlite"
+)
+
+// ErrNoSigningKey is returned for contacts that never published a signing key,
+// no safety number can be computed for them.
+var ErrNoSigningKey = errors.New("contact has no signing key")
+
+// SafetyNumber returns the 60 digit number derived from the signing keys of the
+// user and a contact. Both see the same number, when it matches out of band the
+// relay did not substitute any of the keys.
+func (c *Client) SafetyNumber(contactIDHash []byte) (string, error) {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash)
+	if mContact == nil {
+		return "", fmt.Errorf("contact not found")
+	}
+
+	if len(mContact.SigningKey) == 0 {
+		return "", ErrNoSigningKey
+	}
+
+	return crypt.SafetyNumber(c.SigningKey.PublicKey, c.IDHash, mContact.SigningKey, mContact.IDHash), nil
+}
+
+// SetContactVerified marks a contact as verified once the user compared the
+// safety number, or as unverified again. Verifying a contact whose keys changed
+// allows sending to it again.
+func (c *Client) SetContactVerified(contactIDHash []byte, verified bool) error {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash)
+	if mContact == nil {
+		return fmt.Errorf("contact not found")
+	}
+
+	if verified && len(mContact.SigningKey) == 0 {
+		return ErrNoSigningKey
+	}
+
+	mContact.Verified = verified
+	if verified {
+		mContact.KeyChanged = false
+	}
+
+	return sqlite.UpdateContact(c.DB, mContact)
+}
+
+// IsContactVerified reports whether the safety number of a contact was verified.
+func (c *Client) IsContactVerified(contactIDHash []byte) bool {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash)
+	return mContact != nil && mContact.Verified
+}
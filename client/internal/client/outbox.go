@@ -0,0 +1,241 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"client-go/internal/contact/message"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+)
+
+const (
+	// OUTBOX_MAX_ATTEMPTS is how often the server may reject a message before it
+	// is marked as failed. Lost connections do not count as attempts.
+	OUTBOX_MAX_ATTEMPTS = 5
+	// OUTBOX_RETRY_INTERVAL is how often queued messages are retried while the
+	// session stays authenticated.
+	OUTBOX_RETRY_INTERVAL = 30 * time.Second
+)
+
+// SendStatusHandler is called whenever the send status of an outgoing message
+// changes, messageID is the ID of the message in the local store.
+type SendStatusHandler func(messageID int64, status message.SendStatus)
+
+// SetSendStatusHandler sets the function called on send status changes. It is
+// called from the outbox goroutine.
+func (c *Client) SetSendStatusHandler(handler SendStatusHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statusHandler = handler
+}
+
+// SendStatus returns the send status of an outgoing message, or an empty status
+// if the message did not go through the outbox.
+func (c *Client) SendStatus(messageID int64) (message.SendStatus, error) {
+	entry, err := sqlite.GetOutboxEntry(c.DB, messageID)
+	if err != nil || entry == nil {
+		return "", err
+	}
+
+	return entry.Status, nil
+}
+
+// RetryMessage queues a failed message again.
+func (c *Client) RetryMessage(messageID int64) error {
+	entry, err := sqlite.GetOutboxEntry(c.DB, messageID)
+	if err != nil {
+		return err
+	}
+
+	if entry == nil || entry.Status != message.StatusFailed {
+		return nil
+	}
+
+	entry.Status = message.StatusQueued
+	entry.Attempts = 0
+
+	err = sqlite.UpdateOutbox(c.DB, entry)
+	if err != nil {
+		return err
+	}
+
+	c.notifyStatus(messageID, entry.Status)
+	c.wakeOutbox()
+
+	return nil
+}
+
+// SetTransferProgressHandler sets the function reporting the progress of
+// messages sent or fetched in chunks, because they are larger than
+// tcpclient.MAX_MESSAGE_SIZE.
+func (c *Client) SetTransferProgressHandler(handler tcpclient.ProgressFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.transferProgress = handler
+}
+
+// withTransferProgress returns ctx reporting chunked transfers made with it to
+// the transfer progress handler.
+func (c *Client) withTransferProgress(ctx context.Context) context.Context {
+	c.mu.Lock()
+	handler := c.transferProgress
+	c.mu.Unlock()
+
+	if handler == nil {
+		return ctx
+	}
+
+	return tcpclient.WithProgress(ctx, handler)
+}
+
+func (c *Client) notifyStatus(messageID int64, status message.SendStatus) {
+	c.mu.Lock()
+	handler := c.statusHandler
+	c.mu.Unlock()
+
+	if handler != nil {
+		handler(messageID, status)
+	}
+}
+
+func (c *Client) wakeOutbox() {
+	select {
+	case c.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// startOutbox starts runOutbox unless it is already running.
+func (c *Client) startOutbox() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.outboxStop != nil {
+		return
+	}
+
+	c.outboxStop = make(chan struct{})
+	c.outboxDone = make(chan struct{})
+
+	go c.runOutbox(c.outboxStop, c.outboxDone)
+}
+
+// stopOutbox stops runOutbox and waits for a drain in progress to finish.
+// Queued messages stay stored and are sent once the outbox is started again.
+func (c *Client) stopOutbox() {
+	c.mu.Lock()
+	stop, done := c.outboxStop, c.outboxDone
+	c.outboxStop, c.outboxDone = nil, nil
+	c.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// runOutbox sends queued messages whenever the session becomes authenticated, a
+// message is queued, or the retry interval passes, until stop is closed.
+func (c *Client) runOutbox(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	states, unsubscribe := c.TCPServer.SubscribeState()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(OUTBOX_RETRY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-states:
+			if !ok {
+				return
+			}
+		case <-c.outboxWake:
+		case <-ticker.C:
+		}
+
+		if c.TCPServer.State() != tcpclient.Authenticated {
+			continue
+		}
+
+		c.drainOutbox(stop)
+	}
+}
+
+// drainOutbox sends the queued messages in order. A message the server rejected
+// holds back the later messages to the same contact until it is sent or failed.
+// It returns early once stop is closed.
+func (c *Client) drainOutbox(stop <-chan struct{}) {
+	entries, err := sqlite.GetQueuedOutbox(c.DB)
+	if err != nil {
+		log.Printf("Failed to read outbox: %v", err)
+		return
+	}
+
+	blocked := map[string]bool{}
+
+	for i := range entries {
+		entry := &entries[i]
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if blocked[string(entry.ReceiverIDHash)] {
+			continue
+		}
+
+		ctx := c.withTransferProgress(context.Background())
+
+		// a timed out attempt may have reached the relay, the resend carries the
+		// same message ID so the relay does not deliver it twice
+		if len(entry.PacketID) == len(tcpclient.MessageID{}) {
+			ctx = tcpclient.WithMessageID(ctx, tcpclient.MessageID(entry.PacketID))
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, tcpclient.DEFAULT_REQUEST_TIMEOUT)
+		err := c.TCPServer.Request(ctx, &tcpclient.SendMessageRequest{
+			ReceiverIDHash: entry.ReceiverIDHash,
+			Message:        entry.Payload,
+		}, &tcpclient.SendMessageResponse{})
+		cancel()
+
+		// the connection is gone, everything is retried once it is back
+		if tcpclient.IsRetryable(err) {
+			return
+		}
+
+		if err == nil {
+			entry.Status = message.StatusSent
+		} else {
+			entry.Attempts++
+			entry.LastError = err.Error()
+
+			if entry.Attempts >= OUTBOX_MAX_ATTEMPTS {
+				log.Printf("Giving up sending message %d: %v", entry.MessageID, err)
+				entry.Status = message.StatusFailed
+			} else {
+				blocked[string(entry.ReceiverIDHash)] = true
+			}
+		}
+
+		err = sqlite.UpdateOutbox(c.DB, entry)
+		if err != nil {
+			log.Printf("Failed to update outbox: %v", err)
+			return
+		}
+
+		if entry.Status != message.StatusQueued {
+			c.notifyStatus(entry.MessageID, entry.Status)
+		}
+	}
+}
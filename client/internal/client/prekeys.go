@@ -0,0 +1,248 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"client-go/internal/contact"
+	"client-go/internal/contact/message"
+	"client-go/internal/contact/ratchet"
+	"client-go/internal/crypt"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+)
+
+const (
+	// PREKEY_BATCH_SIZE one-time prekeys are uploaded at a time
+	PREKEY_BATCH_SIZE = 100
+	// PREKEY_MIN_COUNT is the number of one-time prekeys left on the server below
+	// which a new batch is uploaded
+	PREKEY_MIN_COUNT = 20
+	// SIGNED_PREKEY_LIFETIME is how long a signed prekey is published before it
+	// is replaced
+	SIGNED_PREKEY_LIFETIME = 7 * 24 * time.Hour
+	// SIGNED_PREKEY_KEEP signed prekeys are kept, for sessions started with a
+	// replaced one that are still in flight
+	SIGNED_PREKEY_KEEP = 2
+)
+
+// ErrInvalidSignature is returned when the identity key or the signed prekey of
+// a contact is not signed by the contact's signing key.
+var ErrInvalidSignature = errors.New("invalid key signature")
+
+// publishPrekeys uploads the signed prekey, rotating it when it is due, and
+// tops up the one-time prekeys held by the server. It does nothing if the
+// server does not support prekeys.
+func (c *Client) publishPrekeys(ctx context.Context) error {
+	if !c.Capabilities().Has(tcpclient.FeaturePrekeys) {
+		return nil
+	}
+
+	signedPrekey, err := c.signedPrekey()
+	if err != nil {
+		return err
+	}
+
+	request := &tcpclient.PrekeyUploadRequest{
+		SignedPrekey: tcpclient.SignedPrekey{
+			SigningKey:        c.SigningKey.PublicKey,
+			IdentitySignature: crypt.Sign(c.SigningKey, c.KeyPair.PublicKey),
+			ID:                signedPrekey.ID,
+			PublicKey:         signedPrekey.KeyPair.PublicKey,
+			Signature:         crypt.Sign(c.SigningKey, signedPrekey.KeyPair.PublicKey),
+		},
+	}
+
+	// without one-time prekeys the request only tells how many are left
+	response := tcpclient.PrekeyUploadResponse{}
+	err = c.TCPServer.Request(ctx, request, &response)
+	if err != nil {
+		return err
+	}
+
+	if response.Remaining >= PREKEY_MIN_COUNT {
+		return nil
+	}
+
+	keypairs := make([]crypt.KeyPair, PREKEY_BATCH_SIZE)
+	for i := range keypairs {
+		keypairs[i], err = crypt.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+	}
+
+	prekeys, err := sqlite.AddPrekeys(c.DB, false, keypairs)
+	if err != nil {
+		return err
+	}
+
+	for _, prekey := range prekeys {
+		request.OneTimePrekeys = append(request.OneTimePrekeys, tcpclient.OneTimePrekey{
+			ID:        prekey.ID,
+			PublicKey: prekey.KeyPair.PublicKey,
+		})
+	}
+
+	return c.TCPServer.Request(ctx, request, &response)
+}
+
+// signedPrekey returns the current signed prekey, creating a new one if there is
+// none yet or it is older than SIGNED_PREKEY_LIFETIME.
+func (c *Client) signedPrekey() (sqlite.Prekey, error) {
+	prekey, err := sqlite.GetSignedPrekey(c.DB)
+	if err == nil && time.Since(prekey.CreatedAt) < SIGNED_PREKEY_LIFETIME {
+		return prekey, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return prekey, err
+	}
+
+	keypair, err := crypt.GenerateKeyPair()
+	if err != nil {
+		return prekey, err
+	}
+
+	prekeys, err := sqlite.AddPrekeys(c.DB, true, []crypt.KeyPair{keypair})
+	if err != nil {
+		return prekey, err
+	}
+
+	err = sqlite.DeleteOldSignedPrekeys(c.DB, SIGNED_PREKEY_KEEP)
+	if err != nil {
+		return prekey, err
+	}
+
+	return prekeys[0], nil
+}
+
+// newContact starts the session with a new contact. With a prekey bundle the
+// session is started with X3DH, otherwise from the static identity keys.
+func (c *Client) newContact(contactIDHash []byte, response *tcpclient.PubKeyResponse, initState ratchet.RatchetState) (*contact.Contact, error) {
+	if response.Bundle == nil || initState != ratchet.Sending {
+		return contact.NewContact(contactIDHash, c.KeyPair, response.PublicKey, initState), nil
+	}
+
+	signed := response.Bundle.SignedPrekey
+	if !crypt.Verify(signed.SigningKey, response.PublicKey, signed.IdentitySignature) ||
+		!crypt.Verify(signed.SigningKey, signed.PublicKey, signed.Signature) {
+		return nil, ErrInvalidSignature
+	}
+
+	bundle := ratchet.PrekeyBundle{
+		IdentityKey:    response.PublicKey,
+		SignedPrekeyID: signed.ID,
+		SignedPrekey:   signed.PublicKey,
+	}
+
+	if oneTime := response.Bundle.OneTimePrekey; oneTime != nil {
+		bundle.OneTimePrekeyID = oneTime.ID
+		bundle.OneTimePrekey = oneTime.PublicKey
+	}
+
+	session, err := ratchet.NewInitiatorRatchet(c.KeyPair, c.SigningKey, bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &contact.Contact{
+		IDHash:      contactIDHash,
+		DHRatchet:   session,
+		IdentityKey: response.PublicKey,
+		SigningKey:  signed.SigningKey,
+	}, nil
+}
+
+// acceptSession handles a message announcing an X3DH session. A new contact is
+// added with it. For a known contact it replaces the current session, unless
+// both started a session at the same time: then the session of the contact
+// with the lower ID hash is kept on both sides, and the other one is only kept
+// to decrypt the messages already sent with it.
+//
+// The message is decrypted with the new session before the one-time prekey is
+// used up and the session accepted, decrypted reports whether it was. A message
+// of a session that is already known is left to the caller. It is called with
+// the contacts locked.
+func (c *Client) acceptSession(contactIDHash []byte, m *message.Message) (mContact *contact.Contact, decrypted bool, err error) {
+	mContact = contact.GetContactByIDHash(c.contacts, contactIDHash)
+	if mContact != nil && mContact.DHRatchet.Knows(m.SealedHeader) {
+		return mContact, false, nil
+	}
+
+	header := m.Initial
+	if !crypt.Verify(header.SigningKey, header.IdentityKey, header.IdentitySignature) {
+		return nil, false, ErrInvalidSignature
+	}
+
+	session, err := c.responderRatchet(header)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = m.Decrypt(session)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the one-time prekey cannot be used again
+	if header.OneTimePrekeyID != ratchet.NO_ONE_TIME_PREKEY {
+		err = sqlite.DeletePrekey(c.DB, header.OneTimePrekeyID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if mContact == nil {
+		mContact = &contact.Contact{
+			IDHash:      contactIDHash,
+			DHRatchet:   session,
+			IdentityKey: header.IdentityKey,
+			SigningKey:  header.SigningKey,
+		}
+		c.contacts = append(c.contacts, mContact)
+
+		return mContact, true, sqlite.AddContact(c.DB, mContact)
+	}
+
+	changed := c.pinKeys(mContact, header.IdentityKey, header.SigningKey)
+
+	// a session with changed keys cannot be the one started at the same time
+	if !changed && mContact.DHRatchet.Initial != nil && bytes.Compare(c.IDHash, contactIDHash) < 0 {
+		mContact.DHRatchet.KeepSession(session)
+		return mContact, true, nil
+	}
+
+	log.Printf("Contact %x started a new session", contactIDHash)
+
+	session.KeepSession(mContact.DHRatchet)
+	session.ContinueIndex(mContact.DHRatchet)
+	mContact.DHRatchet = session
+
+	return mContact, true, nil
+}
+
+// responderRatchet derives the session announced by header from the prekeys it
+// was started with.
+func (c *Client) responderRatchet(header *ratchet.InitialHeader) (*ratchet.DHRatchet, error) {
+	signedPrekey, err := sqlite.GetPrekey(c.DB, header.SignedPrekeyID)
+	if err != nil || !signedPrekey.Signed {
+		return nil, fmt.Errorf("unknown signed prekey %d", header.SignedPrekeyID)
+	}
+
+	var oneTimePrekey *crypt.KeyPair
+	if header.OneTimePrekeyID != ratchet.NO_ONE_TIME_PREKEY {
+		prekey, err := sqlite.GetPrekey(c.DB, header.OneTimePrekeyID)
+		if err != nil || prekey.Signed {
+			return nil, fmt.Errorf("unknown one-time prekey %d", header.OneTimePrekeyID)
+		}
+
+		oneTimePrekey = &prekey.KeyPair
+	}
+
+	return ratchet.NewResponderRatchet(c.KeyPair, signedPrekey.KeyPair, oneTimePrekey, *header)
+}
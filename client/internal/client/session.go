@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"client-go/internal/contact"
+	"client-go/internal/crypt"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+)
+
+// reauthenticate logs in again when the server rejects the auth token, e.g.
+// because the account was logged in somewhere else meanwhile.
+func (c *Client) reauthenticate() error {
+	if c.IDHash == nil {
+		return fmt.Errorf("not logged in")
+	}
+
+	return c.authenticateStored(context.Background())
+}
+
+// Logout ends the session on the server and forgets it locally: the auth ID and
+// token, the stored credentials, the loaded contacts and the handler for
+// incoming messages. The outbox is stopped, queued messages are sent after the
+// next login. The local session ends even when the server cannot be reached,
+// the error of the ReqLogout request is returned nonetheless.
+func (c *Client) Logout(ctx context.Context) error {
+	logoutErr := c.TCPServer.Request(ctx, &tcpclient.LogoutRequest{}, &tcpclient.LogoutResponse{})
+
+	c.TCPServer.ClearAuth()
+	c.stopOutbox()
+
+	c.mu.Lock()
+	if c.incoming != nil {
+		c.incoming.Unsubscribe()
+		c.incoming = nil
+	}
+	c.IDHash = nil
+	c.LastPolledTimestamp = 0
+	c.mu.Unlock()
+
+	c.lockContacts()
+	c.contacts = []*contact.Contact{}
+	c.unlockContacts()
+
+	err := sqlite.DeleteLoginData(c.DB)
+	if err != nil {
+		return fmt.Errorf("failed to delete login data: %w", err)
+	}
+
+	if logoutErr != nil {
+		return fmt.Errorf("failed to log out on the server: %w", logoutErr)
+	}
+
+	return nil
+}
+
+// LogoutAndWipe logs out and deletes all local data: the identity and signing
+// key pairs, prekeys, contacts with their ratchets, messages and queued outgoing
+// messages. New key pairs are generated, so the client can sign up again right
+// away. With Noise enabled the relay sees the new identity key from the next
+// connection on.
+func (c *Client) LogoutAndWipe(ctx context.Context) error {
+	logoutErr := c.Logout(ctx)
+
+	err := sqlite.Wipe(c.DB)
+	if err != nil {
+		return fmt.Errorf("failed to wipe local data: %w", err)
+	}
+
+	c.mu.Lock()
+	clear(c.KeyPair.PrivateKey)
+	clear(c.SigningKey.PrivateKey)
+	c.KeyPair = crypt.KeyPair{}
+	c.SigningKey = crypt.SigningKeyPair{}
+	c.mu.Unlock()
+
+	err = c.loadKeyPair()
+	if err != nil {
+		return err
+	}
+
+	// the Noise config held the cleared key
+	c.mu.Lock()
+	if c.noise != nil {
+		noise := *c.noise
+		noise.StaticKey = c.KeyPair
+		c.noise = &noise
+		c.TCPServer.SetNoise(&noise)
+	}
+	c.mu.Unlock()
+
+	return logoutErr
+}
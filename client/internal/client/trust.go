@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"client-go/internal/contact"
+	"client-go/internal/contact/ratchet"
+	"client-go/internal/sqlite"
+	"client-go/internal/tcpclient"
+)
+
+// ErrKeyChanged is returned by SendMessage for a contact whose keys changed,
+// until the change is accepted or the contact verified again.
+var ErrKeyChanged = errors.New("contact keys changed")
+
+// ErrOutdatedSession is returned by SendMessage for a contact whose session was
+// stored before headers were encrypted, until a new session is started on the
+// next login.
+var ErrOutdatedSession = errors.New("session predates header encryption")
+
+// KeyChangePolicy decides whether sending to a contact whose keys changed is
+// blocked until the user accepts the new keys.
+type KeyChangePolicy int
+
+const (
+	// KeyChangeBlockVerified blocks sending only to contacts that were verified
+	// before their keys changed.
+	KeyChangeBlockVerified KeyChangePolicy = iota
+	// KeyChangeBlock blocks sending to every contact whose keys changed.
+	KeyChangeBlock
+	// KeyChangeAllow only reports the change, sending continues with the new keys.
+	KeyChangeAllow
+)
+
+// KeyChange reports that the keys of a contact no longer match the ones pinned
+// when the contact was first seen, because the contact re-registered or the
+// relay serves different keys.
+type KeyChange struct {
+	ContactIDHash  []byte
+	OldIdentityKey []byte
+	NewIdentityKey []byte
+	OldSigningKey  []byte
+	NewSigningKey  []byte
+	WasVerified    bool
+	Blocked        bool // sending is blocked until AcceptKeyChange or SetContactVerified
+}
+
+// KeyChangeHandler is called whenever the keys of a contact change.
+type KeyChangeHandler func(change KeyChange)
+
+// SetKeyChangeHandler sets the function called when the keys of a contact
+// change. It is called from the goroutine handling the request or message that
+// revealed the change, once the contacts are unlocked.
+func (c *Client) SetKeyChangeHandler(handler KeyChangeHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyChangeHandler = handler
+}
+
+// SetKeyChangePolicy sets the policy applied to key changes detected from now
+// on, the default is KeyChangeBlockVerified.
+func (c *Client) SetKeyChangePolicy(policy KeyChangePolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyChangePolicy = policy
+}
+
+// AcceptKeyChange allows sending to a contact again after its keys changed,
+// without verifying the new keys.
+func (c *Client) AcceptKeyChange(contactIDHash []byte) error {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash)
+	if mContact == nil {
+		return fmt.Errorf("contact not found")
+	}
+
+	mContact.KeyChanged = false
+
+	return sqlite.UpdateContact(c.DB, mContact)
+}
+
+// HasKeyChanged reports whether sending to a contact is blocked because its keys
+// changed.
+func (c *Client) HasKeyChanged(contactIDHash []byte) bool {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	mContact := contact.GetContactByIDHash(c.contacts, contactIDHash)
+	return mContact != nil && mContact.KeyChanged
+}
+
+// pinKeys compares the keys a contact presents with the pinned ones and pins
+// the presented keys. A missing signing key does not replace a pinned one.
+// When a pinned key changed, the verification is dropped, sending is blocked if
+// the policy says so, and the change is reported once the contacts are
+// unlocked. It is called with the contacts locked.
+func (c *Client) pinKeys(mContact *contact.Contact, identityKey, signingKey []byte) bool {
+	if len(signingKey) == 0 {
+		signingKey = mContact.SigningKey
+	}
+
+	identityChanged := len(mContact.IdentityKey) > 0 && !bytes.Equal(mContact.IdentityKey, identityKey)
+	signingChanged := len(mContact.SigningKey) > 0 && !bytes.Equal(mContact.SigningKey, signingKey)
+
+	change := KeyChange{
+		ContactIDHash:  mContact.IDHash,
+		OldIdentityKey: mContact.IdentityKey,
+		NewIdentityKey: identityKey,
+		OldSigningKey:  mContact.SigningKey,
+		NewSigningKey:  signingKey,
+		WasVerified:    mContact.Verified,
+	}
+
+	mContact.IdentityKey = identityKey
+	mContact.SigningKey = signingKey
+
+	if !identityChanged && !signingChanged {
+		return false
+	}
+
+	c.mu.Lock()
+	policy := c.keyChangePolicy
+	c.mu.Unlock()
+
+	change.Blocked = policy == KeyChangeBlock || (policy == KeyChangeBlockVerified && change.WasVerified)
+
+	log.Printf("Keys of contact %x changed", mContact.IDHash)
+
+	mContact.Verified = false
+	mContact.KeyChanged = mContact.KeyChanged || change.Blocked
+
+	c.pendingKeyChanges = append(c.pendingKeyChanges, change)
+
+	return true
+}
+
+// refreshContact fetches the published keys of a known contact and compares
+// them with the pinned ones. When they changed the contact lost its session
+// state, so a new session is started with the new keys. A session without
+// header keys is replaced as well. It is called with the contacts locked.
+func (c *Client) refreshContact(ctx context.Context, mContact *contact.Contact) error {
+	response := tcpclient.PubKeyResponse{}
+	err := c.TCPServer.Request(ctx, &tcpclient.PubKeyRequest{IDHash: mContact.IDHash}, &response)
+	if err != nil {
+		return err
+	}
+
+	var signingKey []byte
+	if response.Bundle != nil {
+		signingKey = response.Bundle.SignedPrekey.SigningKey
+	}
+
+	identityKey, pinnedSigningKey := mContact.IdentityKey, mContact.SigningKey
+
+	changed := c.pinKeys(mContact, response.PublicKey, signingKey)
+	if !changed && mContact.DHRatchet.HasHeaderKeys() {
+		return sqlite.UpdateContact(c.DB, mContact)
+	}
+
+	fresh, err := c.newContact(mContact.IDHash, &response, ratchet.Sending)
+	if err != nil {
+		// the new keys are not trusted, keep the pinned ones
+		mContact.IdentityKey, mContact.SigningKey = identityKey, pinnedSigningKey
+		return err
+	}
+
+	fresh.DHRatchet.ContinueIndex(mContact.DHRatchet)
+	mContact.DHRatchet = fresh.DHRatchet
+
+	return sqlite.UpdateContact(c.DB, mContact)
+}
+
+// restartOutdatedSessions starts a new session with every contact whose session
+// was stored before headers were encrypted. Such sessions can neither send nor
+// receive, the contact accepts the new one with the next message.
+func (c *Client) restartOutdatedSessions(ctx context.Context) error {
+	c.lockContacts()
+	defer c.unlockContacts()
+
+	var errs []error
+	for _, mContact := range c.contacts {
+		if mContact.DHRatchet.HasHeaderKeys() {
+			continue
+		}
+
+		log.Printf("Starting a new session with contact %x, its session predates header encryption", mContact.IDHash)
+
+		err := c.refreshContact(ctx, mContact)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("contact %x: %w", mContact.IDHash, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -7,14 +7,19 @@ import (
 )
 
 type Contact struct {
-	IDHash    []byte
-	DHRatchet *ratchet.DHRatchet
+	IDHash      []byte
+	DHRatchet   *ratchet.DHRatchet
+	IdentityKey []byte // X25519 identity key
+	SigningKey  []byte // Ed25519 signing key, nil if the contact never published one
+	Verified    bool   // the safety number was compared out of band
+	KeyChanged  bool   // the keys changed, sending is blocked until the change is accepted
 }
 
 func NewContact(IDHash []byte, keypair crypt.KeyPair, publicKey []byte, initState ratchet.RatchetState) *Contact {
 	return &Contact{
-		IDHash:    IDHash,
-		DHRatchet: ratchet.NewDHRatchet(keypair, publicKey, initState),
+		IDHash:      IDHash,
+		DHRatchet:   ratchet.NewDHRatchet(keypair, publicKey, initState),
+		IdentityKey: publicKey,
 	}
 }
 
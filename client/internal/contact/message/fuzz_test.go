@@ -0,0 +1,71 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"client-go/internal/contact/ratchet"
+	"client-go/internal/utils"
+)
+
+// addPayloadSeeds adds the payloads of real messages, one of a legacy session
+// and one carrying the initial header of an X3DH session.
+func addPayloadSeeds(f *testing.F, prefix func(payload []byte) []byte) {
+	legacy, _ := newLegacyPair(f)
+	x3dh, _ := newX3DHPair(f)
+
+	for _, r := range []*ratchet.DHRatchet{legacy, x3dh} {
+		m := NewPlainMessage(nil, nil, []byte("hello"))
+		if err := m.Encrypt(r); err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(prefix(m.Payload()))
+	}
+}
+
+func FuzzParsePayload(f *testing.F) {
+	addPayloadSeeds(f, func(payload []byte) []byte { return payload })
+	f.Add(make([]byte, PAYLOAD_MIN_LENGTH))
+	f.Add(append([]byte{FLAG_INITIAL}, make([]byte, PAYLOAD_MIN_LENGTH)...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := ParsePayload(nil, nil, data)
+		if err != nil {
+			return
+		}
+
+		// the flags are the only byte not kept
+		if data[0] != 0 && data[0] != FLAG_INITIAL {
+			return
+		}
+
+		if !bytes.Equal(m.Payload(), data) {
+			t.Fatalf("payload\n%x\nparsed from\n%x", m.Payload(), data)
+		}
+	})
+}
+
+func FuzzParseMessagesData(f *testing.F) {
+	sender := bytes.Repeat([]byte{0x11}, ID_HASH_LENGTH)
+	addPayloadSeeds(f, func(payload []byte) []byte {
+		message := append(append([]byte{}, sender...), payload...)
+		return append(utils.IntToBytes(int64(len(message))), message...)
+	})
+	f.Add([]byte{})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add(append(utils.IntToBytes(ID_HASH_LENGTH), sender...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		messages, _ := ParseMessagesData(nil, data)
+
+		for _, m := range messages {
+			if len(m.SenderIDHash) != ID_HASH_LENGTH {
+				t.Fatalf("sender ID hash of %d bytes", len(m.SenderIDHash))
+			}
+			if len(m.SealedHeader) != SEALED_HEADER_LENGTH {
+				t.Fatalf("sealed header of %d bytes", len(m.SealedHeader))
+			}
+		}
+	})
+}
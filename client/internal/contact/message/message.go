@@ -1,14 +1,42 @@
 package message
 
 import (
+	"bytes"
 	"client-go/internal/contact/ratchet"
 	"client-go/internal/crypt"
 	"client-go/internal/utils"
+	"encoding/binary"
 	"fmt"
 	"log"
 )
 
-const HASH_LENGTH = 32
+const (
+	HASH_LENGTH    = 32
+	ID_HASH_LENGTH = 16
+	// public key + message index + previous chain length
+	HEADER_LENGTH = crypt.KEY_LENGTH + 2*utils.PACKET_LENGTH_NR_BYTES
+	// the header encrypted with the header key of the sending chain
+	SEALED_HEADER_LENGTH = ratchet.NONCE_LENGTH + HEADER_LENGTH + ratchet.HEADER_TAG_LENGTH
+	// flags + sealed header + hash, the encrypted message follows the sealed
+	// header
+	PAYLOAD_MIN_LENGTH = 1 + SEALED_HEADER_LENGTH + ratchet.NONCE_LENGTH + HASH_LENGTH
+	// identity key + signing key + identity signature + ephemeral key + signed
+	// and one-time prekey IDs
+	INITIAL_HEADER_LENGTH = 3*crypt.KEY_LENGTH + crypt.SIGNATURE_LENGTH + 8
+)
+
+// FLAG_INITIAL marks a payload carrying the X3DH InitialHeader after the flags.
+const FLAG_INITIAL byte = 0x01
+
+// DecodeError is returned for message data that is truncated or malformed.
+type DecodeError struct {
+	Field  string
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid message %s: %s", e.Field, e.Reason)
+}
 
 type Hash [HASH_LENGTH]byte
 
@@ -26,19 +54,64 @@ func hashToBytes(h Hash) []byte {
 	return h[:]
 }
 
+// MessageHeader is sent sealed with the header key of the sending chain, it is
+// only known once the message was decrypted.
 type MessageHeader struct {
 	PublicKey []byte
 	Index     int
 	PrevCount int // Number of messages in the previous chain
 }
 
+func (h *MessageHeader) encode() []byte {
+	data := make([]byte, 0, HEADER_LENGTH)
+	data = append(data, h.PublicKey...)
+	data = append(data, utils.IntToBytes(int64(h.Index))...)
+	return append(data, utils.IntToBytes(int64(h.PrevCount))...)
+}
+
+func decodeHeader(data []byte) (MessageHeader, error) {
+	if len(data) != HEADER_LENGTH {
+		return MessageHeader{}, &DecodeError{Field: "header", Reason: fmt.Sprintf("%d bytes, expected %d", len(data), HEADER_LENGTH)}
+	}
+
+	offset := crypt.KEY_LENGTH
+	h := MessageHeader{
+		PublicKey: append([]byte{}, data[:offset]...),
+		Index:     utils.BytesToInt(data[offset : offset+utils.PACKET_LENGTH_NR_BYTES]),
+		PrevCount: utils.BytesToInt(data[offset+utils.PACKET_LENGTH_NR_BYTES:]),
+	}
+
+	if h.Index < 0 {
+		return h, &DecodeError{Field: "index", Reason: fmt.Sprintf("negative index %d", h.Index)}
+	}
+
+	if h.PrevCount < 0 {
+		return h, &DecodeError{Field: "previous chain length", Reason: fmt.Sprintf("negative length %d", h.PrevCount)}
+	}
+
+	return h, nil
+}
+
+// SendStatus tracks an outgoing message through the outbox.
+type SendStatus string
+
+const (
+	StatusQueued SendStatus = "queued"
+	StatusSent   SendStatus = "sent"
+	StatusFailed SendStatus = "failed"
+)
+
 type Message struct {
+	ID               int64 // row ID in the local store
 	Header           MessageHeader
+	SealedHeader     []byte
 	EncryptedMessage []byte
 	PlainMessage     []byte
 	hash             Hash
 	SenderIDHash     []byte
 	ReceiverIDHash   []byte
+	Status           SendStatus             // empty for received messages
+	Initial          *ratchet.InitialHeader // set while the session is not confirmed
 }
 
 func NewPlainMessage(senderIDHash, receiverIDHash, plainMessage []byte) *Message {
@@ -57,14 +130,15 @@ func ParseMessagesData(receiverIDHash, data []byte) ([]*Message, error) {
 	failedIdxs := make([]int, 0)
 	for offset < len(data) {
 		if len(data[offset:]) < utils.PACKET_LENGTH_NR_BYTES {
-			return nil, fmt.Errorf("insufficient data for message length")
+			return nil, &DecodeError{Field: "length", Reason: fmt.Sprintf("%d bytes left, expected %d", len(data[offset:]), utils.PACKET_LENGTH_NR_BYTES)}
 		}
 
 		messageLength := utils.BytesToInt(data[offset : offset+utils.PACKET_LENGTH_NR_BYTES])
 		offset += utils.PACKET_LENGTH_NR_BYTES
 
-		if len(data[offset:]) < messageLength {
-			return messages, fmt.Errorf("insufficient data for message")
+		// the length is read as a signed 64 bit integer
+		if messageLength < 0 || len(data[offset:]) < messageLength {
+			return messages, &DecodeError{Field: "length", Reason: fmt.Sprintf("%d exceeds the %d bytes left", messageLength, len(data[offset:]))}
 		}
 
 		messageData := data[offset : offset+messageLength]
@@ -89,16 +163,34 @@ func ParseMessagesData(receiverIDHash, data []byte) ([]*Message, error) {
 }
 
 func ParseMessageData(receiverIDHash, data []byte) (*Message, error) {
-	offset := 0
+	if len(data) < ID_HASH_LENGTH {
+		return nil, &DecodeError{Field: "sender", Reason: fmt.Sprintf("%d bytes, expected %d", len(data), ID_HASH_LENGTH)}
+	}
+
+	return ParsePayload(data[:ID_HASH_LENGTH], receiverIDHash, data[ID_HASH_LENGTH:])
+}
 
-	senderIDHash := data[offset : offset+16]
-	offset += 16
+// ParsePayload parses the encrypted message produced by Payload.
+func ParsePayload(senderIDHash, receiverIDHash, data []byte) (*Message, error) {
+	if len(data) < PAYLOAD_MIN_LENGTH {
+		return nil, &DecodeError{Field: "payload", Reason: fmt.Sprintf("%d bytes, expected at least %d", len(data), PAYLOAD_MIN_LENGTH)}
+	}
+
+	flags := data[0]
+	offset := 1
+
+	var initial *ratchet.InitialHeader
+	if flags&FLAG_INITIAL != 0 {
+		if len(data) < PAYLOAD_MIN_LENGTH+INITIAL_HEADER_LENGTH {
+			return nil, &DecodeError{Field: "initial header", Reason: fmt.Sprintf("%d bytes, expected at least %d", len(data), PAYLOAD_MIN_LENGTH+INITIAL_HEADER_LENGTH)}
+		}
 
-	publicKey := data[offset : offset+crypt.KEY_LENGTH]
-	offset += crypt.KEY_LENGTH
+		initial = decodeInitialHeader(data[offset : offset+INITIAL_HEADER_LENGTH])
+		offset += INITIAL_HEADER_LENGTH
+	}
 
-	index := utils.BytesToInt(data[offset : offset+utils.PACKET_LENGTH_NR_BYTES])
-	offset += utils.PACKET_LENGTH_NR_BYTES
+	sealedHeader := data[offset : offset+SEALED_HEADER_LENGTH]
+	offset += SEALED_HEADER_LENGTH
 
 	encryptedMessage := data[offset : len(data)-len(Hash{})]
 	hash, err := bytesToHash(data[len(data)-len(Hash{}):])
@@ -108,23 +200,55 @@ func ParseMessageData(receiverIDHash, data []byte) (*Message, error) {
 	}
 
 	return &Message{
-		Header: MessageHeader{
-			PublicKey: publicKey,
-			Index:     index,
-			PrevCount: 0,
-		},
+		SealedHeader:     sealedHeader,
 		PlainMessage:     nil,
 		EncryptedMessage: encryptedMessage,
 		hash:             hash,
 		SenderIDHash:     senderIDHash,
 		ReceiverIDHash:   receiverIDHash,
+		Initial:          initial,
 	}, nil
 }
 
+func encodeInitialHeader(data []byte, h *ratchet.InitialHeader) []byte {
+	data = append(data, h.IdentityKey...)
+	data = append(data, h.SigningKey...)
+	data = append(data, h.IdentitySignature...)
+	data = append(data, h.EphemeralKey...)
+	data = binary.BigEndian.AppendUint32(data, h.SignedPrekeyID)
+	return binary.BigEndian.AppendUint32(data, h.OneTimePrekeyID)
+}
+
+func decodeInitialHeader(data []byte) *ratchet.InitialHeader {
+	h := &ratchet.InitialHeader{}
+	offset := 0
+
+	field := func(length int) []byte {
+		offset += length
+		return append([]byte{}, data[offset-length:offset]...)
+	}
+
+	h.IdentityKey = field(crypt.KEY_LENGTH)
+	h.SigningKey = field(crypt.KEY_LENGTH)
+	h.IdentitySignature = field(crypt.SIGNATURE_LENGTH)
+	h.EphemeralKey = field(crypt.KEY_LENGTH)
+	h.SignedPrekeyID = binary.BigEndian.Uint32(data[offset:])
+	h.OneTimePrekeyID = binary.BigEndian.Uint32(data[offset+4:])
+
+	return h
+}
+
 func (m *Message) Payload() []byte {
-	data := make([]byte, 0, 16+len(m.Header.PublicKey)+utils.PACKET_LENGTH_NR_BYTES+len(m.EncryptedMessage)+len(m.hash))
-	data = append(data, m.Header.PublicKey...)
-	data = append(data, utils.IntToBytes(int64(m.Header.Index))...)
+	data := make([]byte, 0, 1+INITIAL_HEADER_LENGTH+len(m.SealedHeader)+len(m.EncryptedMessage)+len(m.hash))
+
+	if m.Initial != nil {
+		data = append(data, FLAG_INITIAL)
+		data = encodeInitialHeader(data, m.Initial)
+	} else {
+		data = append(data, 0)
+	}
+
+	data = append(data, m.SealedHeader...)
 	data = append(data, m.EncryptedMessage...)
 	data = append(data, hashToBytes(m.hash)...)
 
@@ -133,21 +257,21 @@ func (m *Message) Payload() []byte {
 
 func (m *Message) Encrypt(r *ratchet.DHRatchet) error {
 	// if ratchet was last used for receiving
-	if r.State == ratchet.Receiving {
+	if r.State == ratchet.Receiving || r.SendingMRatchet == nil {
 		newKeyPair, err := crypt.GenerateKeyPair()
 		if err != nil {
 			log.Fatalf("Failed to generate key pair: %v", err)
 		}
 
-		r.State = ratchet.Sending
-		r.KeyPair = newKeyPair
-
-		// cycle root key with current public key
-		r.RKCycle(nil)
+		// start a new sending chain with the contact's current public key
+		err = r.SendingCycle(newKeyPair)
+		if err != nil {
+			return err
+		}
 	}
 
-	// encrypt message with current message ratchet
-	encryptedMessage, hash_bytes, idx, err := r.CurrentMRatchet.Encrypt(m.PlainMessage)
+	// encrypt message with the sending chain
+	encryptedMessage, hash_bytes, idx, err := r.SendingMRatchet.Encrypt(m.PlainMessage)
 	if err != nil {
 		return err
 	}
@@ -160,47 +284,59 @@ func (m *Message) Encrypt(r *ratchet.DHRatchet) error {
 	m.EncryptedMessage = encryptedMessage
 	m.hash = hash
 	m.Header.Index = idx
+	m.Header.PrevCount = r.PrevCount
 	m.Header.PublicKey = r.KeyPair.PublicKey
+	m.Initial = r.Initial
 
-	return nil
+	m.SealedHeader, err = r.SealHeader(m.Header.encode())
+	return err
 }
 
 func (m *Message) Decrypt(r *ratchet.DHRatchet) error {
-	// Try current ratchet first
-	if r.IsCurrentRatchet(m.Header.PublicKey) {
-		plaintext, err := r.CurrentMRatchet.Decrypt(m.EncryptedMessage, hashToBytes(m.hash), m.Header.Index)
-		if err == nil {
-			m.PlainMessage = plaintext
-		}
-
+	plainHeader, chain, err := r.OpenHeader(m.SealedHeader)
+	if err != nil {
 		return err
 	}
 
-	// Try previous ratchets if current fails
-	prevRatchet := r.GetPrevRatchet(m.Header.PublicKey)
-	if prevRatchet != nil {
-		plaintext, err := prevRatchet.Decrypt(m.EncryptedMessage, hashToBytes(m.hash), m.Header.Index)
-		if err == nil {
-			m.PlainMessage = plaintext
-			return nil
-		}
-
+	header, err := decodeHeader(plainHeader)
+	if err != nil {
 		return err
 	}
 
-	// If no previous ratchet found, cycle the current ratchet
-	if !r.IsCurrentRatchet(m.Header.PublicKey) {
-		r.RKCycle(m.Header.PublicKey)
-		r.State = ratchet.Receiving
+	// the header was sealed with the next header key, cycle a copy of the
+	// current ratchet, it replaces the ratchet once the message authenticated
+	stepped := r
+	if chain == nil {
+		stepped = r.Clone()
 
-		plaintext, err := r.CurrentMRatchet.Decrypt(m.EncryptedMessage, hashToBytes(m.hash), m.Header.Index)
+		err := stepped.RKCycle(header.PublicKey, header.PrevCount)
 		if err != nil {
 			return err
 		}
 
-		m.PlainMessage = plaintext
-		return nil
+		chain = stepped.CurrentMRatchet
+	}
+
+	if !bytes.Equal(chain.ForeignPublicKey, header.PublicKey) {
+		return fmt.Errorf("failed to decrypt message: ratchet key does not match the header key")
+	}
+
+	plaintext, err := chain.Decrypt(m.EncryptedMessage, hashToBytes(m.hash), header.Index)
+	if err != nil {
+		return err
+	}
+
+	if stepped != r {
+		*r = *stepped
 	}
 
-	return fmt.Errorf("failed to decrypt message: no matching ratchet")
+	m.Header = header
+	m.PlainMessage = plaintext
+
+	// the contact answered, the session no longer needs to be announced
+	if chain == r.CurrentMRatchet {
+		r.Initial = nil
+	}
+
+	return nil
 }
@@ -0,0 +1,377 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	"client-go/internal/contact/ratchet"
+	"client-go/internal/crypt"
+)
+
+type op int
+
+const (
+	send    op = iota // encrypt a message
+	deliver           // decrypt it on the other side
+	replay            // decrypt it again, it has to be rejected
+	corrupt           // decrypt it with a modified body, it has to be rejected
+)
+
+// event is one step of a conversation between a and b. Messages are named by
+// their plaintext, the sender of a message is the first letter of its name.
+type event struct {
+	op      op
+	message string
+}
+
+func sends(messages ...string) []event {
+	events := make([]event, len(messages))
+	for i, m := range messages {
+		events[i] = event{send, m}
+	}
+	return events
+}
+
+func delivers(messages ...string) []event {
+	events := make([]event, len(messages))
+	for i, m := range messages {
+		events[i] = event{deliver, m}
+	}
+	return events
+}
+
+func script(parts ...[]event) []event {
+	var events []event
+	for _, part := range parts {
+		events = append(events, part...)
+	}
+	return events
+}
+
+func newLegacyPair(t testing.TB) (a, b *ratchet.DHRatchet) {
+	t.Helper()
+
+	keyA, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ratchet.NewDHRatchet(keyA, keyB.PublicKey, ratchet.Sending), ratchet.NewDHRatchet(keyB, keyA.PublicKey, ratchet.Receiving)
+}
+
+func newX3DHPair(t testing.TB) (a, b *ratchet.DHRatchet) {
+	t.Helper()
+
+	identityA, _ := crypt.GenerateKeyPair()
+	identityB, _ := crypt.GenerateKeyPair()
+	signedPrekey, _ := crypt.GenerateKeyPair()
+	oneTimePrekey, _ := crypt.GenerateKeyPair()
+	signingKey, err := crypt.GenerateSigningKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err = ratchet.NewInitiatorRatchet(identityA, signingKey, ratchet.PrekeyBundle{
+		IdentityKey:     identityB.PublicKey,
+		SignedPrekeyID:  1,
+		SignedPrekey:    signedPrekey.PublicKey,
+		OneTimePrekeyID: 2,
+		OneTimePrekey:   oneTimePrekey.PublicKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ratchet.NewResponderRatchet(identityB, signedPrekey, &oneTimePrekey, *a.Initial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+// skippedKeys counts the message keys a ratchet holds for messages it has not
+// received yet.
+func skippedKeys(r *ratchet.DHRatchet) int {
+	n := len(r.CurrentMRatchet.SkippedMessageKeys)
+	for _, chain := range r.PreviousMRatchets {
+		n += len(chain.SkippedMessageKeys)
+	}
+	return n
+}
+
+func TestConversation(t *testing.T) {
+	tests := []struct {
+		name     string
+		x3dh     bool
+		events   []event
+		skippedA int
+		skippedB int
+	}{
+		{
+			name: "in order over several DH steps",
+			events: script(
+				sends("a1", "a2"), delivers("a1", "a2"),
+				sends("b1"), delivers("b1"),
+				sends("a3"), delivers("a3"),
+				sends("b2", "b3"), delivers("b2", "b3"),
+				sends("a4"), delivers("a4"),
+			),
+		},
+		{
+			name: "reordered within a chain",
+			events: script(
+				sends("a1", "a2", "a3"), delivers("a3", "a1", "a2"),
+				sends("b1", "b2"), delivers("b2", "b1"),
+				sends("a4", "a5"), delivers("a5", "a4"),
+			),
+		},
+		{
+			name: "messages of old chains arrive after several DH steps",
+			events: script(
+				sends("a1", "a2", "a3"), delivers("a3"),
+				sends("b1", "b2"), delivers("b2"),
+				sends("a4", "a5"), delivers("a5"),
+				sends("b3"), delivers("b3"),
+				sends("a6"), delivers("a6"),
+				delivers("a1", "b1", "a2", "a4"),
+			),
+		},
+		{
+			name: "messages arriving after their chain ended",
+			events: script(
+				sends("a1"), delivers("a1"),
+				sends("b1"), delivers("b1"),
+				sends("a2", "a3"), delivers("a2"),
+				sends("b2"), delivers("b2"),
+				// only the previous chain length of a4 tells b that a3 was sent
+				sends("a4"), delivers("a4", "a3"),
+			),
+		},
+		{
+			name: "dropped messages keep their keys",
+			events: script(
+				sends("a1", "a2", "a3"), delivers("a1", "a3"),
+				sends("b1", "b2"), delivers("b2"),
+				sends("a4", "a5"), delivers("a5"),
+				sends("b3"), delivers("b3"),
+			),
+			skippedA: 1, // b1
+			skippedB: 2, // a2 and a4
+		},
+		{
+			name: "dropped message at the end of a chain",
+			events: script(
+				sends("a1", "a2"), delivers("a1"),
+				sends("b1"), delivers("b1"),
+				sends("a3"), delivers("a3"),
+				sends("b2"), delivers("b2"),
+			),
+			skippedB: 1, // a2, announced by the previous chain length of a3
+		},
+		{
+			name: "crossing messages",
+			events: script(
+				sends("a1"), delivers("a1"),
+				sends("b1", "b2"),
+				sends("a2"), delivers("a2"),
+				delivers("b1"),
+				sends("a3"),
+				sends("b3"), delivers("b3"),
+				delivers("a3", "b2"),
+				sends("a4", "b4"), delivers("b4", "a4"),
+			),
+		},
+		{
+			name: "replayed messages are rejected",
+			events: script(
+				sends("a1", "a2"), delivers("a2"),
+				[]event{{replay, "a2"}},
+				delivers("a1"),
+				[]event{{replay, "a1"}},
+				sends("b1"), delivers("b1"),
+				sends("a3"), delivers("a3"),
+				[]event{{replay, "b1"}, {replay, "a3"}},
+			),
+		},
+		{
+			name: "corrupted messages do not advance the ratchet",
+			events: script(
+				sends("a1", "a2"),
+				[]event{{corrupt, "a2"}},
+				delivers("a1", "a2"),
+				sends("b1"),
+				// the header of b1 steps the ratchet of a, the body does not
+				// authenticate
+				[]event{{corrupt, "b1"}},
+				delivers("b1"),
+				sends("a3", "a4"),
+				[]event{{corrupt, "a4"}},
+				delivers("a3", "a4"),
+			),
+		},
+		{
+			name: "session started with X3DH",
+			x3dh: true,
+			events: script(
+				sends("a1", "a2"), delivers("a2"),
+				sends("b1"), delivers("b1"),
+				sends("a3"), delivers("a3"),
+				sends("b2"), delivers("b2"),
+				delivers("a1"),
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newLegacyPair(t)
+			if tt.x3dh {
+				a, b = newX3DHPair(t)
+			}
+
+			sent := map[string][]byte{}
+			for _, e := range tt.events {
+				sender, receiver := a, b
+				if e.message[0] == 'b' {
+					sender, receiver = b, a
+				}
+
+				switch e.op {
+				case send:
+					m := NewPlainMessage(nil, nil, []byte(e.message))
+					if err := m.Encrypt(sender); err != nil {
+						t.Fatalf("encrypt %s: %v", e.message, err)
+					}
+					sent[e.message] = m.Payload()
+
+				case deliver, replay, corrupt:
+					payload := bytes.Clone(sent[e.message])
+					if e.op == corrupt {
+						payload[len(payload)-HASH_LENGTH-1] ^= 0xFF
+					}
+
+					m, err := ParsePayload(nil, nil, payload)
+					if err != nil {
+						t.Fatalf("parse %s: %v", e.message, err)
+					}
+
+					err = m.Decrypt(receiver)
+					if e.op != deliver {
+						if err == nil {
+							t.Fatalf("%s: decrypted a replayed or corrupted message", e.message)
+						}
+						continue
+					}
+					if err != nil {
+						t.Fatalf("decrypt %s: %v", e.message, err)
+					}
+					if string(m.PlainMessage) != e.message {
+						t.Fatalf("decrypted %q, want %q", m.PlainMessage, e.message)
+					}
+				}
+			}
+
+			if n := skippedKeys(a); n != tt.skippedA {
+				t.Errorf("a holds %d skipped keys, want %d", n, tt.skippedA)
+			}
+			if n := skippedKeys(b); n != tt.skippedB {
+				t.Errorf("b holds %d skipped keys, want %d", n, tt.skippedB)
+			}
+		})
+	}
+}
+
+func TestPayloadHidesHeader(t *testing.T) {
+	a, b := newLegacyPair(t)
+
+	m := NewPlainMessage(nil, nil, []byte("a1"))
+	if err := m.Encrypt(a); err != nil {
+		t.Fatal(err)
+	}
+
+	payload := m.Payload()
+	if bytes.Contains(payload, m.Header.PublicKey) {
+		t.Fatal("payload contains the ratchet public key")
+	}
+
+	parsed, err := ParsePayload(nil, nil, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.PublicKey != nil {
+		t.Fatal("header known before decryption")
+	}
+
+	if err := parsed.Decrypt(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Header.PublicKey, m.Header.PublicKey) || parsed.Header.Index != m.Header.Index {
+		t.Fatalf("header %+v, want %+v", parsed.Header, m.Header)
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	a, _ := newLegacyPair(t)
+	_, other := newLegacyPair(t)
+
+	m := NewPlainMessage(nil, nil, []byte("a1"))
+	if err := m.Encrypt(a); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePayload(nil, nil, m.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := parsed.Decrypt(other); err != ratchet.ErrUnknownHeader {
+		t.Fatalf("got %v, want %v", err, ratchet.ErrUnknownHeader)
+	}
+}
+
+func TestKeptSession(t *testing.T) {
+	old, oldResponder := newX3DHPair(t)
+	_, responder := newX3DHPair(t)
+
+	// b switched to a new session, messages a sent with the old one are still
+	// decrypted with the kept chain
+	responder.KeepSession(oldResponder)
+
+	var payloads [][]byte
+	for _, plaintext := range []string{"a1", "a2"} {
+		m := NewPlainMessage(nil, nil, []byte(plaintext))
+		if err := m.Encrypt(old); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, m.Payload())
+	}
+
+	steps := []struct {
+		payload []byte
+		ok      bool
+	}{
+		{payloads[1], true},
+		{payloads[1], false}, // replayed
+		{payloads[0], true},
+	}
+
+	for i, step := range steps {
+		m, err := ParsePayload(nil, nil, step.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.Decrypt(responder)
+		if step.ok && err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if !step.ok && err == nil {
+			t.Fatalf("step %d: decrypted a replayed message", i)
+		}
+	}
+}
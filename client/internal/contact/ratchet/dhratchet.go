@@ -18,13 +18,18 @@ const (
 )
 
 type DHRatchet struct {
-	KeyPair           crypt.KeyPair
-	RootKey           []byte
-	ChildKey          []byte
-	CurrentMRatchet   *MessageRatchet
-	PreviousMRatchets []MessageRatchet
-	RatchetIndex      int
-	State             RatchetState
+	KeyPair                crypt.KeyPair
+	RootKey                []byte
+	ChildKey               []byte
+	SendingMRatchet        *MessageRatchet  // chain of the messages sent with KeyPair
+	CurrentMRatchet        *MessageRatchet  // chain of the messages received with the contact's current key
+	PreviousMRatchets      []MessageRatchet // retired receiving chains, for messages still in flight
+	PrevCount              int              // number of messages sent on the previous sending chain
+	NextSendingHeaderKey   []byte           // header key of the next sending chain, derived with the current one
+	NextReceivingHeaderKey []byte           // header key of the next receiving chain, derived with the current one
+	RatchetIndex           int
+	State                  RatchetState
+	Initial                *InitialHeader // set until the contact answers a session started with X3DH
 }
 
 func NewDHRatchet(keypair crypt.KeyPair, foreignPublicKey []byte, initState RatchetState) *DHRatchet {
@@ -33,18 +38,42 @@ func NewDHRatchet(keypair crypt.KeyPair, foreignPublicKey []byte, initState Ratc
 		log.Fatalf("Failed to generate shared secret: %v", err)
 	}
 
+	return newDHRatchet(rootKey, keypair, foreignPublicKey, initState)
+}
+
+func newDHRatchet(rootKey []byte, keypair crypt.KeyPair, foreignPublicKey []byte, initState RatchetState) *DHRatchet {
+	headerKey, initiatorNext, responderNext, err := headerKeys(rootKey)
+	if err != nil {
+		log.Fatalf("Failed to generate header keys: %v", err)
+	}
+
 	messageRatchet := NewMessageRatchet()
 	messageRatchet.Initialize(rootKey, foreignPublicKey)
+	messageRatchet.HeaderKey = headerKey
+
+	// the side starting the session sends on the chain of the shared root key,
+	// the other one receives on it
+	var sendingRatchet *MessageRatchet
+	nextSending, nextReceiving := responderNext, initiatorNext
+	if initState == Sending {
+		sendingRatchet = NewMessageRatchet()
+		sendingRatchet.Initialize(rootKey, foreignPublicKey)
+		sendingRatchet.HeaderKey = headerKey
+		nextSending, nextReceiving = initiatorNext, responderNext
+	}
 
 	initGob()
 
 	return &DHRatchet{
-		KeyPair:           keypair,
-		RootKey:           rootKey,
-		CurrentMRatchet:   messageRatchet,
-		PreviousMRatchets: []MessageRatchet{},
-		RatchetIndex:      0,
-		State:             initState,
+		KeyPair:                keypair,
+		RootKey:                rootKey,
+		SendingMRatchet:        sendingRatchet,
+		CurrentMRatchet:        messageRatchet,
+		PreviousMRatchets:      []MessageRatchet{},
+		NextSendingHeaderKey:   nextSending,
+		NextReceivingHeaderKey: nextReceiving,
+		RatchetIndex:           0,
+		State:                  initState,
 	}
 }
 
@@ -70,13 +99,21 @@ func (r *DHRatchet) Unmarshal(data []byte) error {
 	return decoder.Decode(r)
 }
 
-func (r *DHRatchet) RKCycle(foreignPublicKey []byte) {
-	if foreignPublicKey == nil {
-		foreignPublicKey = r.CurrentMRatchet.ForeignPublicKey
+// RKCycle steps the ratchet with a new key of the contact. The receiving chain
+// of its previous key is retired, prevCount being the number of messages the
+// contact sent on it, and a new receiving chain is started.
+func (r *DHRatchet) RKCycle(foreignPublicKey []byte, prevCount int) error {
+	if prevCount < 0 {
+		return fmt.Errorf("invalid previous chain length: %d", prevCount)
 	}
 
 	// Store current ratchet before creating a new one
 	if len(r.CurrentMRatchet.ForeignPublicKey) > 0 {
+		err := r.CurrentMRatchet.Retire(prevCount)
+		if err != nil {
+			return err
+		}
+
 		r.PreviousMRatchets = append(r.PreviousMRatchets, *r.CurrentMRatchet)
 
 		// Limit the number of stored previous ratchets (optional)
@@ -85,38 +122,114 @@ func (r *DHRatchet) RKCycle(foreignPublicKey []byte) {
 		}
 	}
 
+	messageRatchet, nextHeaderKey, err := r.rootCycle(foreignPublicKey)
+	if err != nil {
+		return err
+	}
+
+	messageRatchet.HeaderKey = r.NextReceivingHeaderKey
+	r.NextReceivingHeaderKey = nextHeaderKey
+	r.CurrentMRatchet = messageRatchet
+	r.State = Receiving
+
+	return nil
+}
+
+// SendingCycle starts a new sending chain with a new key pair, once a new key
+// of the contact was received.
+func (r *DHRatchet) SendingCycle(keypair crypt.KeyPair) error {
+	r.KeyPair = keypair
+
+	messageRatchet, nextHeaderKey, err := r.rootCycle(r.CurrentMRatchet.ForeignPublicKey)
+	if err != nil {
+		return err
+	}
+
+	messageRatchet.HeaderKey = r.NextSendingHeaderKey
+	r.NextSendingHeaderKey = nextHeaderKey
+
+	r.PrevCount = 0
+	if r.SendingMRatchet != nil {
+		r.PrevCount = r.SendingMRatchet.Count()
+	}
+
+	r.SendingMRatchet = messageRatchet
+	r.State = Sending
+
+	return nil
+}
+
+// rootCycle advances the root key with the DH of the own key pair and
+// foreignPublicKey. It returns the chain derived from it and the header key of
+// the chain after it in the same direction.
+func (r *DHRatchet) rootCycle(foreignPublicKey []byte) (*MessageRatchet, []byte, error) {
 	dhKey, err := crypt.GenerateSharedSecret(r.KeyPair, foreignPublicKey)
 	if err != nil {
-		log.Printf("Failed to generate shared secret: %v", err)
-		return
+		return nil, nil, fmt.Errorf("failed to generate shared secret: %w", err)
 	}
 
-	keyMaterial, err := derive(r.RootKey, dhKey, []byte("Ratchet"), 2*crypt.KEY_LENGTH)
+	keyMaterial, err := derive(r.RootKey, dhKey, []byte("Ratchet"), 3*crypt.KEY_LENGTH)
 	if err != nil {
-		log.Printf("Failed to generate key material: %v", err)
-		return
+		return nil, nil, fmt.Errorf("failed to generate key material: %w", err)
 	}
 
 	r.RootKey = keyMaterial[:crypt.KEY_LENGTH]
-	r.ChildKey = keyMaterial[crypt.KEY_LENGTH:]
+	r.ChildKey = keyMaterial[crypt.KEY_LENGTH : 2*crypt.KEY_LENGTH]
 
 	// Create a new message ratchet with proper initialization
-	r.CurrentMRatchet = NewMessageRatchet()
-	r.CurrentMRatchet.Initialize(r.RootKey, foreignPublicKey)
+	messageRatchet := NewMessageRatchet()
+	messageRatchet.Initialize(r.RootKey, foreignPublicKey)
 	r.RatchetIndex++
+
+	return messageRatchet, keyMaterial[2*crypt.KEY_LENGTH:], nil
+}
+
+// ContinueIndex continues the ratchet index of a session this one replaces.
+// Messages are stored by ratchet index, a new session starting at 0 again
+// would overwrite the ones of the previous session.
+func (r *DHRatchet) ContinueIndex(previous *DHRatchet) {
+	r.RatchetIndex += previous.RatchetIndex + 1
+}
+
+// Clone copies the ratchet, stepping the copy does not change it.
+func (r *DHRatchet) Clone() *DHRatchet {
+	c := *r
+	c.CurrentMRatchet = r.CurrentMRatchet.clone()
+	c.PreviousMRatchets = append([]MessageRatchet{}, r.PreviousMRatchets...)
+
+	return &c
 }
 
 func (r *DHRatchet) IsCurrentRatchet(publicKey []byte) bool {
 	return bytes.Equal(r.CurrentMRatchet.ForeignPublicKey, publicKey)
 }
 
+// Knows reports whether a message with the sealed header belongs to this
+// session, that is one of its header keys opens the header.
+func (r *DHRatchet) Knows(sealedHeader []byte) bool {
+	_, _, err := r.OpenHeader(sealedHeader)
+	return err == nil
+}
+
+// KeepSession keeps the receiving chain of another session with the same
+// contact, so messages already sent on it can still be decrypted after the
+// contact switched to this one.
+func (r *DHRatchet) KeepSession(other *DHRatchet) {
+	r.PreviousMRatchets = append(r.PreviousMRatchets, *other.CurrentMRatchet)
+
+	if len(r.PreviousMRatchets) > PREV_RATCHET_LIMIT {
+		r.PreviousMRatchets = r.PreviousMRatchets[len(r.PreviousMRatchets)-PREV_RATCHET_LIMIT:]
+	}
+}
+
 func (r *DHRatchet) GetPrevRatchet(publicKey []byte) *MessageRatchet {
 	fmt.Printf("Searching for previous ratchet with public key: %x\n", publicKey)
 
-	for _, ratchet := range r.PreviousMRatchets {
+	for i := range r.PreviousMRatchets {
+		ratchet := &r.PreviousMRatchets[i]
 		fmt.Printf("Checking public key: %x\n", ratchet.ForeignPublicKey)
 		if bytes.Equal(ratchet.ForeignPublicKey, publicKey) {
-			return &ratchet
+			return ratchet
 		}
 	}
 
@@ -0,0 +1,89 @@
+package ratchet
+
+import (
+	"client-go/internal/crypt"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// HEADER_TAG_LENGTH is the length of the authentication tag of a sealed header.
+const HEADER_TAG_LENGTH = 16
+
+// ErrUnknownHeader is returned for a header that none of the header keys of a
+// session can open, the message belongs to another session or was forged.
+var ErrUnknownHeader = errors.New("header not sealed with a key of the session")
+
+// headerKeys derives the header keys of a new session from its root key: the
+// key of the first chain, and the next header keys of the side starting the
+// session and of the other one.
+func headerKeys(rootKey []byte) (first, initiatorNext, responderNext []byte, err error) {
+	keyMaterial, err := derive(rootKey, nil, []byte("Header"), 3*crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return keyMaterial[:crypt.KEY_LENGTH], keyMaterial[crypt.KEY_LENGTH : 2*crypt.KEY_LENGTH], keyMaterial[2*crypt.KEY_LENGTH:], nil
+}
+
+// HasHeaderKeys reports whether the session has header keys. Sessions stored
+// before headers were encrypted have none and cannot be continued.
+func (r *DHRatchet) HasHeaderKeys() bool {
+	return len(r.NextSendingHeaderKey) > 0 && len(r.NextReceivingHeaderKey) > 0
+}
+
+// SealHeader encrypts the header of a message sent on the current sending
+// chain with the chain's header key.
+func (r *DHRatchet) SealHeader(header []byte) ([]byte, error) {
+	if r.SendingMRatchet == nil {
+		return nil, fmt.Errorf("no sending chain")
+	}
+
+	nonce := make([]byte, NONCE_LENGTH)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed, err := crypt.EncryptAES(r.SendingMRatchet.HeaderKey, header, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, sealed...), nil
+}
+
+// OpenHeader decrypts a sealed header by trying the header keys of the current
+// receiving chain, of the previous ones and the next header key. It returns the
+// header and the chain of the message, the chain is nil if the header was
+// sealed with the next header key: the contact started a new chain and the
+// ratchet has to step before decrypting the message.
+func (r *DHRatchet) OpenHeader(sealed []byte) ([]byte, *MessageRatchet, error) {
+	if len(sealed) < NONCE_LENGTH+HEADER_TAG_LENGTH {
+		return nil, nil, fmt.Errorf("sealed header too short: %d bytes", len(sealed))
+	}
+
+	if header, err := openHeader(r.CurrentMRatchet.HeaderKey, sealed); err == nil {
+		return header, r.CurrentMRatchet, nil
+	}
+
+	for i := len(r.PreviousMRatchets) - 1; i >= 0; i-- {
+		chain := &r.PreviousMRatchets[i]
+		if header, err := openHeader(chain.HeaderKey, sealed); err == nil {
+			return header, chain, nil
+		}
+	}
+
+	if header, err := openHeader(r.NextReceivingHeaderKey, sealed); err == nil {
+		return header, nil, nil
+	}
+
+	return nil, nil, ErrUnknownHeader
+}
+
+func openHeader(key, sealed []byte) ([]byte, error) {
+	if len(key) != crypt.KEY_LENGTH {
+		return nil, ErrUnknownHeader
+	}
+
+	return crypt.DecryptAES(key, sealed[NONCE_LENGTH:], sealed[:NONCE_LENGTH])
+}
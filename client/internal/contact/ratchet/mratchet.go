@@ -19,6 +19,7 @@ type MessageRatchet struct {
 	ForeignPublicKey   []byte
 	RootKey            []byte
 	ChainKey           []byte         // Current chain key (for deriving the next keys)
+	HeaderKey          []byte         // Key the headers of the chain's messages are sealed with
 	SkippedMessageKeys map[int][]byte // Keys for skipped messages
 	MaxSkip            int            // Maximum number of message keys to store
 	PreviousIndex      int            // Last received message index
@@ -96,40 +97,101 @@ func (m *MessageRatchet) Encrypt(plaintext []byte) ([]byte, []byte, int, error)
 	return append(nonce, cipherText...), macHash, nextIndex, nil
 }
 
+// Count returns the number of messages sent or received on the chain so far.
+func (m *MessageRatchet) Count() int {
+	return m.PreviousIndex + 1
+}
+
+// skip stores the keys of the messages before msgIdx that were not received,
+// to decrypt them when they arrive out of order.
+func (m *MessageRatchet) skip(msgIdx int) error {
+	if msgIdx <= m.PreviousIndex+1 {
+		return nil
+	}
+
+	skipped := msgIdx - (m.PreviousIndex + 1)
+	if skipped > m.MaxSkip {
+		return fmt.Errorf("too many skipped messages: %d", skipped)
+	}
+
+	for i := m.PreviousIndex + 1; i < msgIdx; i++ {
+		m.SkippedMessageKeys[i] = m.CKCycle()
+	}
+	m.PreviousIndex = msgIdx - 1
+
+	return nil
+}
+
+// Retire stores the keys of the messages still in flight on a chain the
+// contact stopped sending on, count being the number of messages it sent on
+// it, and drops the chain key. Only the stored keys can be used afterwards.
+func (m *MessageRatchet) Retire(count int) error {
+	err := m.skip(count)
+	if err != nil {
+		return err
+	}
+
+	m.RootKey = nil
+	m.ChainKey = nil
+
+	return nil
+}
+
+func (m *MessageRatchet) retired() bool {
+	return m.RootKey == nil && m.ChainKey == nil
+}
+
+// clone copies the chain, the copy can be advanced without changing it.
+func (m *MessageRatchet) clone() *MessageRatchet {
+	c := *m
+	c.SkippedMessageKeys = make(map[int][]byte, len(m.SkippedMessageKeys))
+	for i, key := range m.SkippedMessageKeys {
+		c.SkippedMessageKeys[i] = key
+	}
+
+	return &c
+}
+
 func (m *MessageRatchet) Decrypt(cipherText, macHash []byte, msgIdx int) ([]byte, error) {
 	if msgKey, exists := m.SkippedMessageKeys[msgIdx]; exists {
-		defer delete(m.SkippedMessageKeys, msgIdx)
+		plaintext, err := m.decryptWithKey(cipherText, macHash, msgKey)
+		if err == nil {
+			delete(m.SkippedMessageKeys, msgIdx)
+		}
 
-		return m.decryptWithKey(cipherText, macHash, msgKey)
+		return plaintext, err
 	}
 
 	if msgIdx < 0 {
 		return nil, fmt.Errorf("invalid message key index")
 	}
 
-	if msgIdx > m.PreviousIndex+1 {
-		skipped := msgIdx - (m.PreviousIndex + 1)
+	if m.retired() {
+		return nil, fmt.Errorf("no key for message %d of a retired chain", msgIdx)
+	}
 
-		if skipped > m.MaxSkip {
-			return nil, fmt.Errorf("too many skipped messages: %d", skipped)
-		}
+	if msgIdx <= m.PreviousIndex {
+		return nil, fmt.Errorf("message index already processed: %d", msgIdx)
+	}
 
-		for i := m.PreviousIndex + 1; i < msgIdx; i++ {
-			skippedKey := m.CKCycle()
-			m.SkippedMessageKeys[i] = skippedKey
-		}
+	// advance a copy, the chain only moves once the message authenticated
+	next := m.clone()
+
+	err := next.skip(msgIdx)
+	if err != nil {
+		return nil, err
 	}
 
-	var messageKey []byte
+	messageKey := next.CKCycle()
+	next.PreviousIndex = msgIdx
 
-	if msgIdx <= m.PreviousIndex {
-		return nil, fmt.Errorf("message index already processed: %d", msgIdx)
-	} else {
-		messageKey = m.CKCycle()
+	plaintext, err := next.decryptWithKey(cipherText, macHash, messageKey)
+	if err != nil {
+		return nil, err
 	}
 
-	m.PreviousIndex = msgIdx
-	return m.decryptWithKey(cipherText, macHash, messageKey)
+	*m = *next
+	return plaintext, nil
 }
 
 func (m *MessageRatchet) decryptWithKey(cipherText, macHash, messageKey []byte) ([]byte, error) {
@@ -141,6 +203,10 @@ func (m *MessageRatchet) decryptWithKey(cipherText, macHash, messageKey []byte)
 
 	encryptionKey, authenticationKey := derivedKey[:crypt.KEY_LENGTH], derivedKey[crypt.KEY_LENGTH:]
 
+	if len(cipherText) < NONCE_LENGTH {
+		return nil, fmt.Errorf("ciphertext too short: %d bytes", len(cipherText))
+	}
+
 	nonce, cipherText := cipherText[:NONCE_LENGTH], cipherText[NONCE_LENGTH:]
 
 	mac := hmac.New(sha256.New, authenticationKey)
@@ -0,0 +1,118 @@
+package ratchet
+
+import (
+	"bytes"
+	"client-go/internal/crypt"
+	"fmt"
+)
+
+// NO_ONE_TIME_PREKEY is the one-time prekey ID of a session started without a
+// one-time prekey, because the contact had none left.
+const NO_ONE_TIME_PREKEY = 0
+
+// PrekeyBundle holds the keys a contact published to start X3DH sessions with.
+// The signature of the signed prekey has to be verified before using it.
+type PrekeyBundle struct {
+	IdentityKey     []byte
+	SignedPrekeyID  uint32
+	SignedPrekey    []byte
+	OneTimePrekeyID uint32
+	OneTimePrekey   []byte // nil if the contact had none left
+}
+
+// InitialHeader is sent with every message of a session started with X3DH until
+// the contact answers, so the contact can derive the same root key. It carries
+// the sender's signing key and its signature of the identity key, for the
+// contact to verify.
+type InitialHeader struct {
+	IdentityKey       []byte
+	SigningKey        []byte
+	IdentitySignature []byte
+	EphemeralKey      []byte
+	SignedPrekeyID    uint32
+	OneTimePrekeyID   uint32
+}
+
+// NewInitiatorRatchet starts a session with a contact from its prekey bundle.
+// The ephemeral key becomes the first sending ratchet key, the contact's signed
+// prekey its first receiving one.
+func NewInitiatorRatchet(identity crypt.KeyPair, signingKey crypt.SigningKeyPair, bundle PrekeyBundle) (*DHRatchet, error) {
+	ephemeral, err := crypt.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	dhs := []dhInput{
+		{identity.PrivateKey, bundle.SignedPrekey},
+		{ephemeral.PrivateKey, bundle.IdentityKey},
+		{ephemeral.PrivateKey, bundle.SignedPrekey},
+	}
+	if bundle.OneTimePrekey != nil {
+		dhs = append(dhs, dhInput{ephemeral.PrivateKey, bundle.OneTimePrekey})
+	}
+
+	rootKey, err := x3dh(dhs)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newDHRatchet(rootKey, ephemeral, bundle.SignedPrekey, Sending)
+	r.Initial = &InitialHeader{
+		IdentityKey:       identity.PublicKey,
+		SigningKey:        signingKey.PublicKey,
+		IdentitySignature: crypt.Sign(signingKey, identity.PublicKey),
+		EphemeralKey:      ephemeral.PublicKey,
+		SignedPrekeyID:    bundle.SignedPrekeyID,
+		OneTimePrekeyID:   bundle.OneTimePrekeyID,
+	}
+
+	if bundle.OneTimePrekey == nil {
+		r.Initial.OneTimePrekeyID = NO_ONE_TIME_PREKEY
+	}
+
+	return r, nil
+}
+
+// NewResponderRatchet accepts a session started by a contact with the prekeys
+// named in header. oneTimePrekey is nil if the contact did not use one.
+func NewResponderRatchet(identity, signedPrekey crypt.KeyPair, oneTimePrekey *crypt.KeyPair, header InitialHeader) (*DHRatchet, error) {
+	dhs := []dhInput{
+		{signedPrekey.PrivateKey, header.IdentityKey},
+		{identity.PrivateKey, header.EphemeralKey},
+		{signedPrekey.PrivateKey, header.EphemeralKey},
+	}
+	if oneTimePrekey != nil {
+		dhs = append(dhs, dhInput{oneTimePrekey.PrivateKey, header.EphemeralKey})
+	}
+
+	rootKey, err := x3dh(dhs)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDHRatchet(rootKey, signedPrekey, header.EphemeralKey, Receiving), nil
+}
+
+// dhInput is the private and the public key of one of the DHs of X3DH.
+type dhInput struct {
+	private []byte
+	public  []byte
+}
+
+// x3dh derives the root key from the concatenated DH outputs, as described in
+// the X3DH specification.
+func x3dh(dhs []dhInput) ([]byte, error) {
+	// 32 0xFF bytes separate the input from a curve25519 public key
+	input := bytes.Repeat([]byte{0xFF}, crypt.KEY_LENGTH)
+
+	for _, dh := range dhs {
+		secret, err := crypt.GenerateSharedSecret(crypt.KeyPair{PrivateKey: dh.private}, dh.public)
+		if err != nil {
+			return nil, fmt.Errorf("x3dh: %w", err)
+		}
+
+		input = append(input, secret...)
+	}
+
+	return derive(input, nil, []byte("X3DH"), crypt.KEY_LENGTH)
+}
@@ -0,0 +1,53 @@
+package crypt
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	FINGERPRINT_VERSION    = 0
+	FINGERPRINT_ITERATIONS = 5200
+	// FINGERPRINT_GROUPS groups of 5 digits make up the fingerprint of one user
+	FINGERPRINT_GROUPS = 6
+)
+
+// Fingerprint derives the 30 digit fingerprint of a user from its identity key
+// and a stable identifier of the user, as in Signal's numeric fingerprints.
+func Fingerprint(identityKey, stableID []byte) string {
+	hash := []byte{0, FINGERPRINT_VERSION}
+	hash = append(hash, identityKey...)
+	hash = append(hash, stableID...)
+
+	for range FINGERPRINT_ITERATIONS {
+		h := sha512.New()
+		h.Write(hash)
+		h.Write(identityKey)
+		hash = h.Sum(nil)
+	}
+
+	var digits strings.Builder
+	for i := range FINGERPRINT_GROUPS {
+		// 5 bytes per group, reduced to 5 digits
+		chunk := make([]byte, 8)
+		copy(chunk[3:], hash[i*5:i*5+5])
+		fmt.Fprintf(&digits, "%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+
+	return digits.String()
+}
+
+// SafetyNumber combines the fingerprints of two users into the 60 digit number
+// both of them see, the lower fingerprint comes first.
+func SafetyNumber(localKey, localID, remoteKey, remoteID []byte) string {
+	local := Fingerprint(localKey, localID)
+	remote := Fingerprint(remoteKey, remoteID)
+
+	if local < remote {
+		return local + remote
+	}
+
+	return remote + local
+}
@@ -0,0 +1,46 @@
+package crypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+)
+
+const (
+	SIGNATURE_LENGTH = ed25519.SignatureSize
+)
+
+// SigningKeyPair is an Ed25519 key pair, used to sign the keys a user publishes.
+type SigningKeyPair struct {
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+func (k *SigningKeyPair) IsValid() bool {
+	if len(k.PublicKey) != ed25519.PublicKeySize || len(k.PrivateKey) != ed25519.PrivateKeySize {
+		return false
+	}
+
+	return true
+}
+
+func GenerateSigningKeyPair() (SigningKeyPair, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKeyPair{}, err
+	}
+
+	return SigningKeyPair{PublicKey: pub, PrivateKey: priv}, nil
+}
+
+func Sign(key SigningKeyPair, message []byte) []byte {
+	return ed25519.Sign(key.PrivateKey, message)
+}
+
+// Verify reports whether signature is a valid signature of message by publicKey.
+func Verify(publicKey, message, signature []byte) bool {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, message, signature)
+}
@@ -0,0 +1,903 @@
+// Package fakerelay is an in-process stand-in for the Elixir relay server. It
+// speaks the same protocol as tcpclient so clients can be exercised without
+// booting the real server.
+package fakerelay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"client-go/internal/crypt"
+	"client-go/internal/tcpclient"
+	"client-go/internal/utils"
+)
+
+const (
+	ID_HASH_LENGTH = 16
+	TOKEN_LENGTH   = 32
+	NONCE_LENGTH   = 12
+)
+
+type user struct {
+	idHash         []byte
+	publicKey      []byte
+	password       []byte
+	token          []byte
+	signedPrekey   *tcpclient.SignedPrekey
+	oneTimePrekeys []tcpclient.OneTimePrekey
+}
+
+type storedMessage struct {
+	senderIDHash   []byte
+	receiverIDHash []byte
+	messageID      tcpclient.MessageID // of the SendMessage packet, resends are dropped by it
+	uuid           []byte
+	data           []byte
+	timestamp      int64
+}
+
+// Fault describes how the relay misbehaves for a single incoming packet.
+type Fault struct {
+	Delay      time.Duration // wait before handling the packet
+	Drop       bool          // handle the packet but do not send a response
+	Error      string        // respond with an Error packet carrying this reason
+	Disconnect bool          // close the connection instead of handling the packet
+}
+
+// FaultFunc is consulted for every packet received by the relay.
+type FaultFunc func(messageType tcpclient.MessageType, data []byte) Fault
+
+type Relay struct {
+	mu          sync.Mutex
+	users       map[string]*user
+	keys        map[string][]byte
+	messages    []storedMessage
+	connections map[*connection]struct{}
+	listeners   []net.Listener
+	fault       FaultFunc
+	noiseKey    *crypt.KeyPair
+	handshake   tcpclient.ServerHandshake
+	chunks      *tcpclient.ChunkAssembler
+}
+
+type connection struct {
+	conn         net.Conn
+	idHash       []byte
+	noiseStatic  []byte // static key the client authenticated the Noise channel with
+	capabilities tcpclient.Capabilities
+	mu           sync.Mutex
+	writeMu      sync.Mutex // held while writing a frame, never together with mu
+}
+
+func New() *Relay {
+	return &Relay{
+		users:       make(map[string]*user),
+		keys:        make(map[string][]byte),
+		messages:    []storedMessage{},
+		connections: make(map[*connection]struct{}),
+		handshake: tcpclient.ServerHandshake{
+			Versions: tcpclient.PROTOCOL_VERSIONS,
+			Features: tcpclient.FeatureChunking | tcpclient.FeatureDeflate | tcpclient.FeaturePrekeys,
+		},
+		chunks: tcpclient.NewChunkAssembler(),
+	}
+}
+
+// SetHandshake changes the versions and features the relay offers in its
+// Handshake packet, the connection ID is filled in per connection. A Legacy
+// handshake only carries the connection ID, like the original relay.
+func (r *Relay) SetHandshake(handshake tcpclient.ServerHandshake) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handshake = handshake
+}
+
+// SetNoiseKey makes the relay expect a Noise handshake after its Handshake
+// packet, authenticated with the given static key. The client's static key must
+// be the identity key of the account it signs up or logs in with.
+func (r *Relay) SetNoiseKey(keypair crypt.KeyPair) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.noiseKey = &keypair
+}
+
+// SetFault installs a fault injection hook, passing nil removes it.
+func (r *Relay) SetFault(fault FaultFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fault = fault
+}
+
+// Listen starts accepting connections on a loopback port and returns the
+// address and port to pass to tcpclient.NewTCPServer.
+func (r *Relay) Listen() (string, int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", 0, err
+	}
+
+	r.accept(listener)
+
+	host, portStr, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, port, nil
+}
+
+// ListenUnix starts accepting connections on a Unix domain socket at path, for
+// tcpclient.UnixTransport.
+func (r *Relay) ListenUnix(path string) error {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	r.accept(listener)
+
+	return nil
+}
+
+// ListenWebSocket starts accepting WebSocket connections on a loopback port and
+// returns the ws:// URL to pass to tcpclient.WebSocketTransport.
+func (r *Relay) ListenWebSocket() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	r.listeners = append(r.listeners, listener)
+	r.mu.Unlock()
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			conn, err := tcpclient.AcceptWebSocket(w, req)
+			if err != nil {
+				log.Printf("fakerelay: %v", err)
+				return
+			}
+
+			r.Serve(conn)
+		}),
+	}
+	go server.Serve(listener)
+
+	return "ws://" + listener.Addr().String() + "/", nil
+}
+
+// accept serves every connection accepted by listener until it is closed.
+func (r *Relay) accept(listener net.Listener) {
+	r.mu.Lock()
+	r.listeners = append(r.listeners, listener)
+	r.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go r.Serve(conn)
+		}
+	}()
+}
+
+// Pipe returns the client end of an in-memory connection served by the relay.
+func (r *Relay) Pipe() net.Conn {
+	clientConn, serverConn := net.Pipe()
+
+	go r.Serve(serverConn)
+
+	return clientConn
+}
+
+// Transport returns an in-memory transport for tcpclient.NewTCPServerWithTransport,
+// every dial is served by the relay.
+func (r *Relay) Transport() tcpclient.Transport {
+	return &tcpclient.PipeTransport{Serve: r.Serve}
+}
+
+// Close stops all listeners and closes every open connection.
+func (r *Relay) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, listener := range r.listeners {
+		listener.Close()
+	}
+	r.listeners = nil
+
+	for c := range r.connections {
+		c.close()
+	}
+}
+
+// DropConnections closes every open connection but keeps accepting new ones, to
+// simulate a network failure.
+func (r *Relay) DropConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c := range r.connections {
+		c.close()
+	}
+}
+
+// ExpireTokens invalidates the auth token of every user, as if they had all
+// logged in somewhere else.
+func (r *Relay) ExpireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, u := range r.users {
+		u.token = newToken()
+	}
+}
+
+// Serve handles a single client connection until it is closed.
+func (r *Relay) Serve(conn net.Conn) {
+	c := &connection{
+		conn:         conn,
+		capabilities: tcpclient.Capabilities{Version: tcpclient.LEGACY_PROTOCOL_VERSION},
+	}
+
+	r.mu.Lock()
+	r.connections[c] = struct{}{}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.connections, c)
+		r.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	r.mu.Lock()
+	handshake := r.handshake
+	r.mu.Unlock()
+
+	handshake.ConnUUID = make([]byte, tcpclient.UUID_LENGTH)
+	rand.Read(handshake.ConnUUID)
+
+	data, err := handshake.Encode()
+	if err != nil {
+		log.Printf("fakerelay: invalid handshake: %v", err)
+		return
+	}
+
+	err = c.send(tcpclient.Handshake, tcpclient.MessageID{}, data)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	noiseKey := r.noiseKey
+	r.mu.Unlock()
+
+	if noiseKey != nil {
+		noiseConn, clientStatic, err := tcpclient.NoiseServer(conn, *noiseKey)
+		if err != nil {
+			log.Printf("fakerelay: noise handshake failed: %v", err)
+			return
+		}
+
+		c.mu.Lock()
+		c.conn = noiseConn
+		c.noiseStatic = clientStatic
+		c.mu.Unlock()
+	}
+
+	reader := tcpclient.NewFrameReader(c.conn, tcpclient.SEND_LENGTH_NR_BYTES)
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("fakerelay: error reading frame: %v", err)
+			}
+
+			return
+		}
+
+		// a zero length frame is what the 8 byte length prefix looks like to the
+		// real relay, which reads a 4 byte prefix; ignore it the same way
+		if len(frame) < tcpclient.PACKET_HEADER_LENGTH {
+			continue
+		}
+
+		frame, err = tcpclient.DecompressFrame(frame)
+		if err != nil {
+			log.Printf("fakerelay: %v", err)
+			return
+		}
+
+		if !r.handleFrame(c, frame) {
+			return
+		}
+	}
+}
+
+// handleFrame processes one packet, it returns false when the connection
+// should be closed.
+func (r *Relay) handleFrame(c *connection, frame []byte) bool {
+	messageType := tcpclient.MessageType(frame[1])
+	messageID := tcpclient.MessageID{}
+	copy(messageID[:], frame[2:tcpclient.PACKET_HEADER_LENGTH])
+	data := frame[tcpclient.PACKET_HEADER_LENGTH:]
+
+	r.mu.Lock()
+	faultFunc := r.fault
+	r.mu.Unlock()
+
+	fault := Fault{}
+	if faultFunc != nil {
+		fault = faultFunc(messageType, data)
+	}
+
+	if fault.Disconnect {
+		return false
+	}
+
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+
+	if fault.Error != "" {
+		c.send(tcpclient.Error, messageID, []byte(fault.Error))
+		return true
+	}
+
+	responseType, response, push, err := r.handlePacket(c, messageType, messageID, data)
+	if err != nil {
+		responseType = tcpclient.Error
+		response = []byte(err.Error())
+	}
+
+	if !fault.Drop && response != nil {
+		err = c.send(responseType, messageID, response)
+		if err != nil {
+			return false
+		}
+	}
+
+	// pushes to other connections go out after the response, like on the relay
+	if push != nil {
+		push()
+	}
+
+	return true
+}
+
+// handlePacket returns the response to a packet and, for SendMessage, a function
+// that pushes the message to the receiver.
+func (r *Relay) handlePacket(c *connection, messageType tcpclient.MessageType, messageID tcpclient.MessageID, data []byte) (tcpclient.MessageType, []byte, func(), error) {
+	switch messageType {
+	case tcpclient.Ack, tcpclient.Error:
+		return messageType, nil, nil, nil
+
+	case tcpclient.ReqKey:
+		return messageType, r.reqKey(data), nil, nil
+
+	case tcpclient.Ping:
+		return tcpclient.Pong, bytes.Clone(data), nil, nil
+
+	case tcpclient.Handshake:
+		return 0, nil, nil, r.clientHandshake(c, data)
+
+	case tcpclient.Chunk:
+		return r.chunk(c, messageID, data)
+	}
+
+	idHash, data, err := r.authenticate(messageType, data)
+	if err != nil {
+		return messageType, nil, nil, err
+	}
+
+	err = r.checkNoiseKey(c, messageType, idHash, data)
+	if err != nil {
+		return messageType, nil, nil, err
+	}
+
+	switch messageType {
+	case tcpclient.ReqLogin:
+		token, err := r.login(idHash, data)
+		if err != nil {
+			return messageType, nil, nil, err
+		}
+
+		c.setUser(idHash)
+		return messageType, token, nil, nil
+
+	case tcpclient.ReqSignup:
+		token, err := r.signup(idHash, data)
+		if err != nil {
+			return messageType, nil, nil, err
+		}
+
+		c.setUser(idHash)
+		return messageType, token, nil, nil
+
+	case tcpclient.ReqLogout:
+		c.setUser(nil)
+		return messageType, []byte{0}, nil, nil
+
+	case tcpclient.SendMessage:
+		messageUUID, push, err := r.sendMessage(idHash, messageID, data)
+		return messageType, messageUUID, push, err
+
+	case tcpclient.ReqMessages:
+		return messageType, r.reqMessages(idHash, data), nil, nil
+
+	case tcpclient.ReqPubKey:
+		publicKey, err := r.pubKey(data)
+		return messageType, publicKey, nil, err
+
+	case tcpclient.UploadPrekeys:
+		remaining, err := r.uploadPrekeys(idHash, data)
+		return messageType, remaining, nil, err
+	}
+
+	return messageType, nil, nil, fmt.Errorf("unknown_packet_type")
+}
+
+// authenticate strips the ID hash and, for authenticated packet types, the auth
+// token from data.
+func (r *Relay) authenticate(messageType tcpclient.MessageType, data []byte) ([]byte, []byte, error) {
+	if messageType == tcpclient.ReqLogin || messageType == tcpclient.ReqSignup {
+		if len(data) < ID_HASH_LENGTH {
+			return nil, nil, fmt.Errorf("invalid_packet_no_auth")
+		}
+
+		return data[:ID_HASH_LENGTH], data[ID_HASH_LENGTH:], nil
+	}
+
+	if len(data) < ID_HASH_LENGTH+TOKEN_LENGTH {
+		return nil, nil, fmt.Errorf("invalid_packet_with_auth")
+	}
+
+	idHash := data[:ID_HASH_LENGTH]
+	token := data[ID_HASH_LENGTH : ID_HASH_LENGTH+TOKEN_LENGTH]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, exists := r.users[string(idHash)]
+	if !exists {
+		return nil, nil, fmt.Errorf("user_not_found")
+	}
+
+	if u.token == nil || !bytes.Equal(u.token, token) {
+		return nil, nil, fmt.Errorf("invalid_packet_auth_verify")
+	}
+
+	return idHash, data[ID_HASH_LENGTH+TOKEN_LENGTH:], nil
+}
+
+// checkNoiseKey binds the static key of the Noise channel to the account: it
+// is the identity key announced when signing up, and logging in needs the
+// identity key the account signed up with.
+func (r *Relay) checkNoiseKey(c *connection, messageType tcpclient.MessageType, idHash, data []byte) error {
+	c.mu.Lock()
+	clientStatic := c.noiseStatic
+	c.mu.Unlock()
+
+	if clientStatic == nil {
+		return nil
+	}
+
+	var identityKey []byte
+
+	switch messageType {
+	case tcpclient.ReqSignup:
+		if len(data) < crypt.KEY_LENGTH {
+			return nil
+		}
+
+		identityKey = data[:crypt.KEY_LENGTH]
+	case tcpclient.ReqLogin:
+		r.mu.Lock()
+		u, exists := r.users[string(idHash)]
+		r.mu.Unlock()
+
+		// unknown users fail to log in anyway
+		if !exists {
+			return nil
+		}
+
+		identityKey = u.publicKey
+	default:
+		return nil
+	}
+
+	if !bytes.Equal(identityKey, clientStatic) {
+		return fmt.Errorf("noise_key_mismatch")
+	}
+
+	return nil
+}
+
+func (r *Relay) reqKey(idHash []byte) []byte {
+	key := make([]byte, crypt.KEY_LENGTH)
+	rand.Read(key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys[string(idHash)] = key
+
+	return key
+}
+
+// decryptPassword decrypts a password encrypted with the key handed out by
+// ReqKey, the key can only be used once.
+func (r *Relay) decryptPassword(idHash, nonce, encryptedPassword []byte) ([]byte, error) {
+	key, exists := r.keys[string(idHash)]
+	if !exists {
+		return nil, fmt.Errorf("login_failed")
+	}
+
+	delete(r.keys, string(idHash))
+
+	return crypt.DecryptAES(key, encryptedPassword, nonce)
+}
+
+func (r *Relay) login(idHash, data []byte) ([]byte, error) {
+	if len(data) < NONCE_LENGTH {
+		return nil, fmt.Errorf("login_failed")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, exists := r.users[string(idHash)]
+	if !exists {
+		return nil, fmt.Errorf("login_failed")
+	}
+
+	password, err := r.decryptPassword(idHash, data[:NONCE_LENGTH], data[NONCE_LENGTH:])
+	if err != nil || !bytes.Equal(password, u.password) {
+		u.token = nil
+		return nil, fmt.Errorf("login_failed")
+	}
+
+	u.token = newToken()
+
+	return u.token, nil
+}
+
+func (r *Relay) signup(idHash, data []byte) ([]byte, error) {
+	if len(data) < crypt.KEY_LENGTH+NONCE_LENGTH {
+		return nil, fmt.Errorf("signup_failed")
+	}
+
+	publicKey := data[:crypt.KEY_LENGTH]
+	nonce := data[crypt.KEY_LENGTH : crypt.KEY_LENGTH+NONCE_LENGTH]
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	password, err := r.decryptPassword(idHash, nonce, data[crypt.KEY_LENGTH+NONCE_LENGTH:])
+	if err != nil {
+		return nil, fmt.Errorf("signup_failed")
+	}
+
+	if _, exists := r.users[string(idHash)]; exists {
+		return nil, fmt.Errorf("user_exists")
+	}
+
+	u := &user{
+		idHash:    bytes.Clone(idHash),
+		publicKey: bytes.Clone(publicKey),
+		password:  password,
+		token:     newToken(),
+	}
+	r.users[string(idHash)] = u
+
+	return u.token, nil
+}
+
+func (r *Relay) sendMessage(senderIDHash []byte, messageID tcpclient.MessageID, data []byte) ([]byte, func(), error) {
+	if len(data) < ID_HASH_LENGTH {
+		return nil, nil, fmt.Errorf("invalid_message_receiver")
+	}
+
+	receiverIDHash := data[:ID_HASH_LENGTH]
+	messageData := bytes.Clone(data[ID_HASH_LENGTH:])
+
+	r.mu.Lock()
+
+	if _, exists := r.users[string(receiverIDHash)]; !exists {
+		r.mu.Unlock()
+		return nil, nil, fmt.Errorf("invalid_message_receiver")
+	}
+
+	// a resend of a message already stored, e.g. after the response timed out
+	for _, m := range r.messages {
+		if m.messageID == messageID && bytes.Equal(m.senderIDHash, senderIDHash) {
+			r.mu.Unlock()
+			return m.uuid, nil, nil
+		}
+	}
+
+	messageUUID := make([]byte, ID_HASH_LENGTH)
+	rand.Read(messageUUID)
+
+	r.messages = append(r.messages, storedMessage{
+		senderIDHash:   bytes.Clone(senderIDHash),
+		receiverIDHash: bytes.Clone(receiverIDHash),
+		messageID:      messageID,
+		uuid:           messageUUID,
+		data:           messageData,
+		timestamp:      time.Now().UnixMicro(),
+	})
+
+	receivers := []*connection{}
+	for c := range r.connections {
+		if c.isUser(receiverIDHash) {
+			receivers = append(receivers, c)
+		}
+	}
+
+	r.mu.Unlock()
+
+	push := func() {
+		pushData := append(bytes.Clone(senderIDHash), messageData...)
+
+		for _, c := range receivers {
+			c.send(tcpclient.RecvMessage, messageID, pushData)
+		}
+	}
+
+	return messageUUID, push, nil
+}
+
+func (r *Relay) reqMessages(idHash, data []byte) []byte {
+	var senderIDHash []byte
+	timestampBytes := data
+
+	if len(data) > ID_HASH_LENGTH {
+		senderIDHash = data[:ID_HASH_LENGTH]
+		timestampBytes = data[ID_HASH_LENGTH:]
+	}
+
+	lastTimestamp := int64(utils.BytesToInt(timestampBytes))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	response := []byte{}
+	for _, m := range r.messages {
+		if m.timestamp <= lastTimestamp {
+			continue
+		}
+
+		if senderIDHash == nil {
+			if !bytes.Equal(m.receiverIDHash, idHash) {
+				continue
+			}
+		} else {
+			received := bytes.Equal(m.receiverIDHash, idHash) && bytes.Equal(m.senderIDHash, senderIDHash)
+			sent := bytes.Equal(m.senderIDHash, idHash) && bytes.Equal(m.receiverIDHash, senderIDHash)
+
+			if !received && !sent {
+				continue
+			}
+		}
+
+		response = append(response, utils.IntToBytes(int64(len(m.data)+ID_HASH_LENGTH))...)
+		response = append(response, m.senderIDHash...)
+		response = append(response, m.data...)
+	}
+
+	return response
+}
+
+// pubKey returns the identity key of a user with, once the user uploaded
+// prekeys, a bundle holding one of the one-time prekeys, which is handed out
+// only once.
+func (r *Relay) pubKey(idHash []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, exists := r.users[string(idHash)]
+	if !exists {
+		return nil, fmt.Errorf("user_not_found")
+	}
+
+	response := tcpclient.PubKeyResponse{PublicKey: u.publicKey}
+
+	if u.signedPrekey != nil {
+		response.Bundle = &tcpclient.PrekeyBundle{SignedPrekey: *u.signedPrekey}
+
+		if len(u.oneTimePrekeys) > 0 {
+			response.Bundle.OneTimePrekey = &u.oneTimePrekeys[0]
+			u.oneTimePrekeys = u.oneTimePrekeys[1:]
+		}
+	}
+
+	return response.Encode()
+}
+
+func (r *Relay) uploadPrekeys(idHash, data []byte) ([]byte, error) {
+	request := tcpclient.PrekeyUploadRequest{}
+	err := request.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid_prekeys")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u := r.users[string(idHash)]
+	u.signedPrekey = &request.SignedPrekey
+	u.oneTimePrekeys = append(u.oneTimePrekeys, request.OneTimePrekeys...)
+
+	response := tcpclient.PrekeyUploadResponse{Remaining: uint32(len(u.oneTimePrekeys))}
+	return response.Encode()
+}
+
+// chunk collects the chunks of a large request. Every chunk but the last is
+// acknowledged, the last one is answered with the response to the request.
+func (r *Relay) chunk(c *connection, messageID tcpclient.MessageID, data []byte) (tcpclient.MessageType, []byte, func(), error) {
+	idHash, chunkData, err := r.authenticate(tcpclient.Chunk, data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	chunk := tcpclient.TransferChunk{}
+	err = chunk.Decode(chunkData)
+	if err != nil || chunk.MessageType == tcpclient.Chunk {
+		return 0, nil, nil, fmt.Errorf("invalid_chunk")
+	}
+
+	// transfers are kept per user, so they survive a reconnect
+	payload, _, err := r.chunks.Add(string(idHash)+string(messageID[:]), &chunk)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid_chunk")
+	}
+
+	if payload == nil {
+		return tcpclient.Ack, binary.BigEndian.AppendUint32(nil, uint32(chunk.Index)), nil, nil
+	}
+
+	auth := data[:len(data)-len(chunkData)]
+
+	return r.handlePacket(c, chunk.MessageType, messageID, append(bytes.Clone(auth), payload...))
+}
+
+// clientHandshake records the capabilities negotiated with the client.
+func (r *Relay) clientHandshake(c *connection, data []byte) error {
+	handshake := tcpclient.ClientHandshake{}
+	err := handshake.Decode(data)
+	if err != nil {
+		return fmt.Errorf("invalid_handshake")
+	}
+
+	r.mu.Lock()
+	offered := r.handshake
+	r.mu.Unlock()
+
+	version := byte(0)
+	for _, v := range handshake.Versions {
+		if slices.Contains(offered.Versions, v) && v > version {
+			version = v
+		}
+	}
+
+	if version == 0 {
+		return fmt.Errorf("invalid_handshake_version")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capabilities = tcpclient.Capabilities{Version: version, Features: offered.Features & handshake.Features}
+
+	return nil
+}
+
+// close closes the connection, unblocking a write in progress.
+func (c *connection) close() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	conn.Close()
+}
+
+func (c *connection) setUser(idHash []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idHash = bytes.Clone(idHash)
+}
+
+func (c *connection) isUser(idHash []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idHash != nil && bytes.Equal(c.idHash, idHash)
+}
+
+// send writes a packet, splitting it into Chunk packets if it is larger than
+// MAX_MESSAGE_SIZE.
+func (c *connection) send(messageType tcpclient.MessageType, messageID tcpclient.MessageID, data []byte) error {
+	if len(data) <= tcpclient.MAX_MESSAGE_SIZE {
+		return c.sendPacket(messageType, messageID, data)
+	}
+
+	c.mu.Lock()
+	capabilities := c.capabilities
+	c.mu.Unlock()
+
+	if !capabilities.Has(tcpclient.FeatureChunking) {
+		return c.sendPacket(tcpclient.Error, messageID, []byte("response_too_large"))
+	}
+
+	chunks, err := tcpclient.SplitChunks(messageType, data)
+	if err != nil {
+		return c.sendPacket(tcpclient.Error, messageID, []byte("response_too_large"))
+	}
+
+	for i := range chunks {
+		chunkData, err := chunks[i].Encode()
+		if err != nil {
+			return err
+		}
+
+		err = c.sendPacket(tcpclient.Chunk, messageID, chunkData)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendPacket writes a packet framed the way the relay frames it, with a 4 byte
+// length prefix. The write may block until the client reads, so mu is not held
+// meanwhile and the connection can still be closed.
+func (c *connection) sendPacket(messageType tcpclient.MessageType, messageID tcpclient.MessageID, data []byte) error {
+	c.mu.Lock()
+	capabilities := c.capabilities
+	conn := c.conn
+	c.mu.Unlock()
+
+	packet := append([]byte{capabilities.Version, byte(messageType)}, messageID[:]...)
+	packet = append(packet, data...)
+
+	if capabilities.Has(tcpclient.FeatureDeflate) {
+		packet = tcpclient.CompressFrame(packet)
+	}
+
+	prefix := utils.IntToBytes(int64(len(packet)))
+	frame := append(prefix[len(prefix)-tcpclient.RECV_LENGTH_NR_BYTES:], packet...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+func newToken() []byte {
+	token := make([]byte, TOKEN_LENGTH)
+	rand.Read(token)
+	return token
+}
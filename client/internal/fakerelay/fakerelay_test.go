@@ -0,0 +1,375 @@
+package fakerelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"client-go/internal/crypt"
+	"client-go/internal/tcpclient"
+)
+
+// waitForConnections waits until the relay serves n connections.
+func waitForConnections(t *testing.T, r *Relay, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		served := len(r.connections)
+		r.mu.Unlock()
+
+		if served == n {
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("relay does not serve %d connections", n)
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	relay := New()
+
+	// the client never reads, so the relay blocks writing its handshake
+	conn := relay.Pipe()
+	defer conn.Close()
+
+	waitForConnections(t, relay, 1)
+
+	closed := make(chan struct{})
+	go func() {
+		relay.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by a pending write")
+	}
+
+	waitForConnections(t, relay, 0)
+}
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport func(t *testing.T, relay *Relay) tcpclient.Transport
+	}{
+		{"pipe", func(t *testing.T, relay *Relay) tcpclient.Transport {
+			return relay.Transport()
+		}},
+		{"tcp", func(t *testing.T, relay *Relay) tcpclient.Transport {
+			host, port, err := relay.Listen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &tcpclient.TCPTransport{Address: net.JoinHostPort(host, strconv.Itoa(port))}
+		}},
+		{"unix", func(t *testing.T, relay *Relay) tcpclient.Transport {
+			path := filepath.Join(t.TempDir(), "relay.sock")
+			err := relay.ListenUnix(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &tcpclient.UnixTransport{Path: path}
+		}},
+		{"websocket", func(t *testing.T, relay *Relay) tcpclient.Transport {
+			url, err := relay.ListenWebSocket()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &tcpclient.WebSocketTransport{URL: url}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := New()
+			defer relay.Close()
+
+			server := tcpclient.NewTCPServerWithTransport(tt.transport(t, relay))
+			err := server.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			if !server.Capabilities().Has(tcpclient.FeatureDeflate) {
+				t.Fatal("handshake not negotiated")
+			}
+
+			key := tcpclient.KeyResponse{}
+			err = server.Request(context.Background(), &tcpclient.KeyRequest{IDHash: make([]byte, ID_HASH_LENGTH)}, &key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// sizes around the websocket length encodings, incompressible so
+			// deflate keeps them large
+			for _, size := range []int{1, 125, 126, 65535, 65536, 300_000} {
+				data := make([]byte, size)
+				rand.Read(data)
+
+				response, err := server.SendReceive(tcpclient.Ping, data)
+				if err != nil {
+					t.Fatalf("%d bytes: %v", size, err)
+				}
+				if !bytes.Equal(response.Data, data) {
+					t.Fatalf("%d bytes: ping echoed %d different bytes", size, len(response.Data))
+				}
+			}
+		})
+	}
+}
+
+// encryptPassword encrypts the password of every test account with the key the
+// relay hands out for idHash.
+func encryptPassword(server *tcpclient.TCPServer, idHash []byte) ([]byte, []byte, error) {
+	key := tcpclient.KeyResponse{}
+	err := server.Request(context.Background(), &tcpclient.KeyRequest{IDHash: idHash}, &key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, NONCE_LENGTH)
+	rand.Read(nonce)
+
+	encryptedPassword, err := crypt.EncryptAES(key.Key, []byte("password"), nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, encryptedPassword, nil
+}
+
+// signup signs up idHash with publicKey as identity key and authenticates the
+// session with the token handed out.
+func signup(server *tcpclient.TCPServer, idHash, publicKey []byte) error {
+	nonce, encryptedPassword, err := encryptPassword(server, idHash)
+	if err != nil {
+		return err
+	}
+
+	response := tcpclient.AuthResponse{}
+	err = server.Request(context.Background(), &tcpclient.SignupRequest{
+		IDHash:            idHash,
+		PublicKey:         publicKey,
+		Nonce:             nonce,
+		EncryptedPassword: encryptedPassword,
+	}, &response)
+	if err != nil {
+		return err
+	}
+
+	server.SetAuthID(tcpclient.AuthID(idHash))
+	server.SetAuthToken(response.Token)
+
+	return nil
+}
+
+// login authenticates the session of an account created by signup.
+func login(server *tcpclient.TCPServer, idHash []byte) error {
+	nonce, encryptedPassword, err := encryptPassword(server, idHash)
+	if err != nil {
+		return err
+	}
+
+	response := tcpclient.AuthResponse{}
+	err = server.Request(context.Background(), &tcpclient.LoginRequest{
+		IDHash:            idHash,
+		Nonce:             nonce,
+		EncryptedPassword: encryptedPassword,
+	}, &response)
+	if err != nil {
+		return err
+	}
+
+	server.SetAuthToken(response.Token)
+
+	return nil
+}
+
+func TestNoiseClientKey(t *testing.T) {
+	relayKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := New()
+	relay.SetNoiseKey(relayKey)
+	defer relay.Close()
+
+	server := tcpclient.NewTCPServerWithTransport(relay.Transport())
+	server.SetNoise(&tcpclient.NoiseConfig{StaticKey: clientKey, RemoteStatic: relayKey.PublicKey})
+	err = server.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// the identity key must be the key the channel was authenticated with
+	var serverErr *tcpclient.ServerError
+	err = signup(server, bytes.Repeat([]byte{1}, ID_HASH_LENGTH), otherKey.PublicKey)
+	if !errors.As(err, &serverErr) || serverErr.Reason != "noise_key_mismatch" {
+		t.Fatalf("signing up with another key: got %v, want noise_key_mismatch", err)
+	}
+
+	err = signup(server, bytes.Repeat([]byte{2}, ID_HASH_LENGTH), clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// progressRecorder keeps every progress report of a transfer.
+type progressRecorder struct {
+	mu      sync.Mutex
+	reports [][2]int
+}
+
+func (p *progressRecorder) report(done, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reports = append(p.reports, [2]int{done, total})
+}
+
+// total returns the number of chunks announced by the first report.
+func (p *progressRecorder) total() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.reports) == 0 {
+		return 0
+	}
+	return p.reports[0][1]
+}
+
+// check fails unless the transfer reported every chunk of total up to the last.
+func (p *progressRecorder) check(t *testing.T, total int) {
+	t.Helper()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if total == 0 || len(p.reports) != total {
+		t.Fatalf("progress reported %v, want %d chunks", p.reports, total)
+	}
+	for i, report := range p.reports {
+		if report != [2]int{i + 1, total} {
+			t.Fatalf("progress reported %v, want %d chunks", p.reports, total)
+		}
+	}
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	relay := New()
+	defer relay.Close()
+
+	connect := func(idHash []byte) *tcpclient.TCPServer {
+		server := tcpclient.NewTCPServerWithTransport(relay.Transport())
+		t.Cleanup(server.Close)
+
+		err := server.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !server.Capabilities().Has(tcpclient.FeatureChunking) {
+			t.Fatal("chunking not negotiated")
+		}
+
+		publicKey, _ := crypt.GenerateKeyPair()
+		err = signup(server, idHash, publicKey.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server.SetReconnectHandler(func() error {
+			return login(server, idHash)
+		})
+
+		return server
+	}
+
+	aliceIDHash := bytes.Repeat([]byte{1}, ID_HASH_LENGTH)
+	bobIDHash := bytes.Repeat([]byte{2}, ID_HASH_LENGTH)
+	alice := connect(aliceIDHash)
+	bob := connect(bobIDHash)
+
+	pushed := make(chan []byte, 1)
+	bob.RegisterHandler(tcpclient.RecvMessage, func(packet *tcpclient.Packet) {
+		pushed <- packet.Data
+	})
+
+	// the connection drops after the first chunk, the transfer resumes with the
+	// second one after the reconnect
+	var chunks atomic.Int32
+	relay.SetFault(func(messageType tcpclient.MessageType, data []byte) Fault {
+		if messageType == tcpclient.Chunk && chunks.Add(1) == 2 {
+			return Fault{Disconnect: true}
+		}
+		return Fault{}
+	})
+
+	message := make([]byte, tcpclient.MAX_MESSAGE_SIZE+tcpclient.CHUNK_SIZE+1)
+	rand.Read(message)
+	total := (len(message) + ID_HASH_LENGTH + tcpclient.CHUNK_SIZE - 1) / tcpclient.CHUNK_SIZE
+
+	sent := &progressRecorder{}
+	ctx, cancel := context.WithTimeout(tcpclient.WithProgress(context.Background(), sent.report), 30*time.Second)
+	defer cancel()
+
+	err := alice.Request(ctx, &tcpclient.SendMessageRequest{
+		ReceiverIDHash: bobIDHash,
+		Message:        message,
+	}, &tcpclient.SendMessageResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := chunks.Load(); n != int32(total)+1 {
+		t.Fatalf("relay received %d chunks, want %d and the one lost", n, total)
+	}
+	sent.check(t, total)
+
+	// the push and the fetched history are chunked by the relay
+	select {
+	case data := <-pushed:
+		want := append(bytes.Clone(aliceIDHash), message...)
+		if !bytes.Equal(data, want) {
+			t.Fatal("pushed message differs")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not pushed")
+	}
+
+	received := &progressRecorder{}
+	messages := tcpclient.MessagesResponse{}
+	err = bob.Request(tcpclient.WithProgress(context.Background(), received.report), &tcpclient.MessagesRequest{}, &messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(messages.Messages) != 1 || !bytes.Equal(messages.Messages[0].Message, message) {
+		t.Fatal("fetched message differs")
+	}
+	received.check(t, received.total())
+}
@@ -0,0 +1,314 @@
+package fakerelay
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Proxy is an in-process SOCKS5 and HTTP CONNECT proxy, to exercise clients
+// that reach the relay through one. The protocol is told apart by the first
+// byte a client sends.
+type Proxy struct {
+	mu          sync.Mutex
+	username    string
+	password    string
+	listener    net.Listener
+	connections map[net.Conn]struct{}
+	targets     []string
+}
+
+// NewProxy creates a proxy, with a non-empty username clients must
+// authenticate.
+func NewProxy(username, password string) *Proxy {
+	return &Proxy{
+		username:    username,
+		password:    password,
+		connections: make(map[net.Conn]struct{}),
+	}
+}
+
+// Listen starts accepting connections on a random local port and returns the
+// address of the proxy.
+func (p *Proxy) Listen() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	p.listener = listener
+	p.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go p.serve(conn)
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
+
+// Close stops the listener and closes every open tunnel.
+func (p *Proxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.listener != nil {
+		p.listener.Close()
+	}
+
+	for conn := range p.connections {
+		conn.Close()
+	}
+}
+
+// Targets returns the addresses clients asked to connect to, as they asked for
+// them, so host names show whether the client or the proxy resolved them.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func (p *Proxy) track(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.connections[conn] = struct{}{}
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.connections, conn)
+}
+
+func (p *Proxy) serve(conn net.Conn) {
+	p.track(conn)
+	defer func() {
+		p.untrack(conn)
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	var target net.Conn
+	if first[0] == 0x05 {
+		target, err = p.socks(conn, reader)
+	} else {
+		target, err = p.connect(conn, reader)
+	}
+
+	if err != nil {
+		log.Printf("fakerelay: proxy: %v", err)
+		return
+	}
+
+	p.track(target)
+	defer func() {
+		p.untrack(target)
+		target.Close()
+	}()
+
+	go func() {
+		io.Copy(target, reader)
+		target.Close()
+	}()
+
+	io.Copy(conn, target)
+}
+
+// socks handles the SOCKS5 greeting, authentication and CONNECT request.
+func (p *Proxy) socks(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(reader, methods)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(0x00)
+	if p.username != "" {
+		method = 0x02
+	}
+
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{0x05, 0xFF})
+		return nil, fmt.Errorf("no acceptable socks authentication method")
+	}
+
+	_, err = conn.Write([]byte{0x05, method})
+	if err != nil {
+		return nil, err
+	}
+
+	if method == 0x02 {
+		username, password, err := readSocksCredentials(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if username != p.username || password != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return nil, fmt.Errorf("invalid socks credentials")
+		}
+
+		_, err = conn.Write([]byte{0x01, 0x00})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// version, command, reserved, address type
+	request := make([]byte, 4)
+	_, err = io.ReadFull(reader, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var host string
+	switch request[3] {
+	case 0x01, 0x04:
+		length := net.IPv4len
+		if request[3] == 0x04 {
+			length = net.IPv6len
+		}
+
+		ip := make([]byte, length)
+		_, err = io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		var length byte
+		length, err = reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		name := make([]byte, length)
+		_, err = io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		return nil, fmt.Errorf("unsupported socks address type")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	port := make([]byte, 2)
+	_, err = io.ReadFull(reader, port)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	target, err := p.dial(address)
+	if err != nil {
+		// general failure
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	return target, nil
+}
+
+func readSocksCredentials(reader *bufio.Reader) (string, string, error) {
+	// version and username length
+	header := make([]byte, 2)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return "", "", err
+	}
+
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(reader, username)
+	if err != nil {
+		return "", "", err
+	}
+
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+
+	password := make([]byte, length)
+	_, err = io.ReadFull(reader, password)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(username), string(password), nil
+}
+
+// connect handles an HTTP CONNECT request.
+func (p *Proxy) connect(conn net.Conn, reader *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return nil, fmt.Errorf("unexpected method %s", req.Method)
+	}
+
+	if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		if req.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return nil, fmt.Errorf("invalid proxy credentials")
+		}
+	}
+
+	target, err := p.dial(req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// dial connects to the target, host names are resolved by the proxy.
+func (p *Proxy) dial(address string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, address)
+	p.mu.Unlock()
+
+	return net.Dial("tcp", address)
+}
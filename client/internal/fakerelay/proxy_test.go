@@ -0,0 +1,148 @@
+package fakerelay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"client-go/internal/tcpclient"
+)
+
+var proxySchemes = []string{"socks5", "socks5h", "http"}
+
+// newTestProxy starts a relay and a proxy requiring user:secret, it returns the
+// port of the relay and the address of the proxy.
+func newTestProxy(t *testing.T) (int, string, *Proxy) {
+	t.Helper()
+
+	relay := New()
+	t.Cleanup(relay.Close)
+
+	_, port, err := relay.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := NewProxy("user", "secret")
+	t.Cleanup(proxy.Close)
+
+	address, err := proxy.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port, address, proxy
+}
+
+func parseProxy(t *testing.T, rawURL string) *tcpclient.Proxy {
+	t.Helper()
+
+	proxy, err := tcpclient.ParseProxy(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return proxy
+}
+
+func TestProxyRoundTrip(t *testing.T) {
+	for _, scheme := range proxySchemes {
+		t.Run(scheme, func(t *testing.T) {
+			port, proxyAddress, _ := newTestProxy(t)
+
+			server := tcpclient.NewTCPServer("127.0.0.1", port)
+			defer server.Close()
+
+			err := server.SetProxy(parseProxy(t, scheme+"://user:secret@"+proxyAddress))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = server.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := tcpclient.KeyResponse{}
+			err = server.Request(context.Background(), &tcpclient.KeyRequest{IDHash: make([]byte, ID_HASH_LENGTH)}, &key)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestProxyDNS checks who resolves the relay's host name: the proxy for
+// socks5h:// and http://, the client for socks5://.
+func TestProxyDNS(t *testing.T) {
+	for _, scheme := range proxySchemes {
+		t.Run(scheme, func(t *testing.T) {
+			port, proxyAddress, proxy := newTestProxy(t)
+			target := net.JoinHostPort("localhost", strconv.Itoa(port))
+
+			conn, err := parseProxy(t, scheme+"://user:secret@"+proxyAddress).DialContext(context.Background(), target)
+			if err == nil {
+				conn.Close()
+			}
+
+			targets := proxy.Targets()
+			if len(targets) != 1 {
+				t.Fatalf("proxy asked for %q (%v)", targets, err)
+			}
+
+			host, _, _ := net.SplitHostPort(targets[0])
+			resolvedLocally := net.ParseIP(host) != nil
+
+			if resolvedLocally != (scheme == "socks5") {
+				t.Fatalf("proxy asked for %s", targets[0])
+			}
+		})
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	for _, scheme := range proxySchemes {
+		for _, userinfo := range []string{"", "user:wrong@"} {
+			t.Run(scheme+"/"+userinfo, func(t *testing.T) {
+				port, proxyAddress, proxy := newTestProxy(t)
+				target := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+				_, err := parseProxy(t, scheme+"://"+userinfo+proxyAddress).DialContext(context.Background(), target)
+
+				var authErr *tcpclient.ProxyAuthError
+				if !errors.As(err, &authErr) {
+					t.Fatalf("got %v, want a ProxyAuthError", err)
+				}
+
+				if targets := proxy.Targets(); len(targets) != 0 {
+					t.Fatalf("unauthenticated client tunneled to %q", targets)
+				}
+			})
+		}
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	// a port nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := listener.Addr().String()
+	listener.Close()
+
+	for _, scheme := range proxySchemes {
+		t.Run(scheme, func(t *testing.T) {
+			_, proxyAddress, _ := newTestProxy(t)
+
+			_, err := parseProxy(t, scheme+"://user:secret@"+proxyAddress).DialContext(context.Background(), target)
+
+			var proxyErr *tcpclient.ProxyError
+			if !errors.As(err, &proxyErr) {
+				t.Fatalf("got %v, want a ProxyError", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package fakerelay
+
+import (
+	"cmp"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+
+	"client-go/internal/tcpclient"
+)
+
+// Replayer serves a recording made by tcpclient.Recorder to a client. Requests
+// are answered with the responses recorded for the requests of the same type, in
+// order. Packets the server pushed on its own keep their place in the recording:
+// they are sent right after the response that preceded them, or after the
+// handshake of the first connection if they came before any response.
+type Replayer struct {
+	mu        sync.Mutex
+	handshake *tcpclient.RecordedPacket
+	responses map[tcpclient.MessageType][]*recordedResponse
+	pushes    []tcpclient.RecordedPacket // pushed before the first response
+	remaining int                        // pushed packets not sent yet
+	pushed    chan struct{}
+}
+
+// recordedResponse is the answer to one recorded request and the packets the
+// server pushed after it, up to the next response.
+type recordedResponse struct {
+	index   int // position of the first packet in the recording
+	packets []tcpclient.RecordedPacket
+	pushes  []tcpclient.RecordedPacket
+}
+
+// NewReplayer creates a Replayer for the packets of a recording.
+func NewReplayer(packets []tcpclient.RecordedPacket) *Replayer {
+	p := &Replayer{
+		responses: make(map[tcpclient.MessageType][]*recordedResponse),
+		pushed:    make(chan struct{}),
+	}
+
+	requestTypes := make(map[string]tcpclient.MessageType)
+	responses := make(map[string]*recordedResponse)
+	order := []string{}
+
+	// the response the following pushed packets are sent after
+	var last *recordedResponse
+
+	for i := range packets {
+		packet := packets[i]
+
+		switch {
+		case packet.MessageType == tcpclient.Ping || packet.MessageType == tcpclient.Pong:
+			// answered live, the heartbeat does not line up with the recording
+		case packet.MessageType == tcpclient.Handshake:
+			if packet.Direction == tcpclient.Inbound && p.handshake == nil {
+				p.handshake = &packet
+			}
+		case packet.Direction == tcpclient.Outbound:
+			// the chunks of a request share its message ID and its type is
+			// the type of the first one
+			if _, exists := requestTypes[packet.MessageID]; !exists {
+				requestTypes[packet.MessageID] = packet.MessageType
+				order = append(order, packet.MessageID)
+			}
+		default:
+			if _, exists := requestTypes[packet.MessageID]; exists {
+				if responses[packet.MessageID] == nil {
+					responses[packet.MessageID] = &recordedResponse{index: i}
+				}
+
+				last = responses[packet.MessageID]
+				last.packets = append(last.packets, packet)
+				continue
+			}
+
+			p.remaining++
+			if last == nil {
+				p.pushes = append(p.pushes, packet)
+			} else {
+				last.pushes = append(last.pushes, packet)
+			}
+		}
+	}
+
+	for _, messageID := range order {
+		if responses[messageID] == nil {
+			continue
+		}
+
+		messageType := requestTypes[messageID]
+		p.responses[messageType] = append(p.responses[messageType], responses[messageID])
+	}
+
+	if p.remaining == 0 {
+		close(p.pushed)
+	}
+
+	return p
+}
+
+// Transport returns an in-memory transport for tcpclient.NewTCPServerWithTransport,
+// every dial is served by the replayer.
+func (p *Replayer) Transport() tcpclient.Transport {
+	return &tcpclient.PipeTransport{Serve: p.Serve}
+}
+
+// Pushed is closed once the pushed packets of the recording have been sent.
+func (p *Replayer) Pushed() <-chan struct{} {
+	return p.pushed
+}
+
+// Serve replays the recording to a single client connection until it is closed.
+func (p *Replayer) Serve(conn net.Conn) {
+	c := &connection{
+		conn:         conn,
+		capabilities: tcpclient.Capabilities{Version: tcpclient.LEGACY_PROTOCOL_VERSION},
+	}
+	defer conn.Close()
+
+	handshake := tcpclient.ServerHandshake{
+		ConnUUID: make([]byte, tcpclient.UUID_LENGTH),
+		Legacy:   true,
+	}
+	rand.Read(handshake.ConnUUID)
+
+	if p.handshake != nil {
+		err := handshake.Decode(p.handshake.Data)
+		if err != nil {
+			log.Printf("fakerelay: invalid recorded handshake: %v", err)
+			return
+		}
+	}
+
+	data, err := handshake.Encode()
+	if err != nil {
+		log.Printf("fakerelay: invalid handshake: %v", err)
+		return
+	}
+
+	err = c.sendPacket(tcpclient.Handshake, tcpclient.MessageID{}, data)
+	if err != nil {
+		return
+	}
+
+	p.mu.Lock()
+	pushes := p.pushes
+	p.pushes = nil
+	p.mu.Unlock()
+
+	// only the first connection receives the packets pushed before any response
+	err = p.push(c, pushes)
+	if err != nil {
+		return
+	}
+
+	reader := tcpclient.NewFrameReader(conn, tcpclient.SEND_LENGTH_NR_BYTES)
+
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("fakerelay: error reading frame: %v", err)
+			}
+
+			return
+		}
+
+		if len(frame) < tcpclient.PACKET_HEADER_LENGTH {
+			continue
+		}
+
+		frame, err = tcpclient.DecompressFrame(frame)
+		if err != nil {
+			log.Printf("fakerelay: %v", err)
+			return
+		}
+
+		messageType := tcpclient.MessageType(frame[1])
+		messageID := tcpclient.MessageID{}
+		copy(messageID[:], frame[2:tcpclient.PACKET_HEADER_LENGTH])
+
+		err = p.answer(c, messageType, messageID, frame[tcpclient.PACKET_HEADER_LENGTH:])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answer sends the next recorded response to a request of the given type.
+func (p *Replayer) answer(c *connection, messageType tcpclient.MessageType, messageID tcpclient.MessageID, data []byte) error {
+	switch messageType {
+	case tcpclient.Handshake:
+		return nil
+	case tcpclient.Ping:
+		return c.sendPacket(tcpclient.Pong, messageID, data)
+	}
+
+	p.mu.Lock()
+	queue := p.responses[messageType]
+	var response *recordedResponse
+	if len(queue) > 0 {
+		response = queue[0]
+		p.responses[messageType] = queue[1:]
+	}
+	p.mu.Unlock()
+
+	if response == nil {
+		err := c.sendPacket(tcpclient.Error, messageID, []byte("replay_exhausted"))
+		if err != nil {
+			return err
+		}
+
+		// the pushes that followed responses which are never requested
+		// cannot be placed any better than at the end
+		return p.push(c, p.takeUnansweredPushes())
+	}
+
+	for _, packet := range response.packets {
+		data := packet.Data
+
+		// the token of a redacted login or signup response is made up, any token
+		// is accepted by the replayer
+		if packet.Redacted && packet.MessageType != tcpclient.Error {
+			data = newToken()
+		}
+
+		err := c.sendPacket(packet.MessageType, messageID, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.push(c, response.pushes)
+}
+
+// takeUnansweredPushes removes the pushed packets that follow the responses not
+// replayed yet, in the order they were recorded in.
+func (p *Replayer) takeUnansweredPushes() []tcpclient.RecordedPacket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var left []*recordedResponse
+	for _, queue := range p.responses {
+		left = append(left, queue...)
+	}
+
+	slices.SortFunc(left, func(a, b *recordedResponse) int {
+		return cmp.Compare(a.index, b.index)
+	})
+
+	var pushes []tcpclient.RecordedPacket
+	for _, response := range left {
+		pushes = append(pushes, response.pushes...)
+		response.pushes = nil
+	}
+
+	return pushes
+}
+
+// push sends packets the server pushed during the recording.
+func (p *Replayer) push(c *connection, pushes []tcpclient.RecordedPacket) error {
+	for _, packet := range pushes {
+		messageID := tcpclient.MessageID{}
+		rand.Read(messageID[:])
+
+		err := c.sendPacket(packet.MessageType, messageID, packet.Data)
+		if err != nil {
+			log.Printf("fakerelay: failed to replay pushed packet: %v", err)
+			return err
+		}
+
+		p.mu.Lock()
+		p.remaining--
+		if p.remaining == 0 {
+			close(p.pushed)
+		}
+		p.mu.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package fakerelay
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"client-go/internal/tcpclient"
+	"client-go/internal/utils"
+)
+
+func recorded(direction tcpclient.Direction, messageType tcpclient.MessageType, messageID byte, data string) tcpclient.RecordedPacket {
+	id := tcpclient.MessageID{messageID}
+
+	return tcpclient.RecordedPacket{
+		Direction:   direction,
+		Version:     tcpclient.LEGACY_PROTOCOL_VERSION,
+		MessageType: messageType,
+		MessageID:   hex.EncodeToString(id[:]),
+		Data:        []byte(data),
+	}
+}
+
+// replayClient speaks the packet framing to a replayer over a pipe.
+type replayClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *tcpclient.FrameReader
+}
+
+func (c *replayClient) send(messageType tcpclient.MessageType, messageID byte) {
+	c.t.Helper()
+
+	packet := append([]byte{tcpclient.LEGACY_PROTOCOL_VERSION, byte(messageType), messageID}, make([]byte, 15)...)
+	_, err := c.conn.Write(append(utils.IntToBytes(int64(len(packet))), packet...))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// receive returns the type and data of the next packet, or ok false if none
+// arrives within the timeout.
+func (c *replayClient) receive(timeout time.Duration) (tcpclient.MessageType, string, bool) {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+
+	frame, err := c.reader.ReadFrame()
+	if err != nil {
+		return 0, "", false
+	}
+
+	return tcpclient.MessageType(frame[1]), string(frame[tcpclient.PACKET_HEADER_LENGTH:]), true
+}
+
+func TestReplayPushOrder(t *testing.T) {
+	replayer := NewReplayer([]tcpclient.RecordedPacket{
+		recorded(tcpclient.Inbound, tcpclient.RecvMessage, 0xF0, "early"),
+		recorded(tcpclient.Outbound, tcpclient.ReqKey, 1, ""),
+		recorded(tcpclient.Inbound, tcpclient.ReqKey, 1, "key"),
+		recorded(tcpclient.Outbound, tcpclient.ReqLogin, 2, ""),
+		recorded(tcpclient.Inbound, tcpclient.ReqLogin, 2, "token"),
+		recorded(tcpclient.Inbound, tcpclient.RecvMessage, 0xF1, "after login"),
+		recorded(tcpclient.Outbound, tcpclient.SendMessage, 3, ""),
+		recorded(tcpclient.Inbound, tcpclient.SendMessage, 3, "sent"),
+		recorded(tcpclient.Inbound, tcpclient.RecvMessage, 0xF2, "never requested"),
+	})
+
+	server, conn := net.Pipe()
+	go replayer.Serve(server)
+	defer conn.Close()
+
+	c := &replayClient{t: t, conn: conn, reader: tcpclient.NewFrameReader(conn, tcpclient.RECV_LENGTH_NR_BYTES)}
+
+	steps := []struct {
+		request tcpclient.MessageType // sent before the packets are received, if not zero
+		want    []string
+	}{
+		{0, []string{"", "early"}}, // handshake
+		{tcpclient.ReqKey, []string{"key"}},
+		{tcpclient.ReqLogin, []string{"token", "after login"}},
+		// the request for SendMessage never comes, its push follows the end
+		// of the replay
+		{tcpclient.ReqMessages, []string{"replay_exhausted", "never requested"}},
+	}
+
+	for i, step := range steps {
+		if step.request != 0 {
+			c.send(step.request, byte(i))
+		}
+
+		for _, want := range step.want {
+			messageType, data, ok := c.receive(time.Second)
+			if !ok {
+				t.Fatalf("step %d: nothing received, want %q", i, want)
+			}
+
+			// the handshake carries a connection ID and the login token is
+			// made up
+			if messageType == tcpclient.Handshake || messageType == tcpclient.ReqLogin {
+				continue
+			}
+
+			if data != want {
+				t.Fatalf("step %d: received %q, want %q", i, data, want)
+			}
+		}
+
+		// nothing is pushed ahead of the next response
+		if messageType, data, ok := c.receive(50 * time.Millisecond); ok {
+			t.Fatalf("step %d: unexpected %d packet %q", i, messageType, data)
+		}
+	}
+
+	select {
+	case <-replayer.Pushed():
+	default:
+		t.Fatal("pushes not reported as sent")
+	}
+}
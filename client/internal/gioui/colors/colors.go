@@ -15,3 +15,5 @@ var SurfaceContainerHighest = color.NRGBA{R: 54, G: 52, B: 59, A: 255}
 var Primary = color.NRGBA{R: 208, G: 188, B: 255, A: 255}
 var OnPrimary = color.NRGBA{R: 56, G: 30, B: 114, A: 255}
 var OnPrimaryVariant = color.NRGBA{R: 79, G: 55, B: 139, A: 255}
+
+var Error = color.NRGBA{R: 242, G: 184, B: 181, A: 255}
@@ -6,8 +6,6 @@ import (
 	"client-go/internal/gioui/pages/chats"
 	"client-go/internal/gioui/pages/loading"
 	"client-go/internal/gioui/pages/login"
-	"log"
-	"os"
 
 	"gioui.org/app"
 	"gioui.org/op"
@@ -34,7 +32,8 @@ func (a *App) Loop(c *client.Client) error {
 
 	th := material.NewTheme()
 
-	router := page.NewRouter()
+	router := page.NewRouter(a.window.Invalidate)
+	router.WatchState(c.TCPServer)
 	router.Register("loading", loading.New(router, c))
 	router.Register("login", login.New(router, c))
 	router.Register("chats", chats.New(router, c))
@@ -42,11 +41,8 @@ func (a *App) Loop(c *client.Client) error {
 	for {
 		switch e := a.window.Event().(type) {
 		case app.DestroyEvent:
-			if e.Err != nil {
-				log.Fatal(e.Err)
-			}
-
-			os.Exit(0)
+			// the caller exits once the window is gone
+			return e.Err
 
 		case app.FrameEvent:
 			// This graphics context is used for managing the rendering state.
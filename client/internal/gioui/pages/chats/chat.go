@@ -19,6 +19,9 @@ func (p *Page) chat(gtx layout.Context, th *material.Theme) layout.Widget {
 			return layout.Flex{
 				Axis: layout.Vertical,
 			}.Layout(gtx,
+				layout.Rigid(
+					p.chatContactHeader(gtx, th),
+				),
 				layout.Flexed(
 					1.0,
 					func(gtx layout.Context) layout.Dimensions {
@@ -0,0 +1,185 @@
+package chats
+
+import (
+	"client-go/internal/client"
+	"client-go/internal/gioui/colors"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gioui.org/font"
+	"gioui.org/layout"
+	"gioui.org/widget/material"
+)
+
+// SAFETY_NUMBER_GROUP is the number of digits shown together, as the contact
+// reads them out.
+const SAFETY_NUMBER_GROUP = 5
+
+// formatSafetyNumber splits the safety number into groups of digits, on two lines.
+func formatSafetyNumber(number string) string {
+	var groups []string
+	for i := 0; i < len(number); i += SAFETY_NUMBER_GROUP {
+		groups = append(groups, number[i:min(i+SAFETY_NUMBER_GROUP, len(number))])
+	}
+
+	half := (len(groups) + 1) / 2
+	return strings.Join(groups[:half], " ") + "\n" + strings.Join(groups[half:], " ")
+}
+
+// keyChanged is the handler set with SetKeyChangeHandler, it keeps the change
+// to warn about it in the header of the chat.
+func (p *Page) keyChanged(change client.KeyChange) {
+	p.keyChangesMu.Lock()
+	p.keyChanges[string(change.ContactIDHash)] = change
+	p.keyChangesMu.Unlock()
+
+	p.Router.Invalidate()
+}
+
+// keyChange returns the unacknowledged key change of a contact, or nil.
+func (p *Page) keyChange(contactIDHash []byte) *client.KeyChange {
+	p.keyChangesMu.Lock()
+	defer p.keyChangesMu.Unlock()
+
+	change, ok := p.keyChanges[string(contactIDHash)]
+	if !ok {
+		return nil
+	}
+
+	return &change
+}
+
+func (p *Page) dismissKeyChange(contactIDHash []byte) {
+	p.keyChangesMu.Lock()
+	defer p.keyChangesMu.Unlock()
+
+	delete(p.keyChanges, string(contactIDHash))
+}
+
+func (p *Page) toggleVerified() {
+	verified := !p.client.IsContactVerified(p.selectedChat)
+
+	err := p.client.SetContactVerified(p.selectedChat, verified)
+	if err != nil {
+		log.Printf("Failed to verify contact: %v", err)
+		return
+	}
+
+	if verified {
+		p.dismissKeyChange(p.selectedChat)
+	}
+}
+
+func (p *Page) acceptKeyChange() {
+	err := p.client.AcceptKeyChange(p.selectedChat)
+	if err != nil {
+		log.Printf("Failed to accept key change: %v", err)
+		return
+	}
+
+	p.dismissKeyChange(p.selectedChat)
+}
+
+func (p *Page) chatContactHeader(gtx layout.Context, th *material.Theme) layout.Widget {
+	if p.selectedChat == nil {
+		return func(gtx layout.Context) layout.Dimensions {
+			return layout.Dimensions{}
+		}
+	}
+
+	safetyNumber, err := p.client.SafetyNumber(p.selectedChat)
+	switch {
+	case errors.Is(err, client.ErrNoSigningKey):
+		safetyNumber = "no safety number, the contact did not publish a signing key"
+	case err != nil:
+		safetyNumber = "safety number not available"
+	default:
+		safetyNumber = formatSafetyNumber(safetyNumber)
+	}
+
+	verified := p.client.IsContactVerified(p.selectedChat)
+	if verified {
+		p.verifyButton.SetTitle("Unverify")
+	} else {
+		p.verifyButton.SetTitle("Verify")
+	}
+
+	change := p.keyChange(p.selectedChat)
+	blocked := p.client.HasKeyChanged(p.selectedChat)
+
+	return func(gtx layout.Context) layout.Dimensions {
+		return layout.Inset{
+			Left:   30,
+			Right:  30,
+			Bottom: 10,
+		}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{
+				Axis: layout.Vertical,
+			}.Layout(gtx,
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					return layout.Flex{
+						Axis:      layout.Horizontal,
+						Alignment: layout.Middle,
+					}.Layout(gtx,
+						layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+							return layout.Flex{
+								Axis: layout.Vertical,
+							}.Layout(gtx,
+								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+									title := fmt.Sprintf("%x", p.selectedChat)
+									if verified {
+										title += " (verified)"
+									}
+
+									text := material.Label(th, 16, title)
+									text.Color = colors.OnSurface
+									text.Font.Weight = font.Bold
+
+									return text.Layout(gtx)
+								}),
+								layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+									text := material.Label(th, 12, safetyNumber)
+									text.Color = colors.OnSurfaceVariant
+
+									return layout.Inset{Top: 2}.Layout(gtx, text.Layout)
+								}),
+							)
+						}),
+						layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+							return p.verifyButton.Layout(gtx, th)
+						}),
+					)
+				}),
+				layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+					if change == nil && !blocked {
+						return layout.Dimensions{}
+					}
+
+					warning := "The keys of this contact changed, compare the safety number again."
+					if blocked {
+						warning += " Sending is blocked until you verify or accept the new keys."
+					}
+
+					return layout.Inset{Top: 5}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+						return layout.Flex{
+							Axis:      layout.Horizontal,
+							Alignment: layout.Middle,
+						}.Layout(gtx,
+							layout.Flexed(1, func(gtx layout.Context) layout.Dimensions {
+								text := material.Label(th, 14, warning)
+								text.Color = colors.Error
+
+								return text.Layout(gtx)
+							}),
+							layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+								return p.acceptKeyButton.Layout(gtx, th)
+							}),
+						)
+					})
+				}),
+			)
+		})
+	}
+}
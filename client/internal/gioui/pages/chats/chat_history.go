@@ -2,6 +2,7 @@ package chats
 
 import (
 	"bytes"
+	"client-go/internal/contact/message"
 	"client-go/internal/gioui/colors"
 	"client-go/internal/gioui/utils"
 	"image"
@@ -64,10 +65,30 @@ func (p *Page) chatHistory(gtx layout.Context, th *material.Theme) layout.Widget
 								Top:    2,
 								Bottom: 3,
 							}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-								return layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-									tl := widget.Label{}
-									return tl.Layout(gtx, th.Shaper, font, 16, string(chats[index].PlainMessage), textColorOp)
-								})
+								return layout.Flex{
+									Axis:      layout.Vertical,
+									Alignment: layout.End,
+								}.Layout(gtx,
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										tl := widget.Label{}
+										return tl.Layout(gtx, th.Shaper, font, 16, string(chats[index].PlainMessage), textColorOp)
+									}),
+									layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+										// only messages still in the outbox or given up on are marked
+										status := chats[index].Status
+										if status != message.StatusQueued && status != message.StatusFailed {
+											return layout.Dimensions{}
+										}
+
+										label := material.Label(th, 12, string(status))
+										label.Color = colors.OnSurfaceVariant
+										if status == message.StatusFailed {
+											label.Color = colors.Error
+										}
+
+										return label.Layout(gtx)
+									}),
+								)
 							})
 							c := m.Stop()
 
@@ -2,13 +2,16 @@ package chats
 
 import (
 	"client-go/internal/client"
+	"client-go/internal/contact/message"
 	"client-go/internal/gioui/colors"
 	"client-go/internal/gioui/components"
 	"client-go/internal/gioui/icons"
 	page "client-go/internal/gioui/pages"
 	"client-go/internal/gioui/utils"
+	"context"
 	"fmt"
 	"log"
+	"sync"
 
 	"gioui.org/layout"
 	"gioui.org/widget/material"
@@ -21,6 +24,7 @@ type Page struct {
 	selectedIdx     int
 	selectedChat    []byte
 	chatAddOpen     bool
+	settingsOpen    bool
 	initialized     bool
 	chatButtons     []components.ClickableButton
 	addFriendInput  *components.InputStyle
@@ -28,13 +32,26 @@ type Page struct {
 	sendButton      components.ClickableButton
 	addFriendButton components.ClickableButton
 	addFriendIcon   components.ClickableButtonIcon
+	settingsIcon    components.ClickableButtonIcon
+	logoutButton    components.ClickableButton
+	wipeButton      components.ClickableButton
+	verifyButton    components.ClickableButton
+	acceptKeyButton components.ClickableButton
 	chatListState   layout.List
+	keyChangesMu    sync.Mutex
+	keyChanges      map[string]client.KeyChange // by contact ID hash, until acknowledged
 }
 
 func New(r *page.Router, c *client.Client) *Page {
 	c.ListenIncomingMessages()
 
-	return &Page{
+	// the history shows the status of outgoing messages, redraw it when one
+	// is sent or given up on
+	c.SetSendStatusHandler(func(int64, message.SendStatus) {
+		r.Invalidate()
+	})
+
+	p := &Page{
 		Router:          r,
 		client:          c,
 		split:           components.Split(0.3, 0.20, 0.5, 220, 1000, 5),
@@ -48,11 +65,21 @@ func New(r *page.Router, c *client.Client) *Page {
 		sendButton:      components.Button("Send", 50),
 		addFriendButton: components.Button("Add", 50),
 		addFriendIcon:   components.ButtonIcon(icons.Plus, 1, 20, false),
+		settingsIcon:    components.ButtonIcon(icons.Settings, 1, 20, false),
+		logoutButton:    components.Button("Log out", 200),
+		wipeButton:      components.Button("Log out and wipe local data", 200),
+		verifyButton:    components.Button("Verify", 100),
+		acceptKeyButton: components.Button("Accept", 100),
 		chatListState: layout.List{
 			Axis:      layout.Vertical,
 			Alignment: layout.End,
 		},
+		keyChanges: make(map[string]client.KeyChange),
 	}
+
+	c.SetKeyChangeHandler(p.keyChanged)
+
+	return p
 }
 
 var _ page.Page = &Page{}
@@ -67,9 +94,9 @@ func (p *Page) UpdateChats() {
 
 	p.chatButtons = make([]components.ClickableButton, len(chats))
 	for i := range chats {
-		// messagePayload := &client.ReceiveMessagePayload{
-		// 	ContactIDHash:     chats[i],
-		// 	StartingTimestamp: p.client.LastPolledTimestamp,
+		// messagePayload := &tcpclient.MessagesRequest{
+		// 	SenderIDHash: chats[i],
+		// 	Timestamp:    p.client.LastPolledTimestamp,
 		// }
 		// p.client.RequestMessages(messagePayload)
 
@@ -111,7 +138,10 @@ func (p *Page) addFriend() {
 		return
 	}
 
-	err := p.client.AddContact([]byte(friendID))
+	ctx, cancel := context.WithTimeout(context.Background(), page.REQUEST_TIMEOUT)
+	defer cancel()
+
+	err := p.client.AddContact(ctx, []byte(friendID))
 	if err != nil {
 		return
 	}
@@ -124,13 +154,60 @@ func (p *Page) addFriend() {
 	log.Printf("Added friend: %s", friendID)
 }
 
+// logout ends the session, wiping the local data if wipe is set, and goes back
+// to the login page.
+func (p *Page) logout(wipe bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), page.REQUEST_TIMEOUT)
+	defer cancel()
+
+	var err error
+	if wipe {
+		err = p.client.LogoutAndWipe(ctx)
+	} else {
+		err = p.client.Logout(ctx)
+	}
+
+	// the local session is gone even if the server was not told
+	if err != nil {
+		log.Printf("Logout failed: %v", err)
+	}
+
+	p.selectedIdx = -1
+	p.selectedChat = nil
+	p.chatButtons = make([]components.ClickableButton, 0)
+	p.settingsOpen = false
+	p.initialized = false
+
+	p.keyChangesMu.Lock()
+	clear(p.keyChanges)
+	p.keyChangesMu.Unlock()
+
+	p.Router.SetCurrent("login")
+}
+
 func (p *Page) Layout(gtx layout.Context, th *material.Theme) layout.Dimensions {
 	if !p.initialized {
+		// Logout stops listening, start again for the account logged in now
+		p.client.ListenIncomingMessages()
+
 		p.UpdateChats()
 		p.sendButton.SetOnClick(p.sendMessage)
 		p.addFriendIcon.SetOnClick(func() {
 			p.chatAddOpen = !p.chatAddOpen
+			p.settingsOpen = false
+		})
+		p.settingsIcon.SetOnClick(func() {
+			p.settingsOpen = !p.settingsOpen
+			p.chatAddOpen = false
+		})
+		p.logoutButton.SetOnClick(func() {
+			p.logout(false)
+		})
+		p.wipeButton.SetOnClick(func() {
+			p.logout(true)
 		})
+		p.verifyButton.SetOnClick(p.toggleVerified)
+		p.acceptKeyButton.SetOnClick(p.acceptKeyChange)
 		p.addFriendButton.SetOnClick(p.addFriend)
 		if len(p.chatButtons) > 0 {
 			p.chatButtons[0].SetActive(true)
@@ -161,6 +238,8 @@ func (p *Page) Layout(gtx layout.Context, th *material.Theme) layout.Dimensions
 						func(gtx layout.Context) layout.Dimensions {
 							if p.chatAddOpen {
 								return p.chatAdd(gtx, th)(gtx)
+							} else if p.settingsOpen {
+								return p.chatSettings(gtx, th)(gtx)
 							} else {
 								return p.chatList(gtx, th)(gtx)
 							}
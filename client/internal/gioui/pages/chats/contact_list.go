@@ -3,6 +3,7 @@ package chats
 import (
 	"client-go/internal/gioui/colors"
 	"client-go/internal/gioui/utils"
+	"client-go/internal/tcpclient"
 
 	"gioui.org/font"
 	"gioui.org/layout"
@@ -25,9 +26,26 @@ func (p *Page) chatHeader(th *material.Theme) layout.Widget {
 					return text.Layout(gtx)
 				},
 			),
+			layout.Rigid(
+				func(gtx layout.Context) layout.Dimensions {
+					state := p.State()
+					if state == tcpclient.Authenticated {
+						return layout.Dimensions{}
+					}
+
+					text := material.Label(th, 14, state.String())
+					text.Color = colors.OnSurfaceVariant
+
+					return layout.Inset{Right: 10}.Layout(gtx, text.Layout)
+				},
+			),
 			layout.Rigid(
 				p.addFriendIcon.Layout,
 			),
+			layout.Rigid(layout.Spacer{Width: 5}.Layout),
+			layout.Rigid(
+				p.settingsIcon.Layout,
+			),
 		)
 	}
 }
@@ -82,3 +100,40 @@ func (p *Page) chatAdd(gtx layout.Context, th *material.Theme) layout.Widget {
 		})
 	}
 }
+
+func (p *Page) chatSettings(gtx layout.Context, th *material.Theme) layout.Widget {
+	utils.ColorBox(gtx, colors.SurfaceContainerLowest)
+
+	return func(gtx layout.Context) layout.Dimensions {
+		return layout.Inset{
+			Top:    10,
+			Bottom: 5,
+			Left:   10,
+			Right:  10,
+		}.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
+			return layout.Flex{
+				Axis: layout.Vertical,
+			}.Layout(gtx,
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						return p.logoutButton.Layout(gtx, th)
+					},
+				),
+				layout.Rigid(layout.Spacer{Height: 10}.Layout),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						return p.wipeButton.Layout(gtx, th)
+					},
+				),
+				layout.Rigid(
+					func(gtx layout.Context) layout.Dimensions {
+						text := material.Label(th, 12, "Deletes the keys, contacts and messages on this device")
+						text.Color = colors.OnSurfaceVariant
+
+						return layout.Inset{Top: 5}.Layout(gtx, text.Layout)
+					},
+				),
+			)
+		})
+	}
+}
@@ -7,6 +7,8 @@ import (
 	page "client-go/internal/gioui/pages"
 	"client-go/internal/gioui/utils"
 	"client-go/internal/sqlite"
+	"context"
+	"image"
 	"log"
 	"time"
 
@@ -55,7 +57,10 @@ func (p *Page) init() {
 	if err == nil {
 		log.Printf("Logging in...")
 
-		err = p.client.Login(userID, password)
+		ctx, cancel := context.WithTimeout(context.Background(), page.REQUEST_TIMEOUT)
+		defer cancel()
+
+		err = p.client.Login(ctx, userID, password)
 		if err == nil {
 			log.Printf("Login successful: %s", userID)
 
@@ -75,12 +80,28 @@ func (p *Page) Layout(gtx layout.Context, th *material.Theme) layout.Dimensions
 	utils.ColorBox(gtx, colors.Surface)
 
 	layout.Center.Layout(gtx, func(gtx layout.Context) layout.Dimensions {
-		timeDiff := time.Now().UnixMilli() - p.startTime
-		angle := float32(timeDiff/4%360) * 3.14 / 180
-
-		gtx.Execute(op.InvalidateCmd{})
-
-		return icons.Loader.DrawIcon(gtx.Ops, colors.OnSurface, 50, angle)
+		return layout.Flex{
+			Axis:      layout.Vertical,
+			Alignment: layout.Middle,
+		}.Layout(gtx,
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				timeDiff := time.Now().UnixMilli() - p.startTime
+				angle := float32(timeDiff/4%360) * 3.14 / 180
+
+				gtx.Execute(op.InvalidateCmd{})
+
+				// DrawIcon leaves its rotation applied, keep it away from the label
+				defer op.Offset(image.Point{}).Push(gtx.Ops).Pop()
+
+				return icons.Loader.DrawIcon(gtx.Ops, colors.OnSurface, 50, angle)
+			}),
+			layout.Rigid(func(gtx layout.Context) layout.Dimensions {
+				text := material.Label(th, 14, p.State().String())
+				text.Color = colors.OnSurfaceVariant
+
+				return layout.Inset{Top: 10}.Layout(gtx, text.Layout)
+			}),
+		)
 	})
 
 	return layout.Dimensions{}
@@ -6,6 +6,7 @@ import (
 	"client-go/internal/gioui/components"
 	page "client-go/internal/gioui/pages"
 	"client-go/internal/gioui/utils"
+	"context"
 	"log"
 
 	"gioui.org/font"
@@ -65,7 +66,10 @@ func (p *Page) SignIn() {
 	userID := p.usernameInput.Editor.Text()
 	password := p.passwordInput.Editor.Text()
 
-	err := p.client.Login([]byte(userID), []byte(password))
+	ctx, cancel := context.WithTimeout(context.Background(), page.REQUEST_TIMEOUT)
+	defer cancel()
+
+	err := p.client.Login(ctx, []byte(userID), []byte(password))
 	if err == nil {
 		log.Printf("Login successful: %s", userID)
 
@@ -87,7 +91,10 @@ func (p *Page) Signup() {
 		return
 	}
 
-	err := p.client.Signup([]byte(userID), []byte(password))
+	ctx, cancel := context.WithTimeout(context.Background(), page.REQUEST_TIMEOUT)
+	defer cancel()
+
+	err := p.client.Signup(ctx, []byte(userID), []byte(password))
 	if err == nil {
 		log.Printf("Sign up successful: %s", userID)
 
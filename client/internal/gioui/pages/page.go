@@ -1,26 +1,69 @@
 package page
 
 import (
+	"client-go/internal/tcpclient"
+	"sync"
+	"time"
+
 	"gioui.org/layout"
 	"gioui.org/widget/material"
 )
 
+// REQUEST_TIMEOUT bounds the server requests made from the UI, so a slow server
+// cannot keep the window blocked.
+const REQUEST_TIMEOUT = 10 * time.Second
+
 type Page interface {
 	Layout(gtx layout.Context, th *material.Theme) layout.Dimensions
 }
 
 type Router struct {
-	pages   map[any]Page
-	current any
+	pages      map[any]Page
+	current    any
+	invalidate func()
+
+	mu    sync.Mutex
+	state tcpclient.ConnectionState
 }
 
-func NewRouter() *Router {
+// NewRouter creates a router, invalidate is called to redraw the window when
+// something changes outside of a frame.
+func NewRouter(invalidate func()) *Router {
 	return &Router{
-		pages:   make(map[any]Page),
-		current: nil,
+		pages:      make(map[any]Page),
+		current:    nil,
+		invalidate: invalidate,
 	}
 }
 
+// WatchState follows the connection state of the server for the pages and
+// redraws the window on every change.
+func (r *Router) WatchState(server *tcpclient.TCPServer) {
+	states, _ := server.SubscribeState()
+
+	go func() {
+		for state := range states {
+			r.mu.Lock()
+			r.state = state
+			r.mu.Unlock()
+
+			r.Invalidate()
+		}
+	}()
+}
+
+// Invalidate redraws the window, it can be called from any goroutine.
+func (r *Router) Invalidate() {
+	r.invalidate()
+}
+
+// State returns the last connection state seen by WatchState.
+func (r *Router) State() tcpclient.ConnectionState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
 func (r *Router) Register(tag any, p Page) {
 	r.pages[tag] = p
 
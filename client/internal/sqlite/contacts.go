@@ -10,7 +10,7 @@ func GetContacts(db *sql.DB) ([]contact.Contact, error) {
   var contacts = []contact.Contact{}
 
   // Retrieve all contacts from the database
-  stmt, err := db.Prepare("SELECT id_hash, ratchet FROM contacts")
+  stmt, err := db.Prepare("SELECT id_hash, ratchet, identity_key, signing_key, verified, key_changed FROM contacts")
   if err != nil {
     return nil, err
   }
@@ -25,8 +25,12 @@ func GetContacts(db *sql.DB) ([]contact.Contact, error) {
   for rows.Next() {
     var contactIDHash []byte
     var ratchetBytes []byte
+    var identityKey []byte
+    var signingKey []byte
+    var verified sql.NullBool
+    var keyChanged sql.NullBool
 
-    err = rows.Scan(&contactIDHash, &ratchetBytes)
+    err = rows.Scan(&contactIDHash, &ratchetBytes, &identityKey, &signingKey, &verified, &keyChanged)
     if err != nil {
       return nil, err
     }
@@ -38,28 +42,32 @@ func GetContacts(db *sql.DB) ([]contact.Contact, error) {
     }
 
     contacts = append(contacts, contact.Contact{
-      IDHash:    contactIDHash,
-      DHRatchet: ratchet,
+      IDHash:      contactIDHash,
+      DHRatchet:   ratchet,
+      IdentityKey: identityKey,
+      SigningKey:  signingKey,
+      Verified:    verified.Bool,
+      KeyChanged:  keyChanged.Bool,
     })
   }
 
   return contacts, nil
 }
 
-func AddContact(db *sql.DB, contactIDHash []byte, ratchet *ratchet.DHRatchet) error {
+func AddContact(db *sql.DB, c *contact.Contact) error {
   // Insert the contact ID into the contacts table
-  stmt, err := db.Prepare("INSERT INTO contacts (id_hash, ratchet) VALUES (?, ?)")
+  stmt, err := db.Prepare("INSERT INTO contacts (id_hash, ratchet, identity_key, signing_key, verified, key_changed) VALUES (?, ?, ?, ?, ?, ?)")
   if err != nil {
     return err
   }
   defer stmt.Close()
 
-  ratchetBytes, err := ratchet.Marshal()
+  ratchetBytes, err := c.DHRatchet.Marshal()
   if err != nil {
     return err
   }
 
-  _, err = stmt.Exec(contactIDHash, ratchetBytes)
+  _, err = stmt.Exec(c.IDHash, ratchetBytes, c.IdentityKey, c.SigningKey, c.Verified, c.KeyChanged)
   if err != nil {
     return err
   }
@@ -69,7 +77,7 @@ func AddContact(db *sql.DB, contactIDHash []byte, ratchet *ratchet.DHRatchet) er
 
 func UpdateContact(db *sql.DB, c *contact.Contact) error {
   // Update the contact ID in the contacts table
-  stmt, err := db.Prepare("UPDATE contacts SET ratchet = ? WHERE id_hash = ?")
+  stmt, err := db.Prepare("UPDATE contacts SET ratchet = ?, identity_key = ?, signing_key = ?, verified = ?, key_changed = ? WHERE id_hash = ?")
   if err != nil {
     return err
   }
@@ -80,7 +88,7 @@ func UpdateContact(db *sql.DB, c *contact.Contact) error {
     return err
   }
 
-  _, err = stmt.Exec(ratchetBytes, c.IDHash)
+  _, err = stmt.Exec(ratchetBytes, c.IdentityKey, c.SigningKey, c.Verified, c.KeyChanged, c.IDHash)
   if err != nil {
     return err
   }
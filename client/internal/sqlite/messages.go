@@ -5,25 +5,28 @@ import (
 	"database/sql"
 )
 
-func SaveMessage(db *sql.DB, ratchetIndex int, message *message.Message) error {
+// SaveMessage stores a message and returns its row ID.
+func SaveMessage(db *sql.DB, ratchetIndex int, message *message.Message) (int64, error) {
 	stmt, err := db.Prepare("INSERT INTO messages (ratchet_index, thread_index, receiver_id_hash, sender_id_hash, message) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(ratchetIndex, message.Header.Index, message.ReceiverIDHash, message.SenderIDHash, message.PlainMessage)
+	result, err := stmt.Exec(ratchetIndex, message.Header.Index, message.ReceiverIDHash, message.SenderIDHash, message.PlainMessage)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return result.LastInsertId()
 }
 
 func GetMessages(db *sql.DB, senderID []byte) ([]*message.Message, error) {
 	var messages []*message.Message
 
-	stmt, err := db.Prepare("SELECT sender_id_hash, message FROM messages WHERE sender_id_hash = ? OR receiver_id_hash = ?")
+	stmt, err := db.Prepare(`SELECT messages.id, messages.sender_id_hash, messages.message, COALESCE(outbox.status, '')
+    FROM messages LEFT JOIN outbox ON outbox.message_id = messages.id
+    WHERE messages.sender_id_hash = ? OR messages.receiver_id_hash = ?`)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +40,7 @@ func GetMessages(db *sql.DB, senderID []byte) ([]*message.Message, error) {
 
 	for rows.Next() {
 		var msg message.Message
-		err = rows.Scan(&msg.SenderIDHash, &msg.PlainMessage)
+		err = rows.Scan(&msg.ID, &msg.SenderIDHash, &msg.PlainMessage, &msg.Status)
 
 		if err != nil {
 			return nil, err
@@ -0,0 +1,96 @@
+package sqlite
+
+import (
+	"client-go/internal/contact/message"
+	"database/sql"
+)
+
+// OutboxEntry is an encrypted message waiting to be sent to the server.
+type OutboxEntry struct {
+	ID             int64
+	MessageID      int64  // row ID of the plain message in the messages table
+	PacketID       []byte // message ID of every attempt, the relay drops resends by it
+	ReceiverIDHash []byte
+	Payload        []byte
+	Status         message.SendStatus
+	Attempts       int
+	LastError      string
+}
+
+// QueueOutbox adds an encrypted message to the outbox, it is sent under packetID
+// however often it is retried.
+func QueueOutbox(db *sql.DB, messageID int64, packetID, receiverIDHash, payload []byte) (int64, error) {
+	stmt, err := db.Prepare("INSERT INTO outbox (message_id, packet_id, receiver_id_hash, payload, status) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(messageID, packetID, receiverIDHash, payload, message.StatusQueued)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// GetQueuedOutbox returns the messages still waiting to be sent, oldest first.
+func GetQueuedOutbox(db *sql.DB) ([]OutboxEntry, error) {
+	stmt, err := db.Prepare("SELECT id, message_id, packet_id, receiver_id_hash, payload, status, attempts, last_error FROM outbox WHERE status = ? ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(message.StatusQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		var entry OutboxEntry
+		err = rows.Scan(&entry.ID, &entry.MessageID, &entry.PacketID, &entry.ReceiverIDHash, &entry.Payload, &entry.Status, &entry.Attempts, &entry.LastError)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// GetOutboxEntry returns the outbox entry of a message, or nil if the message
+// never went through the outbox.
+func GetOutboxEntry(db *sql.DB, messageID int64) (*OutboxEntry, error) {
+	stmt, err := db.Prepare("SELECT id, message_id, packet_id, receiver_id_hash, payload, status, attempts, last_error FROM outbox WHERE message_id = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var entry OutboxEntry
+	err = stmt.QueryRow(messageID).Scan(&entry.ID, &entry.MessageID, &entry.PacketID, &entry.ReceiverIDHash, &entry.Payload, &entry.Status, &entry.Attempts, &entry.LastError)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// UpdateOutbox stores the status, attempts and last error of an entry.
+func UpdateOutbox(db *sql.DB, entry *OutboxEntry) error {
+	stmt, err := db.Prepare("UPDATE outbox SET status = ?, attempts = ?, last_error = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(entry.Status, entry.Attempts, entry.LastError, entry.ID)
+	return err
+}
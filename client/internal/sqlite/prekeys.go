@@ -0,0 +1,83 @@
+package sqlite
+
+import (
+	"client-go/internal/crypt"
+	"database/sql"
+	"time"
+)
+
+// Prekey is a key pair published for X3DH. The signed prekey is shared by every
+// contact starting a session, a one-time prekey is handed out to one of them
+// and deleted once used.
+type Prekey struct {
+	ID        uint32
+	Signed    bool
+	KeyPair   crypt.KeyPair
+	CreatedAt time.Time
+}
+
+// AddPrekeys stores new prekeys and returns them with their IDs.
+func AddPrekeys(db *sql.DB, signed bool, keypairs []crypt.KeyPair) ([]Prekey, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO prekeys (signed, public_key, private_key) VALUES (?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	prekeys := make([]Prekey, 0, len(keypairs))
+	for _, keypair := range keypairs {
+		result, err := stmt.Exec(signed, keypair.PublicKey, keypair.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		prekeys = append(prekeys, Prekey{ID: uint32(id), Signed: signed, KeyPair: keypair, CreatedAt: time.Now()})
+	}
+
+	return prekeys, tx.Commit()
+}
+
+// GetPrekey returns the prekey with the given ID, sql.ErrNoRows if it does not
+// exist or was already used.
+func GetPrekey(db *sql.DB, id uint32) (Prekey, error) {
+	prekey := Prekey{ID: id}
+
+	err := db.QueryRow("SELECT signed, public_key, private_key, created_at FROM prekeys WHERE id = ?", id).
+		Scan(&prekey.Signed, &prekey.KeyPair.PublicKey, &prekey.KeyPair.PrivateKey, &prekey.CreatedAt)
+
+	return prekey, err
+}
+
+// GetSignedPrekey returns the newest signed prekey, sql.ErrNoRows if none was
+// created yet.
+func GetSignedPrekey(db *sql.DB) (Prekey, error) {
+	prekey := Prekey{Signed: true}
+
+	err := db.QueryRow("SELECT id, public_key, private_key, created_at FROM prekeys WHERE signed = 1 ORDER BY id DESC LIMIT 1").
+		Scan(&prekey.ID, &prekey.KeyPair.PublicKey, &prekey.KeyPair.PrivateKey, &prekey.CreatedAt)
+
+	return prekey, err
+}
+
+func DeletePrekey(db *sql.DB, id uint32) error {
+	_, err := db.Exec("DELETE FROM prekeys WHERE id = ?", id)
+	return err
+}
+
+// DeleteOldSignedPrekeys deletes all but the newest keep signed prekeys. The
+// previous ones are kept for a while, sessions may still be started with them.
+func DeleteOldSignedPrekeys(db *sql.DB, keep int) error {
+	_, err := db.Exec("DELETE FROM prekeys WHERE signed = 1 AND id NOT IN (SELECT id FROM prekeys WHERE signed = 1 ORDER BY id DESC LIMIT ?)", keep)
+	return err
+}
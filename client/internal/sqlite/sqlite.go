@@ -35,10 +35,35 @@ func OpenDatabase(source string) (*sql.DB, error) {
     UNIQUE(sender_id_hash, ratchet_index, thread_index) ON CONFLICT REPLACE
   );
 
+  CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER,
+    packet_id BLOB,
+    receiver_id_hash BLOB,
+    payload BLOB,
+    status TEXT,
+    attempts INTEGER DEFAULT 0,
+    last_error TEXT DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(message_id) REFERENCES messages(id)
+  );
+
+  CREATE TABLE IF NOT EXISTS prekeys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    signed BOOLEAN,
+    public_key BLOB,
+    private_key BLOB,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+  );
+
   CREATE TABLE IF NOT EXISTS contacts (
     id TEXT PRIMARY KEY,
     id_hash BLOB,
     ratchet BLOB,
+    identity_key BLOB,
+    signing_key BLOB,
+    verified BOOLEAN DEFAULT 0,
+    key_changed BOOLEAN DEFAULT 0,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
   );
   `
@@ -47,5 +72,70 @@ func OpenDatabase(source string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// columns added to tables after they were first created, databases created
+// before are migrated on open
+var addedColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"contacts", "identity_key", "BLOB"},
+	{"contacts", "signing_key", "BLOB"},
+	{"contacts", "verified", "BOOLEAN DEFAULT 0"},
+	{"contacts", "key_changed", "BOOLEAN DEFAULT 0"},
+	{"outbox", "packet_id", "BLOB"},
+}
+
+func migrate(db *sql.DB) error {
+	for _, added := range addedColumns {
+		var exists bool
+		err := db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?", added.table, added.column).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			continue
+		}
+
+		_, err = db.Exec("ALTER TABLE " + added.table + " ADD COLUMN " + added.column + " " + added.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Wipe deletes everything stored by the client: settings and key material,
+// prekeys, contacts with their ratchets, messages and the outbox. The file is
+// vacuumed so the deleted rows do not linger in free pages.
+func Wipe(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"outbox", "messages", "contacts", "prekeys", "user_settings"} {
+		_, err = tx.Exec("DELETE FROM " + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("VACUUM")
+	return err
+}
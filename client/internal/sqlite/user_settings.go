@@ -50,6 +50,49 @@ func GetUserKeyPair(db *sql.DB) (crypt.KeyPair, error) {
   return keypair, nil
 }
 
+func SetUserSigningKey(db *sql.DB, key crypt.SigningKeyPair) error {
+  stmt, err := db.Prepare("INSERT OR REPLACE INTO user_settings (key, value) VALUES (?, ?)")
+  if err != nil {
+    return err
+  }
+  defer stmt.Close()
+
+  _, err = stmt.Exec("signing_public_key", key.PublicKey)
+  if err != nil {
+    return err
+  }
+  _, err = stmt.Exec("signing_private_key", key.PrivateKey)
+  if err != nil {
+    return err
+  }
+
+  return nil
+}
+
+func GetUserSigningKey(db *sql.DB) (crypt.SigningKeyPair, error) {
+  var key crypt.SigningKeyPair
+
+  stmt, err := db.Prepare("SELECT value FROM user_settings WHERE key = ?")
+  if err != nil {
+    return key, err
+  }
+  defer stmt.Close()
+
+  row := stmt.QueryRow("signing_public_key")
+  err = row.Scan(&key.PublicKey)
+  if err != nil {
+    return key, err
+  }
+
+  row = stmt.QueryRow("signing_private_key")
+  err = row.Scan(&key.PrivateKey)
+  if err != nil {
+    return key, err
+  }
+
+  return key, nil
+}
+
 func SetLoginData(db *sql.DB, userID, password []byte) error {
   // Insert or update the user login data in the database
   stmt, err := db.Prepare("INSERT OR REPLACE INTO user_settings (key, value) VALUES (?, ?)")
@@ -92,3 +135,46 @@ func GetLoginData(db *sql.DB) (username, password []byte, err error) {
 
   return username, password, nil
 }
+
+// DeleteLoginData removes the stored credentials, so the client no longer logs
+// in on start.
+func DeleteLoginData(db *sql.DB) error {
+  _, err := db.Exec("DELETE FROM user_settings WHERE key IN (?, ?)", "username", "password")
+  return err
+}
+
+// ServerPinStore keeps the pinned server keys of tcpclient in user_settings.
+type ServerPinStore struct {
+  DB *sql.DB
+}
+
+func (s ServerPinStore) GetPin(name string) ([]byte, error) {
+  var pin []byte
+
+  stmt, err := s.DB.Prepare("SELECT value FROM user_settings WHERE key = ?")
+  if err != nil {
+    return nil, err
+  }
+  defer stmt.Close()
+
+  err = stmt.QueryRow("server_pin:" + name).Scan(&pin)
+  if err == sql.ErrNoRows {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+
+  return pin, nil
+}
+
+func (s ServerPinStore) SetPin(name string, pin []byte) error {
+  stmt, err := s.DB.Prepare("INSERT OR REPLACE INTO user_settings (key, value) VALUES (?, ?)")
+  if err != nil {
+    return err
+  }
+  defer stmt.Close()
+
+  _, err = stmt.Exec("server_pin:"+name, pin)
+  return err
+}
@@ -0,0 +1,46 @@
+package tcpclient
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	RECONNECT_BASE_INTERVAL = 1 * time.Second
+	RECONNECT_MAX_INTERVAL  = 30 * time.Second
+)
+
+// backoff produces exponentially growing retry intervals with jitter, so a
+// relay restart is not followed by every client reconnecting at the same time.
+type backoff struct {
+	base     time.Duration
+	interval time.Duration
+	max      time.Duration
+}
+
+func newBackoff() *backoff {
+	return newBackoffWith(RECONNECT_BASE_INTERVAL, RECONNECT_MAX_INTERVAL)
+}
+
+func newBackoffWith(base, max time.Duration) *backoff {
+	return &backoff{base: base, interval: base, max: max}
+}
+
+// next returns the current interval with up to 50% jitter either way and
+// doubles the interval for the next attempt.
+func (b *backoff) next() time.Duration {
+	jitter := time.Duration(rand.Int64N(int64(b.interval)))
+	retryInterval := b.interval/2 + jitter
+
+	b.interval *= 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+
+	return retryInterval
+}
+
+// reset starts over with the base interval.
+func (b *backoff) reset() {
+	b.interval = b.base
+}
@@ -0,0 +1,344 @@
+package tcpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	CHUNK_SIZE = 256 * 1024
+	// original message type + index + total + SHA-256 of the whole payload
+	CHUNK_HEADER_LENGTH = 1 + 4 + 4 + sha256.Size
+	// MAX_TRANSFER_SIZE bounds the memory a single chunked transfer may take up.
+	MAX_TRANSFER_SIZE = 64 * 1024 * 1024
+	// CHUNK_TRANSFER_TIMEOUT is how long an incomplete transfer is kept after its
+	// last chunk, so it can be resumed after a reconnect.
+	CHUNK_TRANSFER_TIMEOUT = 2 * time.Minute
+)
+
+// ChunkError is returned for chunks that do not fit the transfer they belong
+// to, and for transfers whose payload does not match their hash.
+type ChunkError struct {
+	Reason string
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("invalid chunk: %s", e.Reason)
+}
+
+// ProgressFunc reports how many of the chunks of a transfer are done.
+type ProgressFunc func(done, total int)
+
+type progressKey struct{}
+
+// WithProgress returns a context reporting the progress of chunked requests
+// and responses made with it.
+func WithProgress(ctx context.Context, progress ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+func progressFromContext(ctx context.Context) ProgressFunc {
+	progress, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return progress
+}
+
+// TransferChunk is the data of a Chunk packet, one part of a payload larger than
+// MAX_MESSAGE_SIZE. All chunks of a transfer are sent with the message ID of the
+// original packet.
+type TransferChunk struct {
+	MessageType MessageType // type of the reassembled packet
+	Index       int
+	Total       int
+	Hash        []byte // SHA-256 of the reassembled payload
+	Data        []byte
+}
+
+func (c *TransferChunk) Encode() ([]byte, error) {
+	err := checkLength("chunk hash", c.Hash, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, CHUNK_HEADER_LENGTH+len(c.Data))
+	data = append(data, byte(c.MessageType))
+	data = binary.BigEndian.AppendUint32(data, uint32(c.Index))
+	data = binary.BigEndian.AppendUint32(data, uint32(c.Total))
+	data = append(data, c.Hash...)
+	data = append(data, c.Data...)
+
+	return data, nil
+}
+
+func (c *TransferChunk) Decode(data []byte) error {
+	err := checkMinLength("chunk", data, CHUNK_HEADER_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	c.MessageType = MessageType(data[0])
+	c.Index = int(binary.BigEndian.Uint32(data[1:5]))
+	c.Total = int(binary.BigEndian.Uint32(data[5:9]))
+	c.Hash = append([]byte{}, data[9:CHUNK_HEADER_LENGTH]...)
+	c.Data = append([]byte{}, data[CHUNK_HEADER_LENGTH:]...)
+
+	return nil
+}
+
+// SplitChunks splits a payload into chunks of CHUNK_SIZE bytes.
+func SplitChunks(messageType MessageType, payload []byte) ([]TransferChunk, error) {
+	if len(payload) > MAX_TRANSFER_SIZE {
+		return nil, fmt.Errorf("data length exceeds maximum transfer size: %d", len(payload))
+	}
+
+	hash := sha256.Sum256(payload)
+	total := (len(payload) + CHUNK_SIZE - 1) / CHUNK_SIZE
+
+	chunks := make([]TransferChunk, total)
+	for i := range chunks {
+		end := min((i+1)*CHUNK_SIZE, len(payload))
+
+		chunks[i] = TransferChunk{
+			MessageType: messageType,
+			Index:       i,
+			Total:       total,
+			Hash:        hash[:],
+			Data:        payload[i*CHUNK_SIZE : end],
+		}
+	}
+
+	return chunks, nil
+}
+
+// ChunkAssembler collects the chunks of incoming transfers. Chunks may arrive
+// more than once, e.g. when a sender resends after a reconnect.
+type ChunkAssembler struct {
+	mu        sync.Mutex
+	transfers map[string]*transfer
+}
+
+type transfer struct {
+	messageType MessageType
+	hash        []byte
+	chunks      [][]byte
+	received    int
+	size        int
+	updated     time.Time
+}
+
+func NewChunkAssembler() *ChunkAssembler {
+	return &ChunkAssembler{
+		transfers: make(map[string]*transfer),
+	}
+}
+
+// Add stores a chunk of the transfer identified by key. Once every chunk has
+// arrived and the hash matches, the reassembled payload is returned and the
+// transfer is forgotten. received is the number of chunks stored so far.
+func (a *ChunkAssembler) Add(key string, chunk *TransferChunk) (payload []byte, received int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire()
+
+	if chunk.Total <= 0 || chunk.Total > MAX_TRANSFER_SIZE/CHUNK_SIZE+1 {
+		return nil, 0, &ChunkError{Reason: fmt.Sprintf("invalid total %d", chunk.Total)}
+	}
+
+	if chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return nil, 0, &ChunkError{Reason: fmt.Sprintf("index %d out of range", chunk.Index)}
+	}
+
+	t, exists := a.transfers[key]
+	if !exists {
+		t = &transfer{
+			messageType: chunk.MessageType,
+			hash:        chunk.Hash,
+			chunks:      make([][]byte, chunk.Total),
+		}
+		a.transfers[key] = t
+	}
+
+	if t.messageType != chunk.MessageType || len(t.chunks) != chunk.Total || !bytes.Equal(t.hash, chunk.Hash) {
+		delete(a.transfers, key)
+		return nil, 0, &ChunkError{Reason: "chunk does not match its transfer"}
+	}
+
+	t.updated = time.Now()
+
+	// a resent chunk
+	if t.chunks[chunk.Index] != nil {
+		return nil, t.received, nil
+	}
+
+	if t.size+len(chunk.Data) > MAX_TRANSFER_SIZE {
+		delete(a.transfers, key)
+		return nil, 0, &ChunkError{Reason: "transfer exceeds maximum size"}
+	}
+
+	t.chunks[chunk.Index] = chunk.Data
+	t.received++
+	t.size += len(chunk.Data)
+
+	if t.received < len(t.chunks) {
+		return nil, t.received, nil
+	}
+
+	delete(a.transfers, key)
+
+	payload = make([]byte, 0, t.size)
+	for _, data := range t.chunks {
+		payload = append(payload, data...)
+	}
+
+	hash := sha256.Sum256(payload)
+	if !bytes.Equal(hash[:], t.hash) {
+		return nil, t.received, &ChunkError{Reason: "hash mismatch"}
+	}
+
+	return payload, t.received, nil
+}
+
+// expire drops transfers that have not seen a chunk for CHUNK_TRANSFER_TIMEOUT.
+func (a *ChunkAssembler) expire() {
+	for key, t := range a.transfers {
+		if time.Since(t.updated) > CHUNK_TRANSFER_TIMEOUT {
+			delete(a.transfers, key)
+		}
+	}
+}
+
+// sendChunked sends a request larger than MAX_MESSAGE_SIZE chunk by chunk. Every
+// chunk but the last is acknowledged, the response to the last chunk is the
+// response to the request. When the connection drops the transfer continues
+// with the unacknowledged chunk once the session is re-established.
+func (s *TCPServer) sendChunked(ctx context.Context, packet *Packet) (*Packet, error) {
+	chunks, err := SplitChunks(packet.messageType, packet.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DEFAULT_REQUEST_TIMEOUT*time.Duration(len(chunks)))
+		defer cancel()
+	}
+
+	progress := progressFromContext(ctx)
+
+	// the chunks are sent at the priority of the request they make up
+	ctx = WithPriority(ctx, priorityFromContext(ctx, packet.messageType))
+
+	for i := range chunks {
+		data, err := chunks[i].Encode()
+		if err != nil {
+			return nil, err
+		}
+
+		chunkPacket := &Packet{
+			version:     packet.version,
+			messageType: Chunk,
+			messageID:   packet.messageID,
+			Data:        data,
+		}
+
+		var response *Packet
+		for {
+			response, err = s.sendReceivePacket(ctx, chunkPacket)
+			if !IsRetryable(err) {
+				break
+			}
+
+			err = s.waitAuthenticated(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if progress != nil {
+			progress(i+1, len(chunks))
+		}
+
+		if i == len(chunks)-1 {
+			return response, nil
+		}
+
+		if response.messageType != Ack {
+			return nil, fmt.Errorf("unexpected response to chunk %d: type %d", i, response.messageType)
+		}
+	}
+
+	return nil, fmt.Errorf("empty chunked transfer")
+}
+
+// receiveChunk adds a chunk of a response to its transfer and returns the
+// reassembled packet once it is complete.
+func (s *TCPServer) receiveChunk(packet *Packet) *Packet {
+	chunk := TransferChunk{}
+	err := chunk.Decode(packet.Data)
+	if err != nil {
+		return s.chunkFailed(packet, err)
+	}
+
+	payload, received, err := s.chunks.Add(packet.messageIDStr(), &chunk)
+	if err != nil {
+		return s.chunkFailed(packet, err)
+	}
+
+	s.mu.Lock()
+	pending := s.pendingResponses[packet.messageIDStr()]
+	s.mu.Unlock()
+
+	if pending != nil && pending.progress != nil {
+		pending.progress(received, chunk.Total)
+	}
+
+	if payload == nil {
+		return nil
+	}
+
+	return &Packet{
+		version:     packet.version,
+		messageType: chunk.MessageType,
+		messageID:   packet.messageID,
+		Data:        payload,
+	}
+}
+
+// chunkFailed turns a broken transfer into an Error packet, failing the request
+// waiting for it.
+func (s *TCPServer) chunkFailed(packet *Packet, err error) *Packet {
+	log.Printf("Dropping chunked transfer: %v", err)
+
+	return &Packet{
+		version:     packet.version,
+		messageType: Error,
+		messageID:   packet.messageID,
+		Data:        []byte(err.Error()),
+	}
+}
+
+// waitAuthenticated blocks until the session is authenticated or ctx is done.
+func (s *TCPServer) waitAuthenticated(ctx context.Context) error {
+	states, unsubscribe := s.SubscribeState()
+	defer unsubscribe()
+
+	for {
+		select {
+		case state := <-states:
+			if state == Authenticated {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
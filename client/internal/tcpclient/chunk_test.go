@@ -0,0 +1,166 @@
+package tcpclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestSplitChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"one byte", 1, 1},
+		{"one chunk", CHUNK_SIZE, 1},
+		{"remainder", CHUNK_SIZE + 1, 2},
+		{"above a message", MAX_MESSAGE_SIZE + 1, MAX_MESSAGE_SIZE/CHUNK_SIZE + 1},
+		{"largest transfer", MAX_TRANSFER_SIZE, MAX_TRANSFER_SIZE / CHUNK_SIZE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := make([]byte, tt.size)
+			rand.Read(payload)
+
+			chunks, err := SplitChunks(SendMessage, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(chunks) != tt.chunks {
+				t.Fatalf("%d chunks, want %d", len(chunks), tt.chunks)
+			}
+
+			joined := []byte{}
+			for i, chunk := range chunks {
+				if chunk.Index != i || chunk.Total != tt.chunks || chunk.MessageType != SendMessage {
+					t.Fatalf("chunk %d numbered %d of %d, type %d", i, chunk.Index, chunk.Total, chunk.MessageType)
+				}
+				if len(chunk.Data) > CHUNK_SIZE {
+					t.Fatalf("chunk %d holds %d bytes", i, len(chunk.Data))
+				}
+				joined = append(joined, chunk.Data...)
+			}
+
+			if !bytes.Equal(joined, payload) {
+				t.Fatal("chunks do not make up the payload")
+			}
+		})
+	}
+
+	_, err := SplitChunks(SendMessage, make([]byte, MAX_TRANSFER_SIZE+1))
+	if err == nil {
+		t.Fatal("payload above MAX_TRANSFER_SIZE split")
+	}
+}
+
+// testChunks splits a payload of n random bytes.
+func testChunks(t *testing.T, n int) ([]byte, []TransferChunk) {
+	t.Helper()
+
+	payload := make([]byte, n)
+	rand.Read(payload)
+
+	chunks, err := SplitChunks(ReqMessages, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload, chunks
+}
+
+func TestChunkAssembler(t *testing.T) {
+	payload, chunks := testChunks(t, 3*CHUNK_SIZE+10)
+
+	a := NewChunkAssembler()
+
+	// out of order, with a chunk resent after a reconnect
+	for _, i := range []int{2, 0, 2, 3} {
+		got, _, err := a.Add("transfer", &chunks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != nil {
+			t.Fatalf("payload returned after chunk %d", i)
+		}
+	}
+
+	// another transfer does not mix in
+	_, others := testChunks(t, 2*CHUNK_SIZE)
+	_, _, err := a.Add("other", &others[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, received, err := a.Add("transfer", &chunks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != len(chunks) {
+		t.Fatalf("%d chunks received, want %d", received, len(chunks))
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("reassembled payload differs")
+	}
+
+	// the transfer is forgotten once complete
+	a.mu.Lock()
+	_, exists := a.transfers["transfer"]
+	a.mu.Unlock()
+	if exists {
+		t.Fatal("complete transfer kept")
+	}
+}
+
+func TestChunkAssemblerErrors(t *testing.T) {
+	_, chunks := testChunks(t, 2*CHUNK_SIZE)
+
+	tamperedData := chunks[1]
+	tamperedData.Data = bytes.Clone(chunks[1].Data)
+	tamperedData.Data[0] ^= 0xff
+
+	otherType := chunks[1]
+	otherType.MessageType = SendMessage
+
+	otherTotal := chunks[1]
+	otherTotal.Total = 3
+
+	outOfRange := chunks[1]
+	outOfRange.Index = 2
+
+	noTotal := chunks[1]
+	noTotal.Total = 0
+
+	tests := []struct {
+		name  string
+		chunk TransferChunk
+	}{
+		{"hash mismatch", tamperedData},
+		{"other message type", otherType},
+		{"other total", otherTotal},
+		{"index out of range", outOfRange},
+		{"no total", noTotal},
+		{"total above the maximum transfer", TransferChunk{Total: MAX_TRANSFER_SIZE/CHUNK_SIZE + 2, Hash: chunks[1].Hash}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewChunkAssembler()
+
+			_, _, err := a.Add("transfer", &chunks[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err = a.Add("transfer", &tt.chunk)
+
+			var chunkErr *ChunkError
+			if !errors.As(err, &chunkErr) {
+				t.Fatalf("got %v, want a ChunkError", err)
+			}
+		})
+	}
+}
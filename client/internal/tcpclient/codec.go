@@ -0,0 +1,731 @@
+package tcpclient
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"client-go/internal/crypt"
+	"client-go/internal/utils"
+)
+
+const (
+	ID_HASH_LENGTH = 16
+	NONCE_LENGTH   = 12
+	UUID_LENGTH    = 16
+
+	PREKEY_ID_LENGTH       = 4
+	ONE_TIME_PREKEY_LENGTH = PREKEY_ID_LENGTH + crypt.KEY_LENGTH
+	// signing key, identity key signature, signed prekey ID, signed prekey and
+	// its signature
+	SIGNED_PREKEY_LENGTH = crypt.KEY_LENGTH + crypt.SIGNATURE_LENGTH + PREKEY_ID_LENGTH + crypt.KEY_LENGTH + crypt.SIGNATURE_LENGTH
+)
+
+// Request is the typed data of a packet sent to the server.
+type Request interface {
+	MessageType() MessageType
+	Encode() ([]byte, error)
+}
+
+// Response is the typed data of a packet received from the server.
+type Response interface {
+	Decode(data []byte) error
+}
+
+// FieldLengthError is returned when a field of a request or response does not
+// have the length the protocol requires.
+type FieldLengthError struct {
+	Field    string
+	Expected int
+	Received int
+	AtLeast  bool // Expected is a minimum rather than an exact length
+}
+
+func (e *FieldLengthError) Error() string {
+	if e.AtLeast {
+		return fmt.Sprintf("invalid %s length: expected at least %d, received %d", e.Field, e.Expected, e.Received)
+	}
+
+	return fmt.Sprintf("invalid %s length: expected %d, received %d", e.Field, e.Expected, e.Received)
+}
+
+func checkLength(field string, data []byte, length int) error {
+	if len(data) != length {
+		return &FieldLengthError{Field: field, Expected: length, Received: len(data)}
+	}
+
+	return nil
+}
+
+func checkMinLength(field string, data []byte, length int) error {
+	if len(data) < length {
+		return &FieldLengthError{Field: field, Expected: length, Received: len(data), AtLeast: true}
+	}
+
+	return nil
+}
+
+// Request sends req and decodes the server's answer into resp, which may be nil
+// if the answer is not needed.
+func (s *TCPServer) Request(ctx context.Context, req Request, resp Response) error {
+	data, err := req.Encode()
+	if err != nil {
+		return err
+	}
+
+	response, err := s.SendReceiveContext(ctx, req.MessageType(), data)
+	if err != nil {
+		return err
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	err = resp.Decode(response.Data)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+// KeyRequest asks for the key the password of a login or signup is encrypted with.
+type KeyRequest struct {
+	IDHash []byte
+}
+
+func (r *KeyRequest) MessageType() MessageType { return ReqKey }
+
+func (r *KeyRequest) Encode() ([]byte, error) {
+	err := checkLength("id hash", r.IDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, r.IDHash...), nil
+}
+
+func (r *KeyRequest) Decode(data []byte) error {
+	err := checkLength("id hash", data, ID_HASH_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.IDHash = append([]byte{}, data...)
+	return nil
+}
+
+type KeyResponse struct {
+	Key []byte
+}
+
+func (r *KeyResponse) Encode() ([]byte, error) {
+	err := checkLength("key", r.Key, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, r.Key...), nil
+}
+
+func (r *KeyResponse) Decode(data []byte) error {
+	err := checkLength("key", data, crypt.KEY_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.Key = append([]byte{}, data...)
+	return nil
+}
+
+// LoginRequest carries the password encrypted with the key from KeyResponse.
+type LoginRequest struct {
+	IDHash            []byte
+	Nonce             []byte
+	EncryptedPassword []byte
+}
+
+func (r *LoginRequest) MessageType() MessageType { return ReqLogin }
+
+func (r *LoginRequest) Encode() ([]byte, error) {
+	err := checkLength("id hash", r.IDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("nonce", r.Nonce, NONCE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkMinLength("encrypted password", r.EncryptedPassword, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, ID_HASH_LENGTH+NONCE_LENGTH+len(r.EncryptedPassword))
+	data = append(data, r.IDHash...)
+	data = append(data, r.Nonce...)
+	data = append(data, r.EncryptedPassword...)
+
+	return data, nil
+}
+
+func (r *LoginRequest) Decode(data []byte) error {
+	err := checkMinLength("login request", data, ID_HASH_LENGTH+NONCE_LENGTH+1)
+	if err != nil {
+		return err
+	}
+
+	r.IDHash = append([]byte{}, data[:ID_HASH_LENGTH]...)
+	r.Nonce = append([]byte{}, data[ID_HASH_LENGTH:ID_HASH_LENGTH+NONCE_LENGTH]...)
+	r.EncryptedPassword = append([]byte{}, data[ID_HASH_LENGTH+NONCE_LENGTH:]...)
+
+	return nil
+}
+
+// SignupRequest registers a new user with its identity public key.
+type SignupRequest struct {
+	IDHash            []byte
+	PublicKey         []byte
+	Nonce             []byte
+	EncryptedPassword []byte
+}
+
+func (r *SignupRequest) MessageType() MessageType { return ReqSignup }
+
+func (r *SignupRequest) Encode() ([]byte, error) {
+	err := checkLength("id hash", r.IDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("public key", r.PublicKey, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("nonce", r.Nonce, NONCE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkMinLength("encrypted password", r.EncryptedPassword, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, ID_HASH_LENGTH+crypt.KEY_LENGTH+NONCE_LENGTH+len(r.EncryptedPassword))
+	data = append(data, r.IDHash...)
+	data = append(data, r.PublicKey...)
+	data = append(data, r.Nonce...)
+	data = append(data, r.EncryptedPassword...)
+
+	return data, nil
+}
+
+func (r *SignupRequest) Decode(data []byte) error {
+	err := checkMinLength("signup request", data, ID_HASH_LENGTH+crypt.KEY_LENGTH+NONCE_LENGTH+1)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+
+	r.IDHash = append([]byte{}, data[offset:offset+ID_HASH_LENGTH]...)
+	offset += ID_HASH_LENGTH
+
+	r.PublicKey = append([]byte{}, data[offset:offset+crypt.KEY_LENGTH]...)
+	offset += crypt.KEY_LENGTH
+
+	r.Nonce = append([]byte{}, data[offset:offset+NONCE_LENGTH]...)
+	offset += NONCE_LENGTH
+
+	r.EncryptedPassword = append([]byte{}, data[offset:]...)
+
+	return nil
+}
+
+// AuthResponse is the answer to both LoginRequest and SignupRequest.
+type AuthResponse struct {
+	Token AuthToken
+}
+
+func (r *AuthResponse) Encode() ([]byte, error) {
+	return append([]byte{}, r.Token[:]...), nil
+}
+
+func (r *AuthResponse) Decode(data []byte) error {
+	err := checkLength("auth token", data, len(AuthToken{}))
+	if err != nil {
+		return err
+	}
+
+	copy(r.Token[:], data)
+	return nil
+}
+
+// LogoutRequest ends the session of the authenticated user.
+type LogoutRequest struct{}
+
+func (r *LogoutRequest) MessageType() MessageType { return ReqLogout }
+
+func (r *LogoutRequest) Encode() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (r *LogoutRequest) Decode(data []byte) error {
+	return checkLength("logout request", data, 0)
+}
+
+type LogoutResponse struct{}
+
+func (r *LogoutResponse) Encode() ([]byte, error) {
+	return []byte{0}, nil
+}
+
+func (r *LogoutResponse) Decode(data []byte) error {
+	return checkLength("logout response", data, 1)
+}
+
+// SendMessageRequest sends an encrypted message to another user.
+type SendMessageRequest struct {
+	ReceiverIDHash []byte
+	Message        []byte
+}
+
+func (r *SendMessageRequest) MessageType() MessageType { return SendMessage }
+
+func (r *SendMessageRequest) Encode() ([]byte, error) {
+	err := checkLength("receiver id hash", r.ReceiverIDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkMinLength("message", r.Message, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, ID_HASH_LENGTH+len(r.Message))
+	data = append(data, r.ReceiverIDHash...)
+	data = append(data, r.Message...)
+
+	return data, nil
+}
+
+func (r *SendMessageRequest) Decode(data []byte) error {
+	err := checkMinLength("send message request", data, ID_HASH_LENGTH+1)
+	if err != nil {
+		return err
+	}
+
+	r.ReceiverIDHash = append([]byte{}, data[:ID_HASH_LENGTH]...)
+	r.Message = append([]byte{}, data[ID_HASH_LENGTH:]...)
+
+	return nil
+}
+
+// SendMessageResponse holds the ID the server stored the message under.
+type SendMessageResponse struct {
+	MessageUUID []byte
+}
+
+func (r *SendMessageResponse) Encode() ([]byte, error) {
+	err := checkLength("message uuid", r.MessageUUID, UUID_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, r.MessageUUID...), nil
+}
+
+func (r *SendMessageResponse) Decode(data []byte) error {
+	err := checkLength("message uuid", data, UUID_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.MessageUUID = append([]byte{}, data...)
+	return nil
+}
+
+// IncomingMessage is a message sent to the user, either pushed as a RecvMessage
+// packet or returned by MessagesRequest.
+type IncomingMessage struct {
+	SenderIDHash []byte
+	Message      []byte
+}
+
+func (m *IncomingMessage) Encode() ([]byte, error) {
+	err := checkLength("sender id hash", m.SenderIDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkMinLength("message", m.Message, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, ID_HASH_LENGTH+len(m.Message))
+	data = append(data, m.SenderIDHash...)
+	data = append(data, m.Message...)
+
+	return data, nil
+}
+
+func (m *IncomingMessage) Decode(data []byte) error {
+	err := checkMinLength("incoming message", data, ID_HASH_LENGTH+1)
+	if err != nil {
+		return err
+	}
+
+	m.SenderIDHash = append([]byte{}, data[:ID_HASH_LENGTH]...)
+	m.Message = append([]byte{}, data[ID_HASH_LENGTH:]...)
+
+	return nil
+}
+
+// MessagesRequest polls the messages received after Timestamp, in microseconds.
+// When SenderIDHash is set only messages from that sender are returned.
+type MessagesRequest struct {
+	SenderIDHash []byte
+	Timestamp    int64
+}
+
+func (r *MessagesRequest) MessageType() MessageType { return ReqMessages }
+
+func (r *MessagesRequest) Encode() ([]byte, error) {
+	if r.SenderIDHash != nil {
+		err := checkLength("sender id hash", r.SenderIDHash, ID_HASH_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, 0, len(r.SenderIDHash)+utils.PACKET_LENGTH_NR_BYTES)
+	data = append(data, r.SenderIDHash...)
+	data = append(data, utils.IntToBytes(r.Timestamp)...)
+
+	return data, nil
+}
+
+func (r *MessagesRequest) Decode(data []byte) error {
+	switch len(data) {
+	case utils.PACKET_LENGTH_NR_BYTES:
+		r.SenderIDHash = nil
+	case ID_HASH_LENGTH + utils.PACKET_LENGTH_NR_BYTES:
+		r.SenderIDHash = append([]byte{}, data[:ID_HASH_LENGTH]...)
+	default:
+		return &FieldLengthError{Field: "messages request", Expected: utils.PACKET_LENGTH_NR_BYTES, Received: len(data)}
+	}
+
+	r.Timestamp = int64(utils.BytesToInt(data[len(data)-utils.PACKET_LENGTH_NR_BYTES:]))
+
+	return nil
+}
+
+// MessagesResponse is a list of messages, each prefixed by the length of the
+// sender ID hash and message together.
+type MessagesResponse struct {
+	Messages []IncomingMessage
+}
+
+func (r *MessagesResponse) Encode() ([]byte, error) {
+	data := []byte{}
+
+	for i := range r.Messages {
+		message, err := r.Messages[i].Encode()
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, utils.IntToBytes(int64(len(message)))...)
+		data = append(data, message...)
+	}
+
+	return data, nil
+}
+
+func (r *MessagesResponse) Decode(data []byte) error {
+	r.Messages = nil
+	offset := 0
+
+	for offset < len(data) {
+		err := checkMinLength("message length", data[offset:], utils.PACKET_LENGTH_NR_BYTES)
+		if err != nil {
+			return err
+		}
+
+		length := utils.BytesToInt(data[offset : offset+utils.PACKET_LENGTH_NR_BYTES])
+		offset += utils.PACKET_LENGTH_NR_BYTES
+
+		if length < 0 || length > len(data)-offset {
+			return &FieldLengthError{Field: "message", Expected: length, Received: len(data) - offset, AtLeast: true}
+		}
+
+		message := IncomingMessage{}
+		err = message.Decode(data[offset : offset+length])
+		if err != nil {
+			return err
+		}
+		offset += length
+
+		r.Messages = append(r.Messages, message)
+	}
+
+	return nil
+}
+
+// PubKeyRequest asks for the identity public key of a user.
+type PubKeyRequest struct {
+	IDHash []byte
+}
+
+func (r *PubKeyRequest) MessageType() MessageType { return ReqPubKey }
+
+func (r *PubKeyRequest) Encode() ([]byte, error) {
+	err := checkLength("id hash", r.IDHash, ID_HASH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, r.IDHash...), nil
+}
+
+func (r *PubKeyRequest) Decode(data []byte) error {
+	err := checkLength("id hash", data, ID_HASH_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.IDHash = append([]byte{}, data...)
+	return nil
+}
+
+// PubKeyResponse holds the identity public key of a user and, if the user
+// uploaded prekeys, a prekey bundle to start an X3DH session with.
+type PubKeyResponse struct {
+	PublicKey []byte
+	Bundle    *PrekeyBundle
+}
+
+func (r *PubKeyResponse) Encode() ([]byte, error) {
+	err := checkLength("public key", r.PublicKey, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append([]byte{}, r.PublicKey...)
+
+	if r.Bundle == nil {
+		return data, nil
+	}
+
+	bundle, err := r.Bundle.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, bundle...), nil
+}
+
+func (r *PubKeyResponse) Decode(data []byte) error {
+	err := checkMinLength("public key", data, crypt.KEY_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.PublicKey = append([]byte{}, data[:crypt.KEY_LENGTH]...)
+	r.Bundle = nil
+
+	if len(data) == crypt.KEY_LENGTH {
+		return nil
+	}
+
+	r.Bundle = &PrekeyBundle{}
+	return r.Bundle.Decode(data[crypt.KEY_LENGTH:])
+}
+
+// OneTimePrekey is a published X3DH one-time prekey.
+type OneTimePrekey struct {
+	ID        uint32
+	PublicKey []byte
+}
+
+func (k *OneTimePrekey) encode(data []byte) ([]byte, error) {
+	err := checkLength("one-time prekey", k.PublicKey, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	data = binary.BigEndian.AppendUint32(data, k.ID)
+	return append(data, k.PublicKey...), nil
+}
+
+func (k *OneTimePrekey) decode(data []byte) {
+	k.ID = binary.BigEndian.Uint32(data)
+	k.PublicKey = append([]byte{}, data[PREKEY_ID_LENGTH:ONE_TIME_PREKEY_LENGTH]...)
+}
+
+// SignedPrekey is the medium-term X3DH prekey, signed with the user's Ed25519
+// signing key. The signing key also signs the user's X25519 identity key.
+type SignedPrekey struct {
+	SigningKey        []byte
+	IdentitySignature []byte
+	ID                uint32
+	PublicKey         []byte
+	Signature         []byte
+}
+
+func (k *SignedPrekey) encode(data []byte) ([]byte, error) {
+	err := checkLength("signing key", k.SigningKey, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("identity key signature", k.IdentitySignature, crypt.SIGNATURE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("signed prekey", k.PublicKey, crypt.KEY_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkLength("signed prekey signature", k.Signature, crypt.SIGNATURE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	data = append(data, k.SigningKey...)
+	data = append(data, k.IdentitySignature...)
+	data = binary.BigEndian.AppendUint32(data, k.ID)
+	data = append(data, k.PublicKey...)
+	return append(data, k.Signature...), nil
+}
+
+func (k *SignedPrekey) decode(data []byte) {
+	offset := 0
+
+	k.SigningKey = append([]byte{}, data[offset:offset+crypt.KEY_LENGTH]...)
+	offset += crypt.KEY_LENGTH
+
+	k.IdentitySignature = append([]byte{}, data[offset:offset+crypt.SIGNATURE_LENGTH]...)
+	offset += crypt.SIGNATURE_LENGTH
+
+	k.ID = binary.BigEndian.Uint32(data[offset:])
+	offset += PREKEY_ID_LENGTH
+
+	k.PublicKey = append([]byte{}, data[offset:offset+crypt.KEY_LENGTH]...)
+	offset += crypt.KEY_LENGTH
+
+	k.Signature = append([]byte{}, data[offset:offset+crypt.SIGNATURE_LENGTH]...)
+}
+
+// PrekeyBundle is what a user published to be contacted with X3DH: the signed
+// prekey and, while the server has any left, one of the one-time prekeys.
+type PrekeyBundle struct {
+	SignedPrekey  SignedPrekey
+	OneTimePrekey *OneTimePrekey
+}
+
+func (b *PrekeyBundle) Encode() ([]byte, error) {
+	data, err := b.SignedPrekey.encode(make([]byte, 0, SIGNED_PREKEY_LENGTH+ONE_TIME_PREKEY_LENGTH))
+	if err != nil {
+		return nil, err
+	}
+
+	if b.OneTimePrekey == nil {
+		return data, nil
+	}
+
+	return b.OneTimePrekey.encode(data)
+}
+
+func (b *PrekeyBundle) Decode(data []byte) error {
+	switch len(data) {
+	case SIGNED_PREKEY_LENGTH:
+		b.OneTimePrekey = nil
+	case SIGNED_PREKEY_LENGTH + ONE_TIME_PREKEY_LENGTH:
+		b.OneTimePrekey = &OneTimePrekey{}
+		b.OneTimePrekey.decode(data[SIGNED_PREKEY_LENGTH:])
+	default:
+		return &FieldLengthError{Field: "prekey bundle", Expected: SIGNED_PREKEY_LENGTH, Received: len(data)}
+	}
+
+	b.SignedPrekey.decode(data)
+
+	return nil
+}
+
+// PrekeyUploadRequest publishes the signed prekey, replacing the previous one,
+// and adds one-time prekeys to those the server holds. Without one-time
+// prekeys it only asks how many are left.
+type PrekeyUploadRequest struct {
+	SignedPrekey   SignedPrekey
+	OneTimePrekeys []OneTimePrekey
+}
+
+func (r *PrekeyUploadRequest) MessageType() MessageType { return UploadPrekeys }
+
+func (r *PrekeyUploadRequest) Encode() ([]byte, error) {
+	data, err := r.SignedPrekey.encode(make([]byte, 0, SIGNED_PREKEY_LENGTH+len(r.OneTimePrekeys)*ONE_TIME_PREKEY_LENGTH))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range r.OneTimePrekeys {
+		data, err = r.OneTimePrekeys[i].encode(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+func (r *PrekeyUploadRequest) Decode(data []byte) error {
+	err := checkMinLength("prekey upload request", data, SIGNED_PREKEY_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	if (len(data)-SIGNED_PREKEY_LENGTH)%ONE_TIME_PREKEY_LENGTH != 0 {
+		return &FieldLengthError{Field: "one-time prekeys", Expected: ONE_TIME_PREKEY_LENGTH, Received: (len(data) - SIGNED_PREKEY_LENGTH) % ONE_TIME_PREKEY_LENGTH}
+	}
+
+	r.SignedPrekey.decode(data)
+
+	r.OneTimePrekeys = nil
+	for offset := SIGNED_PREKEY_LENGTH; offset < len(data); offset += ONE_TIME_PREKEY_LENGTH {
+		prekey := OneTimePrekey{}
+		prekey.decode(data[offset:])
+		r.OneTimePrekeys = append(r.OneTimePrekeys, prekey)
+	}
+
+	return nil
+}
+
+// PrekeyUploadResponse holds the number of one-time prekeys the server has left
+// for the user.
+type PrekeyUploadResponse struct {
+	Remaining uint32
+}
+
+func (r *PrekeyUploadResponse) Encode() ([]byte, error) {
+	return binary.BigEndian.AppendUint32(nil, r.Remaining), nil
+}
+
+func (r *PrekeyUploadResponse) Decode(data []byte) error {
+	err := checkLength("remaining prekeys", data, PREKEY_ID_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	r.Remaining = binary.BigEndian.Uint32(data)
+	return nil
+}
@@ -0,0 +1,389 @@
+package tcpclient
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// codec is implemented by every request and response.
+type codec interface {
+	Encode() ([]byte, error)
+	Decode(data []byte) error
+}
+
+func fill(value byte, n int) []byte {
+	return bytes.Repeat([]byte{value}, n)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	testSignedPrekey = SignedPrekey{
+		SigningKey:        fill(0x51, 32),
+		IdentitySignature: fill(0x52, 64),
+		ID:                7,
+		PublicKey:         fill(0x53, 32),
+		Signature:         fill(0x54, 64),
+	}
+	testSignedPrekeyBytes = join(fill(0x51, 32), fill(0x52, 64), []byte{0, 0, 0, 7}, fill(0x53, 32), fill(0x54, 64))
+)
+
+func TestCodecGolden(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   codec
+		decoded codec // zero value the golden bytes are decoded into
+		golden  []byte
+	}{
+		{
+			name:    "key request",
+			value:   &KeyRequest{IDHash: fill(0x11, 16)},
+			decoded: &KeyRequest{},
+			golden:  fill(0x11, 16),
+		},
+		{
+			name:    "key response",
+			value:   &KeyResponse{Key: fill(0x22, 32)},
+			decoded: &KeyResponse{},
+			golden:  fill(0x22, 32),
+		},
+		{
+			name:    "login request",
+			value:   &LoginRequest{IDHash: fill(0x11, 16), Nonce: fill(0x33, 12), EncryptedPassword: []byte{1, 2, 3}},
+			decoded: &LoginRequest{},
+			golden:  join(fill(0x11, 16), fill(0x33, 12), []byte{1, 2, 3}),
+		},
+		{
+			name:    "signup request",
+			value:   &SignupRequest{IDHash: fill(0x11, 16), PublicKey: fill(0x22, 32), Nonce: fill(0x33, 12), EncryptedPassword: []byte{1}},
+			decoded: &SignupRequest{},
+			golden:  join(fill(0x11, 16), fill(0x22, 32), fill(0x33, 12), []byte{1}),
+		},
+		{
+			name:    "auth response",
+			value:   &AuthResponse{Token: AuthToken(fill(0x44, 32))},
+			decoded: &AuthResponse{},
+			golden:  fill(0x44, 32),
+		},
+		{
+			name:    "logout request",
+			value:   &LogoutRequest{},
+			decoded: &LogoutRequest{},
+			golden:  []byte{},
+		},
+		{
+			name:    "logout response",
+			value:   &LogoutResponse{},
+			decoded: &LogoutResponse{},
+			golden:  []byte{0},
+		},
+		{
+			name:    "send message request",
+			value:   &SendMessageRequest{ReceiverIDHash: fill(0x11, 16), Message: []byte("hi")},
+			decoded: &SendMessageRequest{},
+			golden:  join(fill(0x11, 16), []byte("hi")),
+		},
+		{
+			name:    "send message response",
+			value:   &SendMessageResponse{MessageUUID: fill(0x55, 16)},
+			decoded: &SendMessageResponse{},
+			golden:  fill(0x55, 16),
+		},
+		{
+			name:    "incoming message",
+			value:   &IncomingMessage{SenderIDHash: fill(0x11, 16), Message: []byte("hi")},
+			decoded: &IncomingMessage{},
+			golden:  join(fill(0x11, 16), []byte("hi")),
+		},
+		{
+			name:    "messages request",
+			value:   &MessagesRequest{Timestamp: 0x0102030405},
+			decoded: &MessagesRequest{},
+			golden:  []byte{0, 0, 0, 1, 2, 3, 4, 5},
+		},
+		{
+			name:    "messages request from a sender",
+			value:   &MessagesRequest{SenderIDHash: fill(0x11, 16), Timestamp: 1},
+			decoded: &MessagesRequest{},
+			golden:  join(fill(0x11, 16), []byte{0, 0, 0, 0, 0, 0, 0, 1}),
+		},
+		{
+			name: "messages response",
+			value: &MessagesResponse{Messages: []IncomingMessage{
+				{SenderIDHash: fill(0x11, 16), Message: []byte("a")},
+				{SenderIDHash: fill(0x12, 16), Message: []byte("bc")},
+			}},
+			decoded: &MessagesResponse{},
+			golden: join(
+				[]byte{0, 0, 0, 0, 0, 0, 0, 17}, fill(0x11, 16), []byte("a"),
+				[]byte{0, 0, 0, 0, 0, 0, 0, 18}, fill(0x12, 16), []byte("bc"),
+			),
+		},
+		{
+			name:    "empty messages response",
+			value:   &MessagesResponse{},
+			decoded: &MessagesResponse{},
+			golden:  []byte{},
+		},
+		{
+			name:    "pub key request",
+			value:   &PubKeyRequest{IDHash: fill(0x11, 16)},
+			decoded: &PubKeyRequest{},
+			golden:  fill(0x11, 16),
+		},
+		{
+			name:    "pub key response",
+			value:   &PubKeyResponse{PublicKey: fill(0x22, 32)},
+			decoded: &PubKeyResponse{},
+			golden:  fill(0x22, 32),
+		},
+		{
+			name: "pub key response with a bundle",
+			value: &PubKeyResponse{PublicKey: fill(0x22, 32), Bundle: &PrekeyBundle{
+				SignedPrekey:  testSignedPrekey,
+				OneTimePrekey: &OneTimePrekey{ID: 0x01020304, PublicKey: fill(0x61, 32)},
+			}},
+			decoded: &PubKeyResponse{},
+			golden:  join(fill(0x22, 32), testSignedPrekeyBytes, []byte{1, 2, 3, 4}, fill(0x61, 32)),
+		},
+		{
+			name:    "prekey bundle without one-time prekey",
+			value:   &PrekeyBundle{SignedPrekey: testSignedPrekey},
+			decoded: &PrekeyBundle{},
+			golden:  testSignedPrekeyBytes,
+		},
+		{
+			name: "prekey upload request",
+			value: &PrekeyUploadRequest{SignedPrekey: testSignedPrekey, OneTimePrekeys: []OneTimePrekey{
+				{ID: 1, PublicKey: fill(0x61, 32)},
+				{ID: 2, PublicKey: fill(0x62, 32)},
+			}},
+			decoded: &PrekeyUploadRequest{},
+			golden:  join(testSignedPrekeyBytes, []byte{0, 0, 0, 1}, fill(0x61, 32), []byte{0, 0, 0, 2}, fill(0x62, 32)),
+		},
+		{
+			name:    "prekey upload request without one-time prekeys",
+			value:   &PrekeyUploadRequest{SignedPrekey: testSignedPrekey},
+			decoded: &PrekeyUploadRequest{},
+			golden:  testSignedPrekeyBytes,
+		},
+		{
+			name:    "prekey upload response",
+			value:   &PrekeyUploadResponse{Remaining: 258},
+			decoded: &PrekeyUploadResponse{},
+			golden:  []byte{0, 0, 1, 2},
+		},
+		{
+			name:    "server handshake",
+			value:   &ServerHandshake{ConnUUID: fill(0x55, 16), Versions: []byte{1, 2}, Features: FeatureChunking | FeaturePrekeys},
+			decoded: &ServerHandshake{},
+			golden:  join(fill(0x55, 16), []byte{2, 1, 2, 0, 0, 0, 0, 0, 0, 0, 5}),
+		},
+		{
+			name:    "legacy server handshake",
+			value:   &ServerHandshake{ConnUUID: fill(0x55, 16), Versions: []byte{LEGACY_PROTOCOL_VERSION}, Legacy: true},
+			decoded: &ServerHandshake{},
+			golden:  fill(0x55, 16),
+		},
+		{
+			name:    "client handshake",
+			value:   &ClientHandshake{Versions: []byte{1}, Features: FeatureDeflate},
+			decoded: &ClientHandshake{},
+			golden:  []byte{1, 1, 0, 0, 0, 0, 0, 0, 0, 2},
+		},
+		{
+			name:    "transfer chunk",
+			value:   &TransferChunk{MessageType: SendMessage, Index: 1, Total: 3, Hash: fill(0x77, 32), Data: []byte("data")},
+			decoded: &TransferChunk{},
+			golden:  join([]byte{byte(SendMessage), 0, 0, 0, 1, 0, 0, 0, 3}, fill(0x77, 32), []byte("data")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.value.Encode()
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if !bytes.Equal(encoded, tt.golden) {
+				t.Fatalf("encoded\n%x\nwant\n%x", encoded, tt.golden)
+			}
+
+			err = tt.decoded.Decode(tt.golden)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !reflect.DeepEqual(tt.decoded, tt.value) {
+				t.Fatalf("decoded %+v, want %+v", tt.decoded, tt.value)
+			}
+		})
+	}
+}
+
+func TestCodecFieldLength(t *testing.T) {
+	tests := []struct {
+		name string
+		// encode is set when the error comes from encoding value, otherwise
+		// data is decoded into it
+		encode bool
+		value  codec
+		data   []byte
+		want   FieldLengthError
+	}{
+		{
+			name:   "short id hash",
+			encode: true,
+			value:  &KeyRequest{IDHash: fill(0x11, 15)},
+			want:   FieldLengthError{Field: "id hash", Expected: 16, Received: 15},
+		},
+		{
+			name:   "empty password",
+			encode: true,
+			value:  &LoginRequest{IDHash: fill(0x11, 16), Nonce: fill(0x33, 12)},
+			want:   FieldLengthError{Field: "encrypted password", Expected: 1, Received: 0, AtLeast: true},
+		},
+		{
+			name:   "long public key",
+			encode: true,
+			value:  &SignupRequest{IDHash: fill(0x11, 16), PublicKey: fill(0x22, 33), Nonce: fill(0x33, 12), EncryptedPassword: []byte{1}},
+			want:   FieldLengthError{Field: "public key", Expected: 32, Received: 33},
+		},
+		{
+			name:   "empty message",
+			encode: true,
+			value:  &SendMessageRequest{ReceiverIDHash: fill(0x11, 16)},
+			want:   FieldLengthError{Field: "message", Expected: 1, Received: 0, AtLeast: true},
+		},
+		{
+			name:   "short sender id hash",
+			encode: true,
+			value:  &MessagesRequest{SenderIDHash: fill(0x11, 4)},
+			want:   FieldLengthError{Field: "sender id hash", Expected: 16, Received: 4},
+		},
+		{
+			name:   "short one-time prekey",
+			encode: true,
+			value:  &PrekeyUploadRequest{SignedPrekey: testSignedPrekey, OneTimePrekeys: []OneTimePrekey{{ID: 1, PublicKey: fill(0x61, 31)}}},
+			want:   FieldLengthError{Field: "one-time prekey", Expected: 32, Received: 31},
+		},
+		{
+			name:   "missing signature",
+			encode: true,
+			value:  &PrekeyBundle{SignedPrekey: SignedPrekey{SigningKey: fill(0x51, 32), IdentitySignature: fill(0x52, 64), PublicKey: fill(0x53, 32)}},
+			want:   FieldLengthError{Field: "signed prekey signature", Expected: 64, Received: 0},
+		},
+		{
+			name:   "no versions",
+			encode: true,
+			value:  &ClientHandshake{},
+			want:   FieldLengthError{Field: "versions", Expected: 1, Received: 0, AtLeast: true},
+		},
+		{
+			name:  "short key",
+			value: &KeyResponse{},
+			data:  fill(0x22, 31),
+			want:  FieldLengthError{Field: "key", Expected: 32, Received: 31},
+		},
+		{
+			name:  "short auth token",
+			value: &AuthResponse{},
+			data:  fill(0x44, 16),
+			want:  FieldLengthError{Field: "auth token", Expected: 32, Received: 16},
+		},
+		{
+			name:  "logout response with data",
+			value: &LogoutResponse{},
+			data:  []byte{0, 0},
+			want:  FieldLengthError{Field: "logout response", Expected: 1, Received: 2},
+		},
+		{
+			name:  "long message uuid",
+			value: &SendMessageResponse{},
+			data:  fill(0x55, 17),
+			want:  FieldLengthError{Field: "message uuid", Expected: 16, Received: 17},
+		},
+		{
+			name:  "incoming message without body",
+			value: &IncomingMessage{},
+			data:  fill(0x11, 16),
+			want:  FieldLengthError{Field: "incoming message", Expected: 17, Received: 16, AtLeast: true},
+		},
+		{
+			name:  "messages request between lengths",
+			value: &MessagesRequest{},
+			data:  fill(0, 12),
+			want:  FieldLengthError{Field: "messages request", Expected: 8, Received: 12},
+		},
+		{
+			name:  "truncated message length",
+			value: &MessagesResponse{},
+			data:  []byte{0, 0, 0},
+			want:  FieldLengthError{Field: "message length", Expected: 8, Received: 3, AtLeast: true},
+		},
+		{
+			name:  "message longer than the response",
+			value: &MessagesResponse{},
+			data:  join([]byte{0, 0, 0, 0, 0, 0, 0, 20}, fill(0x11, 17)),
+			want:  FieldLengthError{Field: "message", Expected: 20, Received: 17, AtLeast: true},
+		},
+		{
+			name:  "short public key",
+			value: &PubKeyResponse{},
+			data:  fill(0x22, 10),
+			want:  FieldLengthError{Field: "public key", Expected: 32, Received: 10, AtLeast: true},
+		},
+		{
+			name:  "truncated bundle",
+			value: &PubKeyResponse{},
+			data:  join(fill(0x22, 32), testSignedPrekeyBytes[:100]),
+			want:  FieldLengthError{Field: "prekey bundle", Expected: SIGNED_PREKEY_LENGTH, Received: 100},
+		},
+		{
+			name:  "partial one-time prekey",
+			value: &PrekeyUploadRequest{},
+			data:  join(testSignedPrekeyBytes, fill(0x61, 10)),
+			want:  FieldLengthError{Field: "one-time prekeys", Expected: ONE_TIME_PREKEY_LENGTH, Received: 10},
+		},
+		{
+			name:  "short remaining prekeys",
+			value: &PrekeyUploadResponse{},
+			data:  []byte{1},
+			want:  FieldLengthError{Field: "remaining prekeys", Expected: 4, Received: 1},
+		},
+		{
+			name:  "short handshake",
+			value: &ServerHandshake{},
+			data:  fill(0x55, 15),
+			want:  FieldLengthError{Field: "handshake", Expected: 16, Received: 15, AtLeast: true},
+		},
+		{
+			name:  "short chunk",
+			value: &TransferChunk{},
+			data:  fill(0, CHUNK_HEADER_LENGTH-1),
+			want:  FieldLengthError{Field: "chunk", Expected: CHUNK_HEADER_LENGTH, Received: CHUNK_HEADER_LENGTH - 1, AtLeast: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.encode {
+				_, err = tt.value.Encode()
+			} else {
+				err = tt.value.Decode(tt.data)
+			}
+
+			var lengthErr *FieldLengthError
+			if !errors.As(err, &lengthErr) {
+				t.Fatalf("got %v, want a FieldLengthError", err)
+			}
+			if *lengthErr != tt.want {
+				t.Fatalf("got %+v, want %+v", *lengthErr, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tcpclient
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+const (
+	// COMPRESSED_FLAG is set in the message type byte of packets whose body,
+	// everything after the packet header, is deflate compressed.
+	COMPRESSED_FLAG = 0x80
+	// COMPRESSION_THRESHOLD is the body size below which packets are sent raw.
+	COMPRESSION_THRESHOLD = 1024
+	// MAX_DECOMPRESSED_SIZE bounds the body of a compressed packet, the same
+	// limit uncompressed packets are held to by MAX_FRAME_SIZE.
+	MAX_DECOMPRESSED_SIZE = MAX_FRAME_SIZE - PACKET_HEADER_LENGTH
+)
+
+// DecompressedSizeError is returned for compressed packets that inflate beyond
+// MAX_DECOMPRESSED_SIZE.
+type DecompressedSizeError struct {
+	Limit int
+}
+
+func (e *DecompressedSizeError) Error() string {
+	return fmt.Sprintf("decompressed packet exceeds %d bytes", e.Limit)
+}
+
+// CompressFrame deflates the body of a frame (header and body, without the
+// length prefix) and sets COMPRESSED_FLAG. Frames below COMPRESSION_THRESHOLD,
+// and frames that do not get smaller, are returned unchanged.
+func CompressFrame(frame []byte) []byte {
+	if len(frame)-PACKET_HEADER_LENGTH < COMPRESSION_THRESHOLD {
+		return frame
+	}
+
+	var buf bytes.Buffer
+	buf.Write(frame[:PACKET_HEADER_LENGTH])
+	buf.Bytes()[1] |= COMPRESSED_FLAG
+
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return frame
+	}
+
+	_, err = writer.Write(frame[PACKET_HEADER_LENGTH:])
+	if err != nil {
+		return frame
+	}
+
+	err = writer.Close()
+	if err != nil || buf.Len() >= len(frame) {
+		return frame
+	}
+
+	return buf.Bytes()
+}
+
+// DecompressFrame inflates a frame compressed by CompressFrame and clears
+// COMPRESSED_FLAG. Frames without the flag are returned unchanged.
+func DecompressFrame(frame []byte) ([]byte, error) {
+	if len(frame) < PACKET_HEADER_LENGTH || frame[1]&COMPRESSED_FLAG == 0 {
+		return frame, nil
+	}
+
+	reader := flate.NewReader(bytes.NewReader(frame[PACKET_HEADER_LENGTH:]))
+	defer reader.Close()
+
+	var buf bytes.Buffer
+	buf.Write(frame[:PACKET_HEADER_LENGTH])
+	buf.Bytes()[1] &^= COMPRESSED_FLAG
+
+	// read one byte past the limit to tell a body of exactly the limit from a bomb
+	n, err := io.Copy(&buf, io.LimitReader(reader, int64(MAX_DECOMPRESSED_SIZE)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress packet: %w", err)
+	}
+
+	if n > int64(MAX_DECOMPRESSED_SIZE) {
+		return nil, &DecompressedSizeError{Limit: MAX_DECOMPRESSED_SIZE}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,133 @@
+package tcpclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testFrame returns a frame with a packet header and a body of n bytes of value.
+func testFrame(n int, value byte) []byte {
+	return join([]byte{LEGACY_PROTOCOL_VERSION, byte(Ping)}, fill(0x07, len(MessageID{})), fill(value, n))
+}
+
+func TestCompressFrame(t *testing.T) {
+	incompressible := testFrame(0, 0)
+	random := make([]byte, 4*COMPRESSION_THRESHOLD)
+	rand.Read(random)
+	incompressible = append(incompressible, random...)
+
+	tests := []struct {
+		name       string
+		frame      []byte
+		compressed bool
+	}{
+		{"empty body", testFrame(0, 'a'), false},
+		{"below the threshold", testFrame(COMPRESSION_THRESHOLD-1, 'a'), false},
+		{"at the threshold", testFrame(COMPRESSION_THRESHOLD, 'a'), true},
+		{"large", testFrame(MAX_DECOMPRESSED_SIZE, 'a'), true},
+		{"incompressible", incompressible, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := bytes.Clone(tt.frame)
+			compressed := CompressFrame(frame)
+
+			if !bytes.Equal(frame, tt.frame) {
+				t.Fatal("input frame modified")
+			}
+
+			flagged := compressed[1]&COMPRESSED_FLAG != 0
+			if flagged != tt.compressed {
+				t.Fatalf("compressed %v, want %v", flagged, tt.compressed)
+			}
+
+			if !tt.compressed {
+				if !bytes.Equal(compressed, tt.frame) {
+					t.Fatal("frame sent raw but changed")
+				}
+				return
+			}
+
+			if len(compressed) >= len(tt.frame) {
+				t.Fatalf("compressed to %d bytes from %d", len(compressed), len(tt.frame))
+			}
+
+			decompressed, err := DecompressFrame(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(decompressed, tt.frame) {
+				t.Fatal("round trip changed the frame")
+			}
+		})
+	}
+}
+
+func TestDecompressFrameLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    int
+		tooLong bool
+	}{
+		{"at the limit", MAX_DECOMPRESSED_SIZE, false},
+		{"past the limit", MAX_DECOMPRESSED_SIZE + 1, true},
+		{"bomb", 16 * MAX_DECOMPRESSED_SIZE, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := CompressFrame(testFrame(tt.body, 0))
+
+			decompressed, err := DecompressFrame(compressed)
+
+			var sizeErr *DecompressedSizeError
+			if tt.tooLong {
+				if !errors.As(err, &sizeErr) {
+					t.Fatalf("got %v, want a DecompressedSizeError", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decompressed) != PACKET_HEADER_LENGTH+tt.body {
+				t.Fatalf("decompressed to %d bytes", len(decompressed))
+			}
+		})
+	}
+}
+
+func TestDecompressFrameCorrupt(t *testing.T) {
+	compressed := CompressFrame(testFrame(COMPRESSION_THRESHOLD, 'a'))
+	compressed = compressed[:len(compressed)-4]
+
+	_, err := DecompressFrame(compressed)
+	if err == nil {
+		t.Fatal("truncated deflate stream decompressed")
+	}
+}
+
+func TestPayloadFrameSize(t *testing.T) {
+	s := NewTCPServer("127.0.0.1", 0)
+	s.SetAuthID(AuthID{1})
+	s.SetAuthToken(AuthToken{1})
+
+	// the largest packet fits a frame, compressed or not
+	payload, err := Packet{version: LEGACY_PROTOCOL_VERSION, messageType: SendMessage, Data: fill('a', MAX_MESSAGE_SIZE)}.payload(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payload) != SEND_LENGTH_NR_BYTES+MAX_FRAME_SIZE {
+		t.Fatalf("frame of %d bytes", len(payload)-SEND_LENGTH_NR_BYTES)
+	}
+
+	_, err = Packet{version: LEGACY_PROTOCOL_VERSION, messageType: SendMessage, Data: fill('a', MAX_MESSAGE_SIZE+1)}.payload(s)
+	if err == nil {
+		t.Fatal("packet above MAX_MESSAGE_SIZE framed")
+	}
+}
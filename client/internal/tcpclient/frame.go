@@ -0,0 +1,104 @@
+package tcpclient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"client-go/internal/utils"
+)
+
+const (
+	// The relay frames its packets with a 4 byte length prefix (gen_tcp packet: 4),
+	// the client writes the 8 byte prefix produced by Packet.payload.
+	RECV_LENGTH_NR_BYTES = 4
+	SEND_LENGTH_NR_BYTES = utils.PACKET_LENGTH_NR_BYTES
+
+	// version + message type + message ID
+	PACKET_HEADER_LENGTH = 2 + len(MessageID{})
+	// header + auth ID + auth token
+	MAX_FRAME_SIZE = MAX_MESSAGE_SIZE + PACKET_HEADER_LENGTH + len(AuthID{}) + len(AuthToken{})
+)
+
+// FrameSizeError is returned when a frame is longer than MAX_FRAME_SIZE. When
+// reading, the frame body is discarded, so the reader stays in sync with the
+// stream.
+type FrameSizeError struct {
+	Size int
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("frame length exceeds maximum: %d > %d", e.Size, MAX_FRAME_SIZE)
+}
+
+// TruncatedFrameError is returned when the stream ends in the middle of a frame.
+type TruncatedFrameError struct {
+	Expected int
+	Received int
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("frame truncated: expected %d bytes, received %d", e.Expected, e.Received)
+}
+
+// FrameReader splits a byte stream into length prefixed frames. Partial reads are
+// reassembled and coalesced frames are returned one at a time.
+type FrameReader struct {
+	reader        *bufio.Reader
+	lengthNrBytes int
+}
+
+func NewFrameReader(r io.Reader, lengthNrBytes int) *FrameReader {
+	return &FrameReader{
+		reader:        bufio.NewReader(r),
+		lengthNrBytes: lengthNrBytes,
+	}
+}
+
+// ReadFrame returns the body of the next frame without its length prefix. It
+// returns io.EOF when the stream ends cleanly between two frames.
+func (f *FrameReader) ReadFrame() ([]byte, error) {
+	prefix := make([]byte, f.lengthNrBytes)
+
+	n, err := io.ReadFull(f.reader, prefix)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, &TruncatedFrameError{Expected: f.lengthNrBytes, Received: n}
+		}
+
+		return nil, err
+	}
+
+	length := utils.BytesToInt(prefix)
+
+	if length < 0 {
+		return nil, &FrameSizeError{Size: length}
+	}
+
+	if length > MAX_FRAME_SIZE {
+		discarded, err := io.CopyN(io.Discard, f.reader, int64(length))
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, &TruncatedFrameError{Expected: length, Received: int(discarded)}
+			}
+
+			return nil, err
+		}
+
+		return nil, &FrameSizeError{Size: length}
+	}
+
+	frame := make([]byte, length)
+
+	n, err = io.ReadFull(f.reader, frame)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, &TruncatedFrameError{Expected: length, Received: n}
+		}
+
+		return nil, err
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,176 @@
+package tcpclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// prefixed frames a body with a 4 byte length prefix, as the relay does.
+func prefixed(body []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+// prefixedLength is a 4 byte length prefix announcing n bytes.
+func prefixedLength(n int) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(n))
+}
+
+func TestFrameReader(t *testing.T) {
+	first := fill('a', 10)
+	second := fill('b', 300)
+	largest := fill('c', MAX_FRAME_SIZE)
+
+	tests := []struct {
+		name   string
+		stream []byte
+		// reader wraps the stream, e.g. to split it into small reads
+		reader func(io.Reader) io.Reader
+		frames [][]byte
+		// err is checked after the frames were read
+		err func(error) bool
+	}{
+		{
+			name:   "one frame",
+			stream: prefixed(first),
+			frames: [][]byte{first},
+		},
+		{
+			name:   "empty frame",
+			stream: prefixed(nil),
+			frames: [][]byte{{}},
+		},
+		{
+			name:   "coalesced frames",
+			stream: join(prefixed(first), prefixed(second), prefixed(first)),
+			frames: [][]byte{first, second, first},
+		},
+		{
+			name:   "split across reads",
+			stream: join(prefixed(first), prefixed(second)),
+			reader: iotest.OneByteReader,
+			frames: [][]byte{first, second},
+		},
+		{
+			name:   "split across reads with errors",
+			stream: join(prefixed(second), prefixed(first)),
+			reader: iotest.DataErrReader,
+			frames: [][]byte{second, first},
+		},
+		{
+			name:   "largest frame",
+			stream: prefixed(largest),
+			reader: iotest.HalfReader,
+			frames: [][]byte{largest},
+		},
+		{
+			name:   "oversize frame discarded",
+			stream: join(prefixed(fill('x', MAX_FRAME_SIZE+1)), prefixed(first)),
+			frames: [][]byte{nil, first},
+		},
+		{
+			name:   "truncated prefix",
+			stream: join(prefixed(first), []byte{0, 0}),
+			frames: [][]byte{first},
+			err: func(err error) bool {
+				var truncated *TruncatedFrameError
+				return errors.As(err, &truncated) && truncated.Expected == RECV_LENGTH_NR_BYTES && truncated.Received == 2
+			},
+		},
+		{
+			name:   "truncated body",
+			stream: join(prefixedLength(100), fill('a', 40)),
+			reader: iotest.OneByteReader,
+			err: func(err error) bool {
+				var truncated *TruncatedFrameError
+				return errors.As(err, &truncated) && truncated.Expected == 100 && truncated.Received == 40
+			},
+		},
+		{
+			name:   "truncated body without data",
+			stream: prefixedLength(100),
+			err: func(err error) bool {
+				var truncated *TruncatedFrameError
+				return errors.As(err, &truncated) && truncated.Expected == 100 && truncated.Received == 0
+			},
+		},
+		{
+			name:   "truncated oversize frame",
+			stream: join(prefixedLength(MAX_FRAME_SIZE+1), fill('x', 10)),
+			err: func(err error) bool {
+				var truncated *TruncatedFrameError
+				return errors.As(err, &truncated) && truncated.Expected == MAX_FRAME_SIZE+1 && truncated.Received == 10
+			},
+		},
+		{
+			name:   "read error",
+			stream: prefixed(first),
+			reader: iotest.TimeoutReader,
+			frames: [][]byte{first},
+			err: func(err error) bool {
+				return errors.Is(err, iotest.ErrTimeout)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream io.Reader = bytes.NewReader(tt.stream)
+			if tt.reader != nil {
+				stream = tt.reader(stream)
+			}
+
+			reader := NewFrameReader(stream, RECV_LENGTH_NR_BYTES)
+
+			for i, want := range tt.frames {
+				frame, err := reader.ReadFrame()
+
+				// nil stands for an oversize frame
+				if want == nil {
+					var sizeErr *FrameSizeError
+					if !errors.As(err, &sizeErr) || sizeErr.Size != MAX_FRAME_SIZE+1 {
+						t.Fatalf("frame %d: got %v, want a FrameSizeError", i, err)
+					}
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(frame, want) {
+					t.Fatalf("frame %d: got %d bytes, want %d", i, len(frame), len(want))
+				}
+			}
+
+			_, err := reader.ReadFrame()
+
+			if tt.err == nil {
+				if err != io.EOF {
+					t.Fatalf("got %v at the end of the stream, want io.EOF", err)
+				}
+				return
+			}
+
+			if !tt.err(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestFrameReaderSendPrefix(t *testing.T) {
+	// the relay reads the 8 byte prefix written by Packet.payload
+	body := fill('a', 20)
+	stream := join(binary.BigEndian.AppendUint64(nil, uint64(len(body))), body)
+
+	frame, err := NewFrameReader(bytes.NewReader(stream), SEND_LENGTH_NR_BYTES).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, body) {
+		t.Fatalf("got %q", frame)
+	}
+}
@@ -0,0 +1,98 @@
+package tcpclient
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func FuzzParsePacket(f *testing.F) {
+	header := append([]byte{LEGACY_PROTOCOL_VERSION, byte(RecvMessage)}, make([]byte, 16)...)
+	f.Add(header)
+	f.Add(append(header, "hello"...))
+	f.Add(CompressFrame(append(header, bytes.Repeat([]byte("hello"), COMPRESSION_THRESHOLD)...)))
+	f.Add([]byte{LEGACY_PROTOCOL_VERSION})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, err := parsePacket(data)
+		if err != nil {
+			return
+		}
+
+		if len(packet.Data) > MAX_DECOMPRESSED_SIZE {
+			t.Fatalf("decompressed %d bytes, limit is %d", len(packet.Data), MAX_DECOMPRESSED_SIZE)
+		}
+
+		// whatever was parsed survives compression
+		frame := append([]byte{byte(packet.version), byte(packet.messageType)}, packet.messageID[:]...)
+		frame = append(frame, packet.Data...)
+
+		decompressed, err := DecompressFrame(CompressFrame(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, frame) {
+			t.Fatal("frame changed by compression")
+		}
+	})
+}
+
+// FuzzDecode checks that every response and request decodes without panicking
+// and that whatever decodes encodes to bytes decoding to the same value. The
+// bytes may differ where the protocol ignores them, like the logout response.
+func FuzzDecode(f *testing.F) {
+	codecs := []func() codec{
+		func() codec { return &KeyRequest{} },
+		func() codec { return &KeyResponse{} },
+		func() codec { return &LoginRequest{} },
+		func() codec { return &SignupRequest{} },
+		func() codec { return &AuthResponse{} },
+		func() codec { return &LogoutRequest{} },
+		func() codec { return &LogoutResponse{} },
+		func() codec { return &SendMessageRequest{} },
+		func() codec { return &SendMessageResponse{} },
+		func() codec { return &IncomingMessage{} },
+		func() codec { return &MessagesRequest{} },
+		func() codec { return &MessagesResponse{} },
+		func() codec { return &PubKeyRequest{} },
+		func() codec { return &PubKeyResponse{} },
+		func() codec { return &PrekeyBundle{} },
+		func() codec { return &PrekeyUploadRequest{} },
+		func() codec { return &PrekeyUploadResponse{} },
+		func() codec { return &ServerHandshake{} },
+		func() codec { return &ClientHandshake{} },
+		func() codec { return &TransferChunk{} },
+	}
+
+	f.Add([]byte{})
+	f.Add(fill(0x11, 16))
+	f.Add(join([]byte{0, 0, 0, 0, 0, 0, 0, 17}, fill(0x11, 16), []byte("a")))
+	f.Add(join(fill(0x22, 32), testSignedPrekeyBytes, []byte{1, 2, 3, 4}, fill(0x61, 32)))
+	f.Add(join(fill(0x55, 16), []byte{2, 1, 2, 0, 0, 0, 0, 0, 0, 0, 5}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, newCodec := range codecs {
+			value := newCodec()
+			if value.Decode(data) != nil {
+				continue
+			}
+
+			encoded, err := value.Encode()
+			if err != nil {
+				t.Fatalf("%T: decoded but does not encode: %v", value, err)
+			}
+			if len(encoded) != len(data) {
+				t.Fatalf("%T: encoded %d bytes from %d", value, len(encoded), len(data))
+			}
+
+			decoded := newCodec()
+			err = decoded.Decode(encoded)
+			if err != nil {
+				t.Fatalf("%T: encoded value does not decode: %v", value, err)
+			}
+			if !reflect.DeepEqual(decoded, value) {
+				t.Fatalf("%T: decoded %+v, want %+v", value, decoded, value)
+			}
+		}
+	})
+}
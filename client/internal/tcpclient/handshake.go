@@ -0,0 +1,271 @@
+package tcpclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// LEGACY_PROTOCOL_VERSION is spoken by relays whose handshake only carries the
+// connection ID.
+const LEGACY_PROTOCOL_VERSION = 1
+
+// PROTOCOL_VERSIONS lists the packet versions this client supports.
+var PROTOCOL_VERSIONS = []byte{LEGACY_PROTOCOL_VERSION}
+
+// Features is a bit set of optional protocol features.
+type Features uint64
+
+const (
+	// FeatureChunking allows payloads larger than MAX_MESSAGE_SIZE to be split
+	// into Chunk packets.
+	FeatureChunking Features = 1 << iota
+	// FeatureDeflate allows packet bodies to be deflate compressed, see
+	// CompressFrame.
+	FeatureDeflate
+	// FeaturePrekeys allows uploading X3DH prekeys with PrekeyUploadRequest,
+	// PubKeyResponse then carries a prekey bundle.
+	FeaturePrekeys
+)
+
+// DEFAULT_FEATURES are offered by a new TCPServer.
+const DEFAULT_FEATURES = FeatureChunking | FeatureDeflate | FeaturePrekeys
+
+// Capabilities is the outcome of the handshake: the packet version used on the
+// connection and the features both sides support.
+type Capabilities struct {
+	Version  byte
+	Features Features
+}
+
+func (c Capabilities) Has(feature Features) bool {
+	return c.Features&feature == feature
+}
+
+var legacyCapabilities = Capabilities{Version: LEGACY_PROTOCOL_VERSION}
+
+// UnsupportedVersionError is returned for packets stamped with a version this
+// client does not speak.
+type UnsupportedVersionError struct {
+	Version byte
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, supported: %v", e.Version, PROTOCOL_VERSIONS)
+}
+
+// NoCommonVersionError is returned when the server supports none of the
+// versions of this client.
+type NoCommonVersionError struct {
+	Offered []byte
+}
+
+func (e *NoCommonVersionError) Error() string {
+	return fmt.Sprintf("no common protocol version: server offers %v, client supports %v", e.Offered, PROTOCOL_VERSIONS)
+}
+
+func isSupportedVersion(version byte) bool {
+	return slices.Contains(PROTOCOL_VERSIONS, version)
+}
+
+// ServerHandshake is the data of the Handshake packet the server sends first.
+type ServerHandshake struct {
+	ConnUUID []byte
+	Versions []byte
+	Features Features
+	// Legacy is set for relays that only send the connection ID and do not
+	// expect a ClientHandshake.
+	Legacy bool
+}
+
+func (h *ServerHandshake) Encode() ([]byte, error) {
+	err := checkLength("connection uuid", h.ConnUUID, UUID_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Legacy {
+		return append([]byte{}, h.ConnUUID...), nil
+	}
+
+	versions, err := encodeVersions(h.Versions, h.Features)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, h.ConnUUID...), versions...), nil
+}
+
+func (h *ServerHandshake) Decode(data []byte) error {
+	err := checkMinLength("handshake", data, UUID_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	h.ConnUUID = append([]byte{}, data[:UUID_LENGTH]...)
+
+	h.Legacy = len(data) == UUID_LENGTH
+	if h.Legacy {
+		h.Versions = []byte{LEGACY_PROTOCOL_VERSION}
+		h.Features = 0
+		return nil
+	}
+
+	h.Versions, h.Features, err = decodeVersions(data[UUID_LENGTH:])
+	return err
+}
+
+// ClientHandshake answers a ServerHandshake with the versions and features of
+// the client. It is not sent to legacy relays.
+type ClientHandshake struct {
+	Versions []byte
+	Features Features
+}
+
+func (h *ClientHandshake) MessageType() MessageType { return Handshake }
+
+func (h *ClientHandshake) Encode() ([]byte, error) {
+	return encodeVersions(h.Versions, h.Features)
+}
+
+func (h *ClientHandshake) Decode(data []byte) error {
+	var err error
+	h.Versions, h.Features, err = decodeVersions(data)
+	return err
+}
+
+// encodeVersions encodes [count][versions...][features 8 bytes].
+func encodeVersions(versions []byte, features Features) ([]byte, error) {
+	if len(versions) == 0 || len(versions) > 0xFF {
+		return nil, &FieldLengthError{Field: "versions", Expected: 1, Received: len(versions), AtLeast: true}
+	}
+
+	data := make([]byte, 0, 1+len(versions)+8)
+	data = append(data, byte(len(versions)))
+	data = append(data, versions...)
+	data = binary.BigEndian.AppendUint64(data, uint64(features))
+
+	return data, nil
+}
+
+func decodeVersions(data []byte) ([]byte, Features, error) {
+	err := checkMinLength("versions", data, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := int(data[0])
+	if count == 0 {
+		return nil, 0, &FieldLengthError{Field: "versions", Expected: 1, Received: 0, AtLeast: true}
+	}
+
+	err = checkLength("versions", data[1:], count+8)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	versions := append([]byte{}, data[1:1+count]...)
+	features := Features(binary.BigEndian.Uint64(data[1+count:]))
+
+	return versions, features, nil
+}
+
+// negotiate picks the highest version both sides support and the features both
+// sides enabled.
+func negotiate(local Features, remote *ServerHandshake) (Capabilities, error) {
+	version := byte(0)
+	for _, v := range remote.Versions {
+		if isSupportedVersion(v) && v > version {
+			version = v
+		}
+	}
+
+	if version == 0 {
+		return Capabilities{}, &NoCommonVersionError{Offered: remote.Versions}
+	}
+
+	return Capabilities{Version: version, Features: local & remote.Features}, nil
+}
+
+// readHandshake reads the Handshake packet the server sends on connect.
+func (s *TCPServer) readHandshake(reader *FrameReader) (*ServerHandshake, error) {
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
+	}
+
+	// no version is agreed on yet, so the version of the handshake itself is
+	// not checked
+	if len(frame) < PACKET_HEADER_LENGTH || MessageType(frame[1]) != Handshake {
+		return nil, fmt.Errorf("expected handshake packet")
+	}
+
+	s.record(Inbound, &Packet{
+		version:     int(frame[0]),
+		messageType: Handshake,
+		Data:        frame[PACKET_HEADER_LENGTH:],
+	})
+
+	remote := &ServerHandshake{}
+	err = remote.Decode(frame[PACKET_HEADER_LENGTH:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake: %w", err)
+	}
+
+	return remote, nil
+}
+
+// answerHandshake negotiates the capabilities of the connection and, unless the
+// server is a legacy relay, sends the client's versions and features.
+func (s *TCPServer) answerHandshake(conn net.Conn, remote *ServerHandshake) (Capabilities, error) {
+	if remote.Legacy {
+		return legacyCapabilities, nil
+	}
+
+	s.mu.Lock()
+	local := s.features
+	s.mu.Unlock()
+
+	capabilities, err := negotiate(local, remote)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	data, err := (&ClientHandshake{Versions: PROTOCOL_VERSIONS, Features: local}).Encode()
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	packet := createPacket(capabilities.Version, Handshake, data)
+
+	payload, err := packet.payload(s)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	s.record(Outbound, packet)
+
+	_, err = conn.Write(payload)
+	if err != nil {
+		return Capabilities{}, fmt.Errorf("failed to send handshake: %w", err)
+	}
+
+	return capabilities, nil
+}
+
+// SetFeatures sets the features the client offers, it takes effect on the next
+// connection.
+func (s *TCPServer) SetFeatures(features Features) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.features = features
+}
+
+// Capabilities returns the version and features negotiated on the current
+// connection.
+func (s *TCPServer) Capabilities() Capabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.capabilities
+}
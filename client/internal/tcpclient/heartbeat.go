@@ -0,0 +1,101 @@
+package tcpclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"client-go/internal/utils"
+)
+
+// HeartbeatConfig controls the Ping packets used to detect dead connections. A
+// zero Interval disables the heartbeat.
+type HeartbeatConfig struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	MaxMissed int // missed beats before the connection is dropped and re-established
+}
+
+var DefaultHeartbeatConfig = HeartbeatConfig{
+	Interval:  15 * time.Second,
+	Timeout:   5 * time.Second,
+	MaxMissed: 3,
+}
+
+// SetHeartbeat changes the heartbeat configuration, it takes effect on the next
+// connection.
+func (s *TCPServer) SetHeartbeat(config HeartbeatConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeatConfig = config
+}
+
+// RTT returns the round trip time measured by the last heartbeat.
+func (s *TCPServer) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+// heartbeat pings the server until the connection is closed. After MaxMissed
+// beats without a response the connection is closed, which makes the listener
+// reconnect.
+func (s *TCPServer) heartbeat(conn net.Conn, connDone <-chan struct{}) {
+	s.mu.Lock()
+	config := s.heartbeatConfig
+	s.mu.Unlock()
+
+	if config.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	missed := 0
+
+	for {
+		select {
+		case <-connDone:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+		start := time.Now()
+		_, err := s.SendReceiveContext(ctx, Ping, utils.IntToBytes(start.UnixNano()))
+		cancel()
+
+		// any response, even an error, shows the connection is alive
+		var serverErr *ServerError
+		if err == nil || errors.As(err, &serverErr) {
+			s.mu.Lock()
+			s.rtt = time.Since(start)
+			s.mu.Unlock()
+
+			if missed > 0 {
+				missed = 0
+				s.state.set(s.liveState())
+			}
+
+			continue
+		}
+
+		if IsRetryable(err) {
+			return
+		}
+
+		missed++
+		log.Printf("Missed heartbeat %d/%d: %v", missed, config.MaxMissed, err)
+
+		s.state.set(Degraded)
+
+		if missed >= config.MaxMissed {
+			log.Printf("Server stopped responding, dropping connection")
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package tcpclient
+
+import (
+	"context"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// Invoker sends a request and returns its response. Packets sent with Send have
+// no response, the Invoker returns nil for them.
+type Invoker func(ctx context.Context, request *Packet) (*Packet, error)
+
+// RequestInterceptor wraps outgoing requests, for logging, metrics or fault
+// injection. It calls next to send the request, possibly with a modified
+// packet, or short-circuits by returning without calling it.
+type RequestInterceptor func(ctx context.Context, request *Packet, next Invoker) (*Packet, error)
+
+// PacketInterceptor wraps the dispatch of incoming packets to pending requests
+// and handlers. It calls next to dispatch the packet, possibly a modified one,
+// or drops it by returning without calling it.
+type PacketInterceptor func(packet *Packet, next MessageHandler)
+
+// AddRequestInterceptor adds an interceptor for outgoing requests. Interceptors
+// run in the order they were added, the first one added is the outermost.
+func (s *TCPServer) AddRequestInterceptor(interceptor RequestInterceptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requestInterceptors = append(s.requestInterceptors, interceptor)
+}
+
+// AddPacketInterceptor adds an interceptor for incoming packets. Interceptors
+// run in the order they were added, the first one added is the outermost.
+func (s *TCPServer) AddPacketInterceptor(interceptor PacketInterceptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetInterceptors = append(s.packetInterceptors, interceptor)
+}
+
+// intercept sends request through the request interceptors, invoke is called
+// at the end of the chain.
+func (s *TCPServer) intercept(ctx context.Context, request *Packet, invoke Invoker) (*Packet, error) {
+	s.mu.Lock()
+	interceptors := s.requestInterceptors
+	s.mu.Unlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoke
+		invoke = func(ctx context.Context, request *Packet) (*Packet, error) {
+			return interceptor(ctx, request, next)
+		}
+	}
+
+	return invoke(ctx, request)
+}
+
+// interceptIncoming passes packet through the packet interceptors, dispatch is
+// called at the end of the chain.
+func (s *TCPServer) interceptIncoming(packet *Packet, dispatch MessageHandler) {
+	s.mu.Lock()
+	interceptors := s.packetInterceptors
+	s.mu.Unlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], dispatch
+		dispatch = func(packet *Packet) {
+			interceptor(packet, next)
+		}
+	}
+
+	dispatch(packet)
+}
+
+// MessageType returns the type of the packet.
+func (p Packet) MessageType() MessageType {
+	return p.messageType
+}
+
+// MessageID returns the ID shared by a request and its response.
+func (p Packet) MessageID() MessageID {
+	return p.messageID
+}
+
+// Version returns the protocol version the packet was created for.
+func (p Packet) Version() int {
+	return p.version
+}
+
+// Reply creates a response to the packet, e.g. for an interceptor answering a
+// request itself. Replying with the Error type fails the request with a
+// ServerError.
+func (p Packet) Reply(messageType MessageType, data []byte) *Packet {
+	return &Packet{
+		version:     p.version,
+		messageType: messageType,
+		messageID:   p.messageID,
+		Data:        data,
+	}
+}
+
+// LoggingInterceptor logs the type, ID, size and latency of every request and
+// the type and size of its response.
+func LoggingInterceptor(ctx context.Context, request *Packet, next Invoker) (*Packet, error) {
+	start := time.Now()
+
+	response, err := next(ctx, request)
+
+	id := hex.EncodeToString(request.messageID[:])
+	latency := time.Since(start)
+
+	switch {
+	case err != nil:
+		log.Printf("Request %s type %d (%d bytes) failed after %s: %v", id, request.messageType, len(request.Data), latency, err)
+	case response == nil:
+		log.Printf("Sent %s type %d (%d bytes) in %s", id, request.messageType, len(request.Data), latency)
+	default:
+		log.Printf("Request %s type %d (%d bytes) answered with type %d (%d bytes) in %s", id, request.messageType, len(request.Data), response.messageType, len(response.Data), latency)
+	}
+
+	return response, err
+}
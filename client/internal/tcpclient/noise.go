@@ -0,0 +1,491 @@
+package tcpclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"client-go/internal/crypt"
+)
+
+const (
+	NOISE_PROTOCOL_NAME = "Noise_XX_25519_ChaChaPoly_SHA256"
+	NOISE_PROLOGUE      = "secure-messager"
+
+	// Noise messages are limited to 65535 bytes, including the AEAD tag.
+	NOISE_MAX_MESSAGE_SIZE = 65535
+	NOISE_TAG_LENGTH       = 16
+)
+
+var ErrNoiseDecrypt = errors.New("noise: failed to decrypt message")
+
+// NoiseConfig enables an encrypted channel between client and relay, set up
+// with a Noise XX handshake right after the relay's Handshake packet. Both
+// sides authenticate with their static X25519 keys.
+type NoiseConfig struct {
+	// StaticKey is the client's identity key pair.
+	StaticKey crypt.KeyPair
+	// Address is the relay the static key is pinned for, as host:port.
+	Address string
+	// RemoteStatic pins the relay's static key. When it is nil the key is
+	// pinned in PinStore on first connect instead.
+	RemoteStatic []byte
+	PinStore     PinStore
+}
+
+// pinName is the name the relay's static key is pinned under, one per relay.
+func (c *NoiseConfig) pinName() string {
+	return "noise:" + c.Address
+}
+
+// verifyRemote checks the relay's static key against the configured pin.
+func (c *NoiseConfig) verifyRemote(remoteStatic []byte) error {
+	name := c.pinName()
+
+	if c.RemoteStatic != nil {
+		if !bytes.Equal(c.RemoteStatic, remoteStatic) {
+			return &PinMismatchError{Name: name, Expected: c.RemoteStatic, Received: remoteStatic}
+		}
+
+		return nil
+	}
+
+	if c.PinStore == nil {
+		return fmt.Errorf("noise: no pin configured for the relay key")
+	}
+
+	if c.Address == "" {
+		return fmt.Errorf("noise: no relay address to pin the key for")
+	}
+
+	pinned, err := c.PinStore.GetPin(name)
+	if err != nil {
+		return err
+	}
+
+	if pinned == nil {
+		return c.PinStore.SetPin(name, remoteStatic)
+	}
+
+	if !bytes.Equal(pinned, remoteStatic) {
+		return &PinMismatchError{Name: name, Expected: pinned, Received: remoteStatic}
+	}
+
+	return nil
+}
+
+type cipherState struct {
+	key   []byte
+	nonce uint64
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) ([]byte, error) {
+	if c.key == nil {
+		return plaintext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := aead.Seal(nil, c.nonceBytes(), plaintext, ad)
+	c.nonce++
+
+	return ciphertext, nil
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	if c.key == nil {
+		return ciphertext, nil
+	}
+
+	aead, err := chacha20poly1305.New(c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, ErrNoiseDecrypt
+	}
+	c.nonce++
+
+	return plaintext, nil
+}
+
+func (c *cipherState) nonceBytes() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	return nonce
+}
+
+type symmetricState struct {
+	cipher        cipherState
+	chainingKey   []byte
+	handshakeHash []byte
+}
+
+func newSymmetricState(prologue []byte) *symmetricState {
+	// the protocol name is exactly 32 bytes, so it is used as the hash directly
+	h := []byte(NOISE_PROTOCOL_NAME)
+
+	s := &symmetricState{
+		chainingKey:   h,
+		handshakeHash: h,
+	}
+	s.mixHash(prologue)
+
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.handshakeHash)
+	h.Write(data)
+	s.handshakeHash = h.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(input []byte) {
+	var key []byte
+	s.chainingKey, key = noiseHKDF(s.chainingKey, input)
+	s.cipher = cipherState{key: key}
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipher.encrypt(s.handshakeHash, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(s.handshakeHash, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the initiator's and the responder's sending cipher states.
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := noiseHKDF(s.chainingKey, nil)
+	return &cipherState{key: k1}, &cipherState{key: k2}
+}
+
+func noiseHKDF(chainingKey, input []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainingKey)
+	mac.Write(input)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+func noiseDH(keypair crypt.KeyPair, publicKey []byte) ([]byte, error) {
+	return crypt.GenerateSharedSecret(keypair, publicKey)
+}
+
+// NoiseClient runs the initiator side of the XX handshake over conn and returns
+// the encrypted connection.
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+func NoiseClient(conn net.Conn, config *NoiseConfig) (net.Conn, error) {
+	ephemeral, err := crypt.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return noiseClient(conn, config, []byte(NOISE_PROLOGUE), ephemeral)
+}
+
+// noiseClient runs the initiator side with the given prologue and ephemeral
+// key, the test vectors fix both.
+func noiseClient(conn net.Conn, config *NoiseConfig, prologue []byte, ephemeral crypt.KeyPair) (*noiseConn, error) {
+	s := newSymmetricState(prologue)
+
+	// -> e
+	s.mixHash(ephemeral.PublicKey)
+	payload, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeNoiseMessage(conn, append(bytes.Clone(ephemeral.PublicKey), payload...))
+	if err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es
+	message, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message) < crypt.KEY_LENGTH+crypt.KEY_LENGTH+NOISE_TAG_LENGTH {
+		return nil, fmt.Errorf("noise: handshake message too short")
+	}
+
+	remoteEphemeral := message[:crypt.KEY_LENGTH]
+	s.mixHash(remoteEphemeral)
+
+	err = mixDH(s, ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteStatic, err := s.decryptAndHash(message[crypt.KEY_LENGTH : 2*crypt.KEY_LENGTH+NOISE_TAG_LENGTH])
+	if err != nil {
+		return nil, err
+	}
+
+	err = mixDH(s, ephemeral, remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.decryptAndHash(message[2*crypt.KEY_LENGTH+NOISE_TAG_LENGTH:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.verifyRemote(remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+
+	// -> s, se
+	encryptedStatic, err := s.encryptAndHash(config.StaticKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mixDH(s, config.StaticKey, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err = s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeNoiseMessage(conn, append(encryptedStatic, payload...))
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv := s.split()
+
+	return &noiseConn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// NoiseServer runs the responder side of the XX handshake over conn. It returns
+// the encrypted connection and the client's static key.
+func NoiseServer(conn net.Conn, staticKey crypt.KeyPair) (net.Conn, []byte, error) {
+	ephemeral, err := crypt.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return noiseServer(conn, staticKey, []byte(NOISE_PROLOGUE), ephemeral)
+}
+
+// noiseServer runs the responder side with the given prologue and ephemeral
+// key.
+func noiseServer(conn net.Conn, staticKey crypt.KeyPair, prologue []byte, ephemeral crypt.KeyPair) (*noiseConn, []byte, error) {
+	s := newSymmetricState(prologue)
+
+	// -> e
+	message, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(message) < crypt.KEY_LENGTH {
+		return nil, nil, fmt.Errorf("noise: handshake message too short")
+	}
+
+	remoteEphemeral := message[:crypt.KEY_LENGTH]
+	s.mixHash(remoteEphemeral)
+
+	_, err = s.decryptAndHash(message[crypt.KEY_LENGTH:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	s.mixHash(ephemeral.PublicKey)
+
+	err = mixDH(s, ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedStatic, err := s.encryptAndHash(staticKey.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = mixDH(s, staticKey, remoteEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response := append(bytes.Clone(ephemeral.PublicKey), encryptedStatic...)
+	err = writeNoiseMessage(conn, append(response, payload...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	message, err = readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(message) < crypt.KEY_LENGTH+NOISE_TAG_LENGTH {
+		return nil, nil, fmt.Errorf("noise: handshake message too short")
+	}
+
+	remoteStatic, err := s.decryptAndHash(message[:crypt.KEY_LENGTH+NOISE_TAG_LENGTH])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = mixDH(s, ephemeral, remoteStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = s.decryptAndHash(message[crypt.KEY_LENGTH+NOISE_TAG_LENGTH:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recv, send := s.split()
+
+	return &noiseConn{Conn: conn, send: send, recv: recv}, remoteStatic, nil
+}
+
+func mixDH(s *symmetricState, keypair crypt.KeyPair, publicKey []byte) error {
+	dh, err := noiseDH(keypair, publicKey)
+	if err != nil {
+		return err
+	}
+
+	s.mixKey(dh)
+	return nil
+}
+
+// Noise messages are sent with a 2 byte length prefix.
+func writeNoiseMessage(w io.Writer, message []byte) error {
+	if len(message) > NOISE_MAX_MESSAGE_SIZE {
+		return fmt.Errorf("noise: message too long: %d", len(message))
+	}
+
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(message)))
+	_, err := w.Write(append(frame, message...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 2)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint16(prefix))
+	_, err = io.ReadFull(r, message)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// noiseConn encrypts everything written to it as Noise transport messages and
+// presents the decrypted messages it reads as a continuous byte stream.
+type noiseConn struct {
+	net.Conn
+	send    *cipherState
+	recv    *cipherState
+	pending []byte
+	writeMu sync.Mutex
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		message, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending, err = c.recv.decrypt(nil, message)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(p) {
+		end := min(len(p), written+NOISE_MAX_MESSAGE_SIZE-NOISE_TAG_LENGTH)
+
+		message, err := c.send.encrypt(nil, p[written:end])
+		if err != nil {
+			return written, err
+		}
+
+		err = writeNoiseMessage(c.Conn, message)
+		if err != nil {
+			return written, err
+		}
+
+		written = end
+	}
+
+	return written, nil
+}
@@ -0,0 +1,217 @@
+package tcpclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+
+	"client-go/internal/crypt"
+)
+
+// recordingConn keeps every message written to it.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.written = append(c.written, bytes.Clone(p))
+	c.mu.Unlock()
+
+	return c.Conn.Write(p)
+}
+
+// message returns the i-th message written, without its length prefix.
+func (c *recordingConn) message(t *testing.T, i int) string {
+	t.Helper()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i >= len(c.written) {
+		t.Fatalf("only %d messages written", len(c.written))
+	}
+
+	return hex.EncodeToString(c.written[i][2:])
+}
+
+func keyPairFromHex(t *testing.T, private string) crypt.KeyPair {
+	t.Helper()
+
+	privateKey, err := hex.DecodeString(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crypt.KeyPair{PublicKey: publicKey, PrivateKey: privateKey}
+}
+
+// handshakeNoise runs both sides of the handshake over a pipe.
+func handshakeNoise(t *testing.T, config *NoiseConfig, prologue []byte, initEphemeral, respStatic, respEphemeral crypt.KeyPair) (*noiseConn, *noiseConn, []byte, *recordingConn, *recordingConn, error) {
+	t.Helper()
+
+	clientPipe, serverPipe := net.Pipe()
+	t.Cleanup(func() {
+		clientPipe.Close()
+		serverPipe.Close()
+	})
+
+	clientConn := &recordingConn{Conn: clientPipe}
+	serverConn := &recordingConn{Conn: serverPipe}
+
+	type result struct {
+		conn         *noiseConn
+		remoteStatic []byte
+		err          error
+	}
+	server := make(chan result, 1)
+
+	go func() {
+		conn, remoteStatic, err := noiseServer(serverConn, respStatic, prologue, respEphemeral)
+		if err != nil {
+			serverPipe.Close()
+		}
+		server <- result{conn, remoteStatic, err}
+	}()
+
+	client, err := noiseClient(clientConn, config, prologue, initEphemeral)
+	if err != nil {
+		clientPipe.Close()
+		<-server
+		return nil, nil, nil, clientConn, serverConn, err
+	}
+
+	r := <-server
+	return client, r.conn, r.remoteStatic, clientConn, serverConn, r.err
+}
+
+// TestNoiseVector checks the handshake and the first transport messages against
+// the Noise_XX_25519_ChaChaPoly_SHA256 vector without prologue and payloads from
+// the cacophony test vectors.
+func TestNoiseVector(t *testing.T) {
+	initStatic := keyPairFromHex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	respStatic := keyPairFromHex(t, "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+	initEphemeral := keyPairFromHex(t, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f")
+	respEphemeral := keyPairFromHex(t, "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60")
+
+	config := &NoiseConfig{StaticKey: initStatic, RemoteStatic: respStatic.PublicKey}
+
+	client, server, clientStatic, clientConn, serverConn, err := handshakeNoise(t, config, nil, initEphemeral, respStatic, respEphemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(clientStatic, initStatic.PublicKey) {
+		t.Fatalf("responder received static key %x, want %x", clientStatic, initStatic.PublicKey)
+	}
+
+	handshake := []struct {
+		conn *recordingConn
+		want string
+	}{
+		{clientConn, "358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254"},
+		{serverConn, "64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4560a34e36ea82109f26cf2e5a5caf992b608d55c747f615e5a3425a7a19eefb8f"},
+		{clientConn, "87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d97e5ea11b16f3968710b23a3be3202dc1b5e1ce3c963347491e74f5c0768a9b42"},
+	}
+
+	for i, message := range handshake {
+		if got := message.conn.message(t, i/2); got != message.want {
+			t.Fatalf("handshake message %d\n%s\nwant\n%s", i, got, message.want)
+		}
+	}
+
+	transport := []struct {
+		from, to   *noiseConn
+		recorded   *recordingConn
+		index      int
+		payload    string
+		ciphertext string
+	}{
+		{client, server, clientConn, 2, "yellowsubmarine", "a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6"},
+		{server, client, serverConn, 1, "submarineyellow", "2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521"},
+	}
+
+	for _, message := range transport {
+		go message.from.Write([]byte(message.payload))
+
+		received := make([]byte, len(message.payload))
+		_, err := io.ReadFull(message.to, received)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := message.recorded.message(t, message.index); got != message.ciphertext {
+			t.Fatalf("transport message %q\n%s\nwant\n%s", message.payload, got, message.ciphertext)
+		}
+		if string(received) != message.payload {
+			t.Fatalf("received %q, want %q", received, message.payload)
+		}
+	}
+}
+
+func TestNoisePin(t *testing.T) {
+	relayKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRelayKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := crypt.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &memoryPinStore{pins: map[string][]byte{}}
+
+	connect := func(address string, relayKey crypt.KeyPair) error {
+		config := &NoiseConfig{StaticKey: clientKey, Address: address, PinStore: store}
+
+		ephemeral, _ := crypt.GenerateKeyPair()
+		relayEphemeral, _ := crypt.GenerateKeyPair()
+
+		_, _, _, _, _, err := handshakeNoise(t, config, []byte(NOISE_PROLOGUE), ephemeral, relayKey, relayEphemeral)
+		return err
+	}
+
+	// the first connect pins the key, the same key is accepted again
+	for range 2 {
+		err = connect("relay-a:4040", relayKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pin := store.pins["noise:relay-a:4040"]; !bytes.Equal(pin, relayKey.PublicKey) {
+		t.Fatalf("pinned %x, want %x", pin, relayKey.PublicKey)
+	}
+
+	// another relay has its own pin
+	err = connect("relay-b:4040", otherRelayKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pinErr *PinMismatchError
+	err = connect("relay-a:4040", otherRelayKey)
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("changed relay key: got %v, want a PinMismatchError", err)
+	}
+	if pinErr.Name != "noise:relay-a:4040" {
+		t.Fatalf("mismatch reported for %q", pinErr.Name)
+	}
+}
@@ -2,6 +2,7 @@ package tcpclient
 
 import (
 	"client-go/internal/utils"
+	"context"
 	"crypto/rand"
 	"fmt"
 )
@@ -23,6 +24,10 @@ const (
 	RecvMessage
 	ReqMessages
 	ReqPubKey
+	Ping
+	Pong
+	Chunk
+	UploadPrekeys
 )
 
 type Packet struct {
@@ -37,6 +42,8 @@ const (
 )
 
 func (p Packet) payload(s *TCPServer) ([]byte, error) {
+	// the relay inflates compressed bodies only up to MAX_DECOMPRESSED_SIZE, so
+	// the data is held to the limit before compression as well
 	if len(p.Data) > MAX_MESSAGE_SIZE {
 		return nil, fmt.Errorf("data length exceeds maximum: %d", len(p.Data))
 	}
@@ -45,7 +52,7 @@ func (p Packet) payload(s *TCPServer) ([]byte, error) {
 	message = append(message, byte(p.messageType))
 	message = append(message, p.messageID[:]...)
 
-	if p.messageType != ReqKey && p.messageType != ReqLogin && p.messageType != ReqSignup {
+	if p.messageType.requiresAuth() {
 		if s.authID == (AuthID{}) || s.authToken == (AuthToken{}) {
 			return nil, fmt.Errorf("authID or authToken not set")
 		}
@@ -56,41 +63,84 @@ func (p Packet) payload(s *TCPServer) ([]byte, error) {
 
 	message = append(message, p.Data...)
 
+	if s.Capabilities().Has(FeatureDeflate) {
+		message = CompressFrame(message)
+	}
+
+	if len(message) > MAX_FRAME_SIZE {
+		return nil, &FrameSizeError{Size: len(message)}
+	}
+
 	message = append(utils.IntToBytes(int64(len(message))), message...)
 
 	return message, nil
 }
 
+// requiresAuth reports whether packets of this type carry the auth ID and token.
+func (t MessageType) requiresAuth() bool {
+	switch t {
+	case Handshake, ReqKey, ReqLogin, ReqSignup, Ping, Pong:
+		return false
+	}
+
+	return true
+}
+
 func (p Packet) messageIDStr() string {
 	messageId := p.messageID[:]
 	return string(messageId)
 }
 
-func createPacket(messageType MessageType, data []byte) *Packet {
+func createPacket(version byte, messageType MessageType, data []byte) *Packet {
 	messageID := MessageID{}
 	rand.Read(messageID[:])
 
 	return &Packet{
-		version:     1,
+		version:     int(version),
 		messageType: messageType,
 		messageID:   messageID,
 		Data:        data,
 	}
 }
 
+type messageIDKey struct{}
+
+// WithMessageID returns a context sending requests made with it under messageID
+// instead of a random message ID. The relay remembers the IDs of the messages it
+// stored, so a SendMessage resent after a timeout is not delivered twice.
+func WithMessageID(ctx context.Context, messageID MessageID) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, messageID)
+}
+
+func messageIDFromContext(ctx context.Context) (MessageID, bool) {
+	messageID, ok := ctx.Value(messageIDKey{}).(MessageID)
+	return messageID, ok
+}
+
+// parsePacket parses a frame body as returned by FrameReader.ReadFrame.
 func parsePacket(data []byte) (*Packet, error) {
-	if len(data) < 22 {
-		return &Packet{}, fmt.Errorf("invalid packet length")
+	err := checkMinLength("packet", data, PACKET_HEADER_LENGTH)
+	if err != nil {
+		return &Packet{}, err
+	}
+
+	data, err = DecompressFrame(data)
+	if err != nil {
+		return &Packet{}, err
+	}
+
+	if !isSupportedVersion(data[0]) {
+		return &Packet{}, &UnsupportedVersionError{Version: data[0]}
 	}
 
 	packet := &Packet{
-		version:     int(data[4]),
-		messageType: MessageType(data[5]),
+		version:     int(data[0]),
+		messageType: MessageType(data[1]),
 		messageID:   MessageID{},
-		Data:        data[22:],
+		Data:        data[PACKET_HEADER_LENGTH:],
 	}
 
-	copy(packet.messageID[:], data[6:22])
+	copy(packet.messageID[:], data[2:PACKET_HEADER_LENGTH])
 
 	return packet, nil
 }
@@ -0,0 +1,226 @@
+package tcpclient
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// RATE_LIMIT_ERROR is the reason of the Error packet the server answers with
+	// when the client sends too fast. Requests rejected with it are sent again
+	// after a backoff.
+	RATE_LIMIT_ERROR        = "rate_limited"
+	RATE_LIMIT_BASE_BACKOFF = 500 * time.Millisecond
+	RATE_LIMIT_MAX_BACKOFF  = 30 * time.Second
+)
+
+// Priority orders packets waiting for the rate limiter, lower values go first.
+type Priority int
+
+const (
+	PriorityAuth Priority = iota
+	PriorityInteractive
+	PriorityBackground
+	priorityCount
+)
+
+type priorityKey struct{}
+
+// WithPriority returns a context sending requests made with it at the given
+// priority instead of the default for their message type.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context, messageType MessageType) Priority {
+	priority, ok := ctx.Value(priorityKey{}).(Priority)
+	if ok && priority >= 0 && priority < priorityCount {
+		return priority
+	}
+
+	return messageType.priority()
+}
+
+// priority is the default priority of packets of this type.
+func (t MessageType) priority() Priority {
+	switch t {
+	case Handshake, ReqKey, ReqLogin, ReqSignup, ReqLogout:
+		return PriorityAuth
+	case ReqMessages, UploadPrekeys:
+		return PriorityBackground
+	}
+
+	return PriorityInteractive
+}
+
+// RateLimitConfig controls the token bucket packets are sent through. A zero
+// Rate disables the limit, backing off after rate limit errors still applies.
+type RateLimitConfig struct {
+	Rate  float64 // packets per second
+	Burst int     // packets that may be sent at once after being idle
+}
+
+var DefaultRateLimitConfig = RateLimitConfig{
+	Rate:  20,
+	Burst: 40,
+}
+
+// SetRateLimit changes the rate limit configuration.
+func (s *TCPServer) SetRateLimit(config RateLimitConfig) {
+	s.limiter.setConfig(config)
+}
+
+// schedule blocks until a packet of the given type may be sent. Heartbeat
+// packets are never held back, they measure the connection, not the relay.
+func (s *TCPServer) schedule(ctx context.Context, messageType MessageType) error {
+	if messageType == Ping || messageType == Pong {
+		return nil
+	}
+
+	return s.limiter.wait(ctx, priorityFromContext(ctx, messageType))
+}
+
+func isRateLimited(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr) && serverErr.Reason == RATE_LIMIT_ERROR
+}
+
+// limiter is a token bucket handing out tokens to waiting packets by priority,
+// in order within the same priority.
+type limiter struct {
+	mu          sync.Mutex
+	config      RateLimitConfig
+	tokens      float64
+	updated     time.Time
+	pausedUntil time.Time
+	backoff     *backoff
+	queues      [priorityCount][]*ticket
+	timer       *time.Timer
+}
+
+type ticket struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newLimiter(config RateLimitConfig) *limiter {
+	return &limiter{
+		config:  config,
+		tokens:  float64(max(config.Burst, 1)),
+		updated: time.Now(),
+		backoff: newBackoffWith(RATE_LIMIT_BASE_BACKOFF, RATE_LIMIT_MAX_BACKOFF),
+	}
+}
+
+func (l *limiter) setConfig(config RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.config = config
+	l.tokens = min(l.tokens, float64(max(config.Burst, 1)))
+	l.dispatch()
+}
+
+// wait blocks until a token is handed to the caller or ctx is done.
+func (l *limiter) wait(ctx context.Context, priority Priority) error {
+	t := &ticket{ready: make(chan struct{})}
+
+	l.mu.Lock()
+	l.queues[priority] = append(l.queues[priority], t)
+	l.dispatch()
+	l.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if t.granted {
+			return nil
+		}
+
+		l.queues[priority] = slices.DeleteFunc(l.queues[priority], func(queued *ticket) bool {
+			return queued == t
+		})
+
+		return ctx.Err()
+	}
+}
+
+// rateLimited pauses the limiter after the server rejected a packet, for a
+// growing interval while the rejections continue.
+func (l *limiter) rateLimited() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	interval := l.backoff.next()
+	l.pausedUntil = time.Now().Add(interval)
+
+	return interval
+}
+
+// accepted resets the backoff once the server accepts packets again.
+func (l *limiter) accepted() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.backoff.reset()
+}
+
+// dispatch refills the bucket and hands out tokens, highest priority first. When
+// packets are left waiting it arms a timer to try again. l.mu must be held.
+func (l *limiter) dispatch() {
+	now := time.Now()
+	limited := l.config.Rate > 0
+
+	if limited {
+		burst := float64(max(l.config.Burst, 1))
+		l.tokens = min(burst, l.tokens+now.Sub(l.updated).Seconds()*l.config.Rate)
+	}
+	l.updated = now
+
+	for priority := range l.queues {
+		for len(l.queues[priority]) > 0 {
+			if now.Before(l.pausedUntil) || (limited && l.tokens < 1) {
+				l.retryLater(now)
+				return
+			}
+
+			t := l.queues[priority][0]
+			l.queues[priority] = l.queues[priority][1:]
+
+			t.granted = true
+			close(t.ready)
+
+			if limited {
+				l.tokens--
+			}
+		}
+	}
+}
+
+// retryLater arms the timer for when the next token is available and the
+// limiter is no longer paused. l.mu must be held.
+func (l *limiter) retryLater(now time.Time) {
+	delay := l.pausedUntil.Sub(now)
+
+	if l.config.Rate > 0 && l.tokens < 1 {
+		refill := time.Duration((1 - l.tokens) / l.config.Rate * float64(time.Second))
+		delay = max(delay, refill)
+	}
+
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+
+	l.timer = time.AfterFunc(max(delay, time.Millisecond), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.dispatch()
+	})
+}
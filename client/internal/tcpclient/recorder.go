@@ -0,0 +1,169 @@
+package tcpclient
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction tells whether a recorded packet was sent or received by the client.
+type Direction string
+
+const (
+	Inbound  Direction = "in"
+	Outbound Direction = "out"
+)
+
+// RecordedPacket is one line of a recording.
+type RecordedPacket struct {
+	Time        time.Time   `json:"time"`
+	Direction   Direction   `json:"direction"`
+	Version     int         `json:"version"`
+	MessageType MessageType `json:"type"`
+	MessageID   string      `json:"message_id"` // hex encoded
+	Data        []byte      `json:"data,omitempty"`
+	Redacted    bool        `json:"redacted,omitempty"` // Data was left out
+}
+
+// Recorder writes every packet exchanged with the server as a line of JSON.
+//
+// The auth ID and token prefixed to outgoing packets are never part of the
+// recorded data. Login and signup requests, which carry the encrypted password,
+// and the responses to them, which carry the token, are redacted.
+type Recorder struct {
+	mu           sync.Mutex
+	encoder      *json.Encoder
+	closer       io.Closer
+	authRequests map[MessageID]struct{}
+}
+
+// NewRecorder creates a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		encoder:      json.NewEncoder(w),
+		authRequests: make(map[MessageID]struct{}),
+	}
+}
+
+// CreateRecording creates a Recorder writing to a new file at path, which is
+// only readable by the current user.
+func CreateRecording(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	recorder := NewRecorder(file)
+	recorder.closer = file
+
+	return recorder, nil
+}
+
+// Record adds a packet to the recording.
+func (r *Recorder) Record(direction Direction, packet *Packet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record := RecordedPacket{
+		Time:        time.Now(),
+		Direction:   direction,
+		Version:     packet.version,
+		MessageType: packet.messageType,
+		MessageID:   hex.EncodeToString(packet.messageID[:]),
+		Data:        packet.Data,
+	}
+
+	if r.redact(direction, packet) {
+		record.Data = nil
+		record.Redacted = true
+	}
+
+	return r.encoder.Encode(&record)
+}
+
+// redact reports whether the data of a packet carries credentials.
+func (r *Recorder) redact(direction Direction, packet *Packet) bool {
+	if direction == Outbound {
+		if packet.messageType == ReqLogin || packet.messageType == ReqSignup {
+			r.authRequests[packet.messageID] = struct{}{}
+			return true
+		}
+
+		return false
+	}
+
+	if _, exists := r.authRequests[packet.messageID]; !exists {
+		return false
+	}
+
+	delete(r.authRequests, packet.messageID)
+
+	return true
+}
+
+// Close closes the file of a Recorder created by CreateRecording.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closer == nil {
+		return nil
+	}
+
+	return r.closer.Close()
+}
+
+// ReadRecording reads the packets written by a Recorder.
+func ReadRecording(reader io.Reader) ([]RecordedPacket, error) {
+	var packets []RecordedPacket
+
+	scanner := bufio.NewScanner(reader)
+	// a recorded packet holds up to MAX_FRAME_SIZE bytes of base64 data
+	scanner.Buffer(nil, 2*MAX_FRAME_SIZE)
+
+	for line := 1; scanner.Scan(); line++ {
+		packet := RecordedPacket{}
+		err := json.Unmarshal(scanner.Bytes(), &packet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recording at line %d: %w", line, err)
+		}
+
+		packets = append(packets, packet)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	return packets, nil
+}
+
+// SetRecorder starts recording the packets sent and received on the connection,
+// nil stops recording.
+func (s *TCPServer) SetRecorder(recorder *Recorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorder = recorder
+}
+
+func (s *TCPServer) record(direction Direction, packet *Packet) {
+	s.mu.Lock()
+	recorder := s.recorder
+	s.mu.Unlock()
+
+	if recorder == nil {
+		return
+	}
+
+	err := recorder.Record(direction, packet)
+	if err != nil {
+		log.Printf("Failed to record packet: %v", err)
+	}
+}
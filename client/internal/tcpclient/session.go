@@ -0,0 +1,79 @@
+package tcpclient
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// AUTH_REJECTED_ERROR is the reason of the Error packet the server answers with
+// when the auth token of a packet is no longer valid, e.g. because the user
+// logged in somewhere else.
+const AUTH_REJECTED_ERROR = "invalid_packet_auth_verify"
+
+// ErrSessionExpired is returned when the server rejected the auth token and the
+// session could not be re-established.
+var ErrSessionExpired = errors.New("session expired")
+
+// ReauthHandler is called when the server rejects the auth token, it is used to
+// log in again and set a new token.
+type ReauthHandler func() error
+
+// SetReauthHandler sets the function called when the server rejects the auth
+// token. Requests rejected that way are sent again once it succeeds.
+func (s *TCPServer) SetReauthHandler(handler ReauthHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reauthHandler = handler
+}
+
+// ClearAuth forgets the auth ID and token, the session is no longer
+// authenticated.
+func (s *TCPServer) ClearAuth() {
+	s.mu.Lock()
+	s.authID = AuthID{}
+	s.mu.Unlock()
+
+	s.SetAuthToken(AuthToken{})
+}
+
+func (s *TCPServer) currentAuthToken() AuthToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authToken
+}
+
+func isAuthRejected(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr) && serverErr.Reason == AUTH_REJECTED_ERROR
+}
+
+// reauthenticate runs the reauth handler after the server rejected token.
+// Concurrent callers share a single re-authentication: once the token has been
+// replaced the handler is not run again.
+func (s *TCPServer) reauthenticate(rejected AuthToken) error {
+	s.reauthMu.Lock()
+	defer s.reauthMu.Unlock()
+
+	s.mu.Lock()
+	current := s.authToken
+	handler := s.reauthHandler
+	s.mu.Unlock()
+
+	if current != rejected && current != (AuthToken{}) {
+		return nil
+	}
+
+	if handler == nil {
+		return ErrSessionExpired
+	}
+
+	log.Printf("Auth token rejected by the server, logging in again")
+
+	err := handler()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSessionExpired, err)
+	}
+
+	return nil
+}
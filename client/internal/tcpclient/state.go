@@ -0,0 +1,93 @@
+package tcpclient
+
+import "sync"
+
+type ConnectionState int
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+	Authenticated
+	Degraded // heartbeats are being missed
+)
+
+const STATE_SUBSCRIBER_BUFFER = 8
+
+func (c ConnectionState) String() string {
+	switch c {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Authenticated:
+		return "authenticated"
+	case Degraded:
+		return "degraded"
+	}
+
+	return "unknown"
+}
+
+// stateBroadcaster keeps the current connection state and sends every change to
+// its subscribers.
+type stateBroadcaster struct {
+	mu          sync.Mutex
+	state       ConnectionState
+	subscribers map[chan ConnectionState]struct{}
+}
+
+func newStateBroadcaster() *stateBroadcaster {
+	return &stateBroadcaster{
+		state:       Disconnected,
+		subscribers: make(map[chan ConnectionState]struct{}),
+	}
+}
+
+func (b *stateBroadcaster) get() ConnectionState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *stateBroadcaster) set(state ConnectionState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == state {
+		return
+	}
+	b.state = state
+
+	for subscriber := range b.subscribers {
+		// slow subscribers miss intermediate states rather than blocking the connection
+		select {
+		case subscriber <- state:
+		default:
+		}
+	}
+}
+
+func (b *stateBroadcaster) subscribe() (<-chan ConnectionState, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscriber := make(chan ConnectionState, STATE_SUBSCRIBER_BUFFER)
+	subscriber <- b.state
+	b.subscribers[subscriber] = struct{}{}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		})
+	}
+
+	return subscriber, unsubscribe
+}
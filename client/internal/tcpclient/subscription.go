@@ -0,0 +1,215 @@
+package tcpclient
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// HANDLER_QUEUE_SIZE is the number of packets buffered per subscription.
+const HANDLER_QUEUE_SIZE = 64
+
+// HANDLER_DELIVER_TIMEOUT is how long the listener waits for a full queue to
+// make room, the packet is dropped after it and the subscription resyncs.
+const HANDLER_DELIVER_TIMEOUT = time.Second
+
+type MessageHandler func(*Packet)
+
+// Subscription is a registered MessageHandler. Every subscription runs its
+// handler on its own worker, so a slow handler stalls the listener for at most
+// HANDLER_DELIVER_TIMEOUT once its queue is full.
+type Subscription struct {
+	server      *TCPServer
+	messageType MessageType
+	catchAll    bool
+	handler     MessageHandler
+	queue       chan *Packet
+	resync      chan struct{}
+	done        chan struct{}
+	once        sync.Once
+
+	mu            sync.Mutex
+	resyncHandler func()
+}
+
+// RegisterHandler subscribes a handler to pushed packets of the given type.
+// Several handlers can be registered for the same type, each receives every
+// packet.
+func (s *TCPServer) RegisterHandler(messageType MessageType, handler MessageHandler) *Subscription {
+	return s.RegisterHandlerContext(context.Background(), messageType, handler)
+}
+
+// RegisterHandlerContext registers a handler like RegisterHandler, the handler
+// is unsubscribed once ctx is done.
+func (s *TCPServer) RegisterHandlerContext(ctx context.Context, messageType MessageType, handler MessageHandler) *Subscription {
+	sub := s.newSubscription(handler)
+	sub.messageType = messageType
+
+	s.mu.Lock()
+	if s.messageHandlers[messageType] == nil {
+		s.messageHandlers[messageType] = make(map[*Subscription]struct{})
+	}
+	s.messageHandlers[messageType][sub] = struct{}{}
+	s.mu.Unlock()
+
+	sub.unsubscribeOnDone(ctx)
+
+	return sub
+}
+
+// RegisterFallbackHandler subscribes a handler to pushed packets no other
+// handler is registered for, and to every Error packet that is not the response
+// to a request.
+func (s *TCPServer) RegisterFallbackHandler(handler MessageHandler) *Subscription {
+	sub := s.newSubscription(handler)
+	sub.catchAll = true
+
+	s.mu.Lock()
+	s.fallbackHandlers[sub] = struct{}{}
+	s.mu.Unlock()
+
+	return sub
+}
+
+func (s *TCPServer) newSubscription(handler MessageHandler) *Subscription {
+	sub := &Subscription{
+		server:  s,
+		handler: handler,
+		queue:   make(chan *Packet, HANDLER_QUEUE_SIZE),
+		resync:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	go sub.run()
+
+	return sub
+}
+
+// subscribers returns the subscriptions a pushed packet is delivered to.
+func (s *TCPServer) subscribers(packet *Packet) []*Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := make([]*Subscription, 0, len(s.messageHandlers[packet.messageType]))
+	for sub := range s.messageHandlers[packet.messageType] {
+		subs = append(subs, sub)
+	}
+
+	if len(subs) == 0 || packet.messageType == Error {
+		for sub := range s.fallbackHandlers {
+			subs = append(subs, sub)
+		}
+	}
+
+	return subs
+}
+
+// unsubscribeAll stops the workers of every subscription.
+func (s *TCPServer) unsubscribeAll() {
+	s.mu.Lock()
+	subs := []*Subscription{}
+	for _, handlers := range s.messageHandlers {
+		for sub := range handlers {
+			subs = append(subs, sub)
+		}
+	}
+	for sub := range s.fallbackHandlers {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// Unsubscribe removes the handler, packets still queued for it are discarded.
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		s := sub.server
+
+		s.mu.Lock()
+		if sub.catchAll {
+			delete(s.fallbackHandlers, sub)
+		} else {
+			delete(s.messageHandlers[sub.messageType], sub)
+			if len(s.messageHandlers[sub.messageType]) == 0 {
+				delete(s.messageHandlers, sub.messageType)
+			}
+		}
+		s.mu.Unlock()
+
+		close(sub.done)
+	})
+}
+
+func (sub *Subscription) unsubscribeOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Unsubscribe()
+		case <-sub.done:
+		}
+	}()
+}
+
+// SetResyncHandler sets the function called on the worker after packets were
+// dropped for this subscription, it should fetch what the handler missed, for
+// messages with ReqMessages.
+func (sub *Subscription) SetResyncHandler(handler func()) {
+	sub.mu.Lock()
+	sub.resyncHandler = handler
+	sub.mu.Unlock()
+}
+
+func (sub *Subscription) deliver(packet *Packet) {
+	select {
+	case sub.queue <- packet:
+		return
+	default:
+	}
+
+	// a slow handler holds up the listener for a while rather than losing
+	// packets on a burst
+	timer := time.NewTimer(HANDLER_DELIVER_TIMEOUT)
+	defer timer.Stop()
+
+	select {
+	case sub.queue <- packet:
+	case <-sub.done:
+	case <-timer.C:
+		log.Printf("Handler queue full, dropping packet of type %d", packet.messageType)
+
+		select {
+		case sub.resync <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sub *Subscription) run() {
+	for {
+		select {
+		case <-sub.done:
+			return
+		case packet := <-sub.queue:
+			sub.handler(packet)
+		case <-sub.resync:
+			sub.mu.Lock()
+			resync := sub.resyncHandler
+			sub.mu.Unlock()
+
+			if resync == nil {
+				log.Printf("Packets of type %d dropped without a resync handler", sub.messageType)
+				continue
+			}
+
+			resync()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package tcpclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscriptionOverflow(t *testing.T) {
+	s := NewTCPServer("127.0.0.1", 0)
+
+	// the handler handles a packet for every token
+	tokens := make(chan struct{}, 2*HANDLER_QUEUE_SIZE)
+	handled := make(chan struct{}, HANDLER_QUEUE_SIZE+2)
+	sub := s.RegisterHandler(RecvMessage, func(packet *Packet) {
+		<-tokens
+		handled <- struct{}{}
+	})
+	defer sub.Unsubscribe()
+
+	resynced := make(chan struct{}, 1)
+	sub.SetResyncHandler(func() { resynced <- struct{}{} })
+
+	// one packet held by the handler, a full queue and one packet too many
+	packet := &Packet{messageType: RecvMessage}
+	for range HANDLER_QUEUE_SIZE + 2 {
+		s.dispatch(packet)
+	}
+
+	for range HANDLER_QUEUE_SIZE + 1 {
+		tokens <- struct{}{}
+	}
+
+	for range HANDLER_QUEUE_SIZE + 1 {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("queued packet not handled")
+		}
+	}
+
+	select {
+	case <-resynced:
+	case <-time.After(time.Second):
+		t.Fatal("dropped packet without a resync")
+	}
+
+	// a handler that catches up in time loses nothing
+	go func() {
+		time.Sleep(HANDLER_DELIVER_TIMEOUT / 2)
+		for range HANDLER_QUEUE_SIZE + 2 {
+			tokens <- struct{}{}
+		}
+	}()
+
+	for range HANDLER_QUEUE_SIZE + 2 {
+		s.dispatch(packet)
+	}
+
+	for range HANDLER_QUEUE_SIZE + 2 {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("packet dropped although the handler caught up")
+		}
+	}
+
+	select {
+	case <-resynced:
+		t.Fatal("resync although nothing was dropped")
+	default:
+	}
+}
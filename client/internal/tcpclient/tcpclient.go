@@ -1,6 +1,8 @@
 package tcpclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -9,78 +11,218 @@ import (
 	"time"
 )
 
-const MAX_RETRIES = 10
+const (
+	MAX_RETRIES = 10
+
+	// DEFAULT_REQUEST_TIMEOUT applies to requests whose context has no deadline.
+	DEFAULT_REQUEST_TIMEOUT = 5 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned when a request is made while there is no connection.
+	ErrNotConnected = errors.New("not connected to server")
+	// ErrConnectionLost is returned to requests that were in flight when the connection dropped.
+	ErrConnectionLost = errors.New("connection to server lost")
+)
+
+// isPermanent reports whether a dial error will not go away by retrying.
+func isPermanent(err error) bool {
+	var pinErr *PinMismatchError
+	var versionErr *NoCommonVersionError
+	var proxyAuthErr *ProxyAuthError
+	return errors.As(err, &pinErr) || errors.As(err, &versionErr) || errors.As(err, &proxyAuthErr)
+}
+
+// ServerError is returned when the server answers a request with an Error packet.
+type ServerError struct {
+	Reason string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error: %s", e.Reason)
+}
+
+// IsRetryable reports whether a request failed because of the connection and
+// can be sent again once the server is reconnected.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrNotConnected) || errors.Is(err, ErrConnectionLost)
+}
 
 type TCPServer struct {
-	address          string
-	port             int
-	conn             net.Conn
-	authID           AuthID
-	authToken        AuthToken
-	mu               sync.Mutex
-	pendingResponses map[string]chan *Packet
-	messageHandlers  map[MessageType]MessageHandler
-	stopListener     chan struct{}
+	transport           Transport
+	conn                net.Conn
+	reader              *FrameReader
+	connDone            chan struct{}
+	state               *stateBroadcaster
+	heartbeatConfig     HeartbeatConfig
+	rtt                 time.Duration
+	authID              AuthID
+	authToken           AuthToken
+	mu                  sync.Mutex
+	pendingResponses    map[string]*pendingResponse
+	chunks              *ChunkAssembler
+	writeMu             sync.Mutex
+	messageHandlers     map[MessageType]map[*Subscription]struct{}
+	fallbackHandlers    map[*Subscription]struct{}
+	reconnectHandler    ReconnectHandler
+	reauthHandler       ReauthHandler
+	reauthMu            sync.Mutex
+	requestInterceptors []RequestInterceptor
+	packetInterceptors  []PacketInterceptor
+	noise               *NoiseConfig
+	features            Features
+	capabilities        Capabilities
+	recorder            *Recorder
+	limiter             *limiter
+	stopListener        chan struct{}
+	closeOnce           sync.Once
 }
 
-type MessageHandler func(*Packet)
+// ReconnectHandler is called after the connection has been re-established, it
+// is used to re-authenticate the session.
+type ReconnectHandler func() error
+
+type pendingResponse struct {
+	response chan *Packet
+	progress ProgressFunc // reports incoming chunked responses
+}
 
-// NewTCPServer creates a new TCPServer instance.
+// NewTCPServer creates a new TCPServer instance connecting over plain TCP.
 func NewTCPServer(address string, port int) *TCPServer {
+	return NewTCPServerWithTransport(&TCPTransport{
+		Address: net.JoinHostPort(address, strconv.Itoa(port)),
+	})
+}
+
+// NewTCPServerWithTransport creates a new TCPServer instance connecting over the
+// given transport.
+func NewTCPServerWithTransport(transport Transport) *TCPServer {
 	server := &TCPServer{
-		address:          address,
-		port:             port,
+		transport:        transport,
 		conn:             nil,
-		pendingResponses: make(map[string]chan *Packet),
-		messageHandlers:  make(map[MessageType]MessageHandler),
+		pendingResponses: make(map[string]*pendingResponse),
+		chunks:           NewChunkAssembler(),
+		features:         DEFAULT_FEATURES,
+		messageHandlers:  make(map[MessageType]map[*Subscription]struct{}),
+		fallbackHandlers: make(map[*Subscription]struct{}),
+		capabilities:     legacyCapabilities,
+		state:            newStateBroadcaster(),
+		heartbeatConfig:  DefaultHeartbeatConfig,
+		limiter:          newLimiter(DefaultRateLimitConfig),
 		stopListener:     make(chan struct{}),
 	}
 
 	return server
 }
 
+// Connect dials the server, retrying with backoff, and starts the listener. When
+// the connection drops later on it is re-established in the background.
 func (s *TCPServer) Connect() error {
-	var conn net.Conn
 	var err error
 
-	retryInterval := 1 * time.Second
+	s.state.set(Connecting)
+
+	backoff := newBackoff()
 
 	for range MAX_RETRIES {
-		conn, err = net.Dial("tcp", s.address+":"+strconv.Itoa(s.port))
-		if err == nil {
+		err = s.dial()
+		if err == nil || isPermanent(err) {
 			break
 		}
 
+		retryInterval := backoff.next()
+
 		log.Printf("Failed to connect to server: %v. Retrying in %s...", err, retryInterval)
 		time.Sleep(retryInterval)
-		retryInterval *= 2
 	}
 
 	if err != nil {
-		log.Fatalf("Failed to connect to server after %d attempts: %v", MAX_RETRIES, err)
+		s.state.set(Disconnected)
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+
+	s.serve()
+
+	return nil
+}
+
+func (s *TCPServer) dial() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+
+	conn, err := s.transport.Dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	reader := NewFrameReader(conn, RECV_LENGTH_NR_BYTES)
+
+	conn.SetDeadline(time.Now().Add(DIAL_TIMEOUT))
+	remote, err := s.readHandshake(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.mu.Lock()
+	noise := s.noise
+	s.mu.Unlock()
+
+	// the relay sends nothing after its handshake until the client starts the
+	// noise handshake, so the frame reader has nothing buffered at this point
+	if noise != nil {
+		noiseConn, err := NoiseClient(conn, noise)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("noise handshake failed: %w", err)
+		}
+
+		conn = noiseConn
+		reader = NewFrameReader(conn, RECV_LENGTH_NR_BYTES)
 	}
 
-	// receive handshake
-	buffer := make([]byte, MAX_MESSAGE_SIZE)
-	_, err = conn.Read(buffer)
+	// the answer goes through the noise channel, if there is one
+	capabilities, err := s.answerHandshake(conn, remote)
 	if err != nil {
-		log.Fatalf("Failed to read handshake: %v", err)
+		conn.Close()
+		return fmt.Errorf("handshake failed: %w", err)
 	}
+	conn.SetDeadline(time.Time{})
 
+	s.mu.Lock()
 	s.conn = conn
-	go s.startListener()
+	s.reader = reader
+	s.capabilities = capabilities
+	s.connDone = make(chan struct{})
+	s.mu.Unlock()
+
+	s.state.set(Connected)
 
 	return nil
 }
 
+// serve starts the listener and the heartbeat for the current connection.
+func (s *TCPServer) serve() {
+	s.mu.Lock()
+	conn := s.conn
+	connDone := s.connDone
+	s.mu.Unlock()
+
+	go s.startListener()
+	go s.heartbeat(conn, connDone)
+}
+
 func (s *TCPServer) startListener() {
+	s.mu.Lock()
+	reader := s.reader
+	s.mu.Unlock()
+
 	for {
 		select {
 		case <-s.stopListener:
 			return
 		default:
-			buffer := make([]byte, MAX_MESSAGE_SIZE)
-			n, err := s.conn.Read(buffer)
+			frame, err := reader.ReadFrame()
 
 			if err != nil {
 				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
@@ -88,122 +230,419 @@ func (s *TCPServer) startListener() {
 					continue
 				}
 
+				var sizeErr *FrameSizeError
+				if errors.As(err, &sizeErr) {
+					log.Printf("Dropping frame: %v", err)
+					continue
+				}
+
+				if s.isClosed() {
+					return
+				}
+
 				log.Printf("Error reading from server: %v", err)
-				continue
+
+				s.disconnect()
+				go s.reconnect()
+				return
 			}
 
-			packet, err := parsePacket(buffer[:n])
+			packet, err := parsePacket(frame)
 			if err != nil {
 				log.Printf("Error parsing packet: %v", err)
 				continue
 			}
 
-			s.mu.Lock()
-			if respChan, exists := s.pendingResponses[packet.messageIDStr()]; exists {
-				respChan <- packet
-				delete(s.pendingResponses, packet.messageIDStr())
+			s.record(Inbound, packet)
 
-				s.mu.Unlock()
-				continue
+			if packet.messageType == Chunk {
+				packet = s.receiveChunk(packet)
+				if packet == nil {
+					continue
+				}
 			}
 
-			if handler, exists := s.messageHandlers[packet.messageType]; exists {
-				s.mu.Unlock()
-				handler(packet)
-				continue
-			}
-			s.mu.Unlock()
+			s.interceptIncoming(packet, s.dispatch)
+		}
+	}
+}
 
-			if packet.messageType == Error {
-				log.Printf("Server error: %s", string(packet.Data))
-			}
+// dispatch hands an incoming packet to the request waiting for it, or else to
+// the subscribed handlers.
+func (s *TCPServer) dispatch(packet *Packet) {
+	s.mu.Lock()
+	if pending, exists := s.pendingResponses[packet.messageIDStr()]; exists {
+		pending.response <- packet
+		delete(s.pendingResponses, packet.messageIDStr())
 
-			log.Printf("No handler for message type %d", packet.messageType)
-		}
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Unlock()
+
+	subs := s.subscribers(packet)
+	for _, sub := range subs {
+		sub.deliver(packet)
 	}
+
+	if len(subs) > 0 {
+		return
+	}
+
+	if packet.messageType == Error {
+		log.Printf("Server error: %s", string(packet.Data))
+	}
+
+	log.Printf("No handler for message type %d", packet.messageType)
 }
 
-func (s *TCPServer) RegisterHandler(messageType MessageType, handler MessageHandler) {
+// disconnect closes the current connection and fails all pending requests with
+// ErrConnectionLost.
+func (s *TCPServer) disconnect() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.messageHandlers[messageType] = handler
+
+	if s.conn != nil {
+		s.conn.Close()
+		close(s.connDone)
+		s.conn = nil
+		s.reader = nil
+	}
+
+	for id, pending := range s.pendingResponses {
+		close(pending.response)
+		delete(s.pendingResponses, id)
+	}
+
+	s.state.set(Disconnected)
 }
 
-func (s *TCPServer) SendReceive(messageType MessageType, data []byte) (*Packet, error) {
-	packet := createPacket(messageType, data)
+// reconnect re-dials the server until it succeeds or the server is closed, and
+// then calls the reconnect handler.
+func (s *TCPServer) reconnect() {
+	backoff := newBackoff()
+
+	for {
+		s.state.set(Connecting)
+
+		retryInterval := backoff.next()
+
+		log.Printf("Connection lost. Reconnecting in %s...", retryInterval)
+
+		select {
+		case <-s.stopListener:
+			s.state.set(Disconnected)
+			return
+		case <-time.After(retryInterval):
+		}
+
+		err := s.dial()
+		if isPermanent(err) {
+			log.Printf("Giving up reconnecting to server: %v", err)
+			s.state.set(Disconnected)
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to reconnect to server: %v", err)
+			continue
+		}
+
+		break
+	}
+
+	log.Printf("Reconnected to server")
+
+	s.serve()
 
-	responseChan := make(chan *Packet)
 	s.mu.Lock()
-	s.pendingResponses[packet.messageIDStr()] = responseChan
+	handler := s.reconnectHandler
 	s.mu.Unlock()
 
+	if handler != nil {
+		err := handler()
+		if err != nil {
+			log.Printf("Failed to restore session after reconnect: %v", err)
+		}
+	}
+}
+
+// SetNoise enables the Noise encrypted channel for the next connections,
+// passing nil disables it.
+func (s *TCPServer) SetNoise(config *NoiseConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noise = config
+}
+
+// SetReconnectHandler sets the function called after every reconnect.
+func (s *TCPServer) SetReconnectHandler(handler ReconnectHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconnectHandler = handler
+}
+
+func (s *TCPServer) SendReceive(messageType MessageType, data []byte) (*Packet, error) {
+	return s.SendReceiveContext(context.Background(), messageType, data)
+}
+
+// SendReceiveContext sends a request and waits for its response until ctx is
+// done. Without a deadline on ctx, DEFAULT_REQUEST_TIMEOUT is used.
+// Requests larger than MAX_MESSAGE_SIZE are sent as chunks if the server
+// supports it, progress is reported to the ProgressFunc set with WithProgress.
+func (s *TCPServer) SendReceiveContext(ctx context.Context, messageType MessageType, data []byte) (*Packet, error) {
+	capabilities := s.Capabilities()
+
+	packet := createPacket(capabilities.Version, messageType, data)
+	if messageID, ok := messageIDFromContext(ctx); ok {
+		packet.messageID = messageID
+	}
+
+	response, err := s.intercept(ctx, packet, func(ctx context.Context, packet *Packet) (*Packet, error) {
+		if len(packet.Data) > MAX_MESSAGE_SIZE && capabilities.Has(FeatureChunking) {
+			return s.sendChunked(ctx, packet)
+		}
+
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, DEFAULT_REQUEST_TIMEOUT)
+			defer cancel()
+		}
+
+		return s.sendReceivePacket(ctx, packet)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// an interceptor may have answered the request itself
+	if response == nil {
+		return nil, fmt.Errorf("no response to request")
+	}
+
+	if response.messageType == Error {
+		return nil, &ServerError{Reason: string(response.Data)}
+	}
+
+	return response, nil
+}
+
+// sendReceivePacket sends a request once the rate limiter lets it through. When
+// the server rejects it as rate limited the request is sent again after a
+// backoff, until ctx is done. When the server rejects the auth token the
+// session is re-authenticated and the request sent again once.
+func (s *TCPServer) sendReceivePacket(ctx context.Context, packet *Packet) (*Packet, error) {
+	reauthenticated := false
+
+	for {
+		err := s.schedule(ctx, packet.messageType)
+		if err != nil {
+			return nil, err
+		}
+
+		token := s.currentAuthToken()
+
+		response, err := s.exchange(ctx, packet)
+
+		if isRateLimited(err) {
+			interval := s.limiter.rateLimited()
+			log.Printf("Rate limited by the server, backing off for %s", interval)
+			continue
+		}
+
+		if isAuthRejected(err) && packet.messageType.requiresAuth() && !reauthenticated {
+			reauthenticated = true
+
+			err = s.reauthenticate(token)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if err == nil {
+			s.limiter.accepted()
+		}
+
+		return response, err
+	}
+}
+
+// exchange sends a request and waits for its response.
+func (s *TCPServer) exchange(ctx context.Context, packet *Packet) (*Packet, error) {
 	payload, err := packet.payload(s)
 	if err != nil {
 		return nil, err
 	}
 
+	responseChan := make(chan *Packet, 1)
 	s.mu.Lock()
-	_, err = s.conn.Write(payload)
+	s.pendingResponses[packet.messageIDStr()] = &pendingResponse{
+		response: responseChan,
+		progress: progressFromContext(ctx),
+	}
 	s.mu.Unlock()
 
+	s.record(Outbound, packet)
+
+	err = s.write(ctx, payload)
 	if err != nil {
-		s.mu.Lock()
-		delete(s.pendingResponses, packet.messageIDStr())
-		s.mu.Unlock()
+		s.removePending(packet.messageIDStr())
 
 		return nil, err
 	}
 
 	select {
-	case response := <-responseChan:
+	case response, ok := <-responseChan:
+		if !ok {
+			return nil, ErrConnectionLost
+		}
+
 		if response.messageType == Error {
-			return nil, fmt.Errorf("server error: %s", string(response.Data))
+			return nil, &ServerError{Reason: string(response.Data)}
 		}
 		return response, nil
 
-	case <-time.After(5 * time.Second):
-		s.mu.Lock()
-		delete(s.pendingResponses, packet.messageIDStr())
-		s.mu.Unlock()
+	case <-ctx.Done():
+		s.removePending(packet.messageIDStr())
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timeout waiting for response: %w", ctx.Err())
+		}
 
-		return nil, fmt.Errorf("timeout waiting for response")
+		return nil, ctx.Err()
 	}
 }
 
+func (s *TCPServer) removePending(messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pendingResponses, messageID)
+}
+
 func (s *TCPServer) Send(messageType MessageType, data []byte) error {
-	packet := createPacket(messageType, data)
+	return s.SendContext(context.Background(), messageType, data)
+}
 
-	payload, err := packet.payload(s)
+// SendContext sends a packet without waiting for a response.
+func (s *TCPServer) SendContext(ctx context.Context, messageType MessageType, data []byte) error {
+	packet := createPacket(s.Capabilities().Version, messageType, data)
+
+	_, err := s.intercept(ctx, packet, func(ctx context.Context, packet *Packet) (*Packet, error) {
+		err := s.schedule(ctx, packet.messageType)
+		if err != nil {
+			return nil, err
+		}
+
+		payload, err := packet.payload(s)
+		if err != nil {
+			return nil, err
+		}
+
+		s.record(Outbound, packet)
+
+		return nil, s.write(ctx, payload)
+	})
+
+	return err
+}
+
+func (s *TCPServer) write(ctx context.Context, payload []byte) error {
+	err := ctx.Err()
 	if err != nil {
 		return err
 	}
 
 	s.mu.Lock()
-	_, err = s.conn.Write(payload)
+	conn := s.conn
 	s.mu.Unlock()
 
-	return err
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	// writes are serialized on their own lock, so a large write does not hold up
+	// the listener
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	n, err := conn.Write(payload)
+	if err != nil {
+		// after a partial frame the server cannot find the start of the next
+		// one, so the connection is closed, which makes the listener reconnect
+		if n > 0 {
+			log.Printf("Dropping connection after a partial write: %v", err)
+			conn.Close()
+		}
+
+		return fmt.Errorf("%w: %v", ErrConnectionLost, err)
+	}
+
+	return nil
 }
 
 func (s *TCPServer) SetAuthToken(token AuthToken) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	s.authToken = token
+	s.mu.Unlock()
+
+	state := s.state.get()
+	if state == Connected || state == Authenticated {
+		s.state.set(s.liveState())
+	}
 }
 
-func (s *TCPServer) SetAuthID(authID AuthID) {
+// liveState is the state of a healthy connection, depending on whether the
+// session is authenticated.
+func (s *TCPServer) liveState() ConnectionState {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.authID = authID
+
+	if s.authToken == (AuthToken{}) {
+		return Connected
+	}
+
+	return Authenticated
 }
 
-func (s *TCPServer) Close() {
-	s.stopListener <- struct{}{}
+// State returns the current connection state.
+func (s *TCPServer) State() ConnectionState {
+	return s.state.get()
+}
 
+// SubscribeState returns a channel receiving the current connection state and
+// every change after it, and a function to unsubscribe.
+func (s *TCPServer) SubscribeState() (<-chan ConnectionState, func()) {
+	return s.state.subscribe()
+}
+
+func (s *TCPServer) SetAuthID(authID AuthID) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.conn != nil {
-		s.conn.Close()
-		s.conn = nil
+	s.authID = authID
+}
+
+func (s *TCPServer) isClosed() bool {
+	select {
+	case <-s.stopListener:
+		return true
+	default:
+		return false
 	}
 }
+
+func (s *TCPServer) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stopListener)
+	})
+
+	s.disconnect()
+	s.unsubscribeAll()
+}
@@ -0,0 +1,131 @@
+package tcpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// PinStore persists the pinned public key of a server between sessions.
+type PinStore interface {
+	// GetPin returns the pin stored under name, or nil if there is none.
+	GetPin(name string) ([]byte, error)
+	SetPin(name string, pin []byte) error
+}
+
+// PinMismatchError is returned when a server presents a different public key
+// than the one pinned on first connect.
+type PinMismatchError struct {
+	Name     string
+	Expected []byte
+	Received []byte
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("server key for %s changed: pinned %x, received %x", e.Name, e.Expected, e.Received)
+}
+
+// TLSTransport connects to the relay over TLS. When a PinStore is set the SPKI
+// hash of the server certificate is pinned on first connect and every later
+// connection must present the same key.
+type TLSTransport struct {
+	Address    string // host:port
+	ServerName string // defaults to the host of Address
+	// RootCAs is the CA bundle used to verify the server, nil uses the system pool.
+	RootCAs  *x509.CertPool
+	PinStore PinStore
+	Proxy    *Proxy // optional
+}
+
+// LoadCABundle reads a PEM encoded CA bundle for TLSTransport.RootCAs.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// SPKIHash returns the pin of a certificate, the SHA-256 hash of its subject
+// public key info.
+func SPKIHash(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+func (t *TLSTransport) Dial(ctx context.Context) (net.Conn, error) {
+	serverName := t.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(t.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		serverName = host
+	}
+
+	conn, err := dialTCP(ctx, t.Proxy, t.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    t.RootCAs,
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return t.verifyPin(state)
+		},
+	})
+
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func (t *TLSTransport) setProxy(proxy *Proxy) {
+	t.Proxy = proxy
+}
+
+func (t *TLSTransport) verifyPin(state tls.ConnectionState) error {
+	if t.PinStore == nil {
+		return nil
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("server did not present a certificate")
+	}
+
+	name := "tls:" + t.Address
+	pin := SPKIHash(state.PeerCertificates[0])
+
+	pinned, err := t.PinStore.GetPin(name)
+	if err != nil {
+		return err
+	}
+
+	if pinned == nil {
+		return t.PinStore.SetPin(name, pin)
+	}
+
+	if !bytes.Equal(pinned, pin) {
+		return &PinMismatchError{Name: name, Expected: pinned, Received: pin}
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package tcpclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memoryPinStore struct {
+	mu   sync.Mutex
+	pins map[string][]byte
+}
+
+func (s *memoryPinStore) GetPin(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pins[name], nil
+}
+
+func (s *memoryPinStore) SetPin(name string, pin []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pins[name] = pin
+	return nil
+}
+
+// newSelfSignedCert creates a certificate for 127.0.0.1 signed by its own key.
+func newSelfSignedCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relay"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTLSPinning(t *testing.T) {
+	first, firstCert := newSelfSignedCert(t)
+	second, secondCert := newSelfSignedCert(t)
+
+	// the listener presents the certificate in current, both are trusted so
+	// only the pin tells them apart
+	var current atomic.Pointer[tls.Certificate]
+	current.Store(&first)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(firstCert)
+	roots.AddCert(secondCert)
+
+	pins := &memoryPinStore{pins: map[string][]byte{}}
+	transport := &TLSTransport{
+		Address:  listener.Addr().String(),
+		RootCAs:  roots,
+		PinStore: pins,
+	}
+
+	dial := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, err := transport.Dial(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	steps := []struct {
+		name     string
+		cert     *tls.Certificate
+		mismatch bool
+	}{
+		{"first connect pins the key", &first, false},
+		{"same key is accepted", &first, false},
+		{"changed key is rejected", &second, true},
+	}
+
+	for _, step := range steps {
+		current.Store(step.cert)
+
+		err := dial()
+
+		var mismatch *PinMismatchError
+		if step.mismatch != errors.As(err, &mismatch) {
+			t.Fatalf("%s: got %v", step.name, err)
+		}
+		if !step.mismatch && err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+
+	pin, _ := pins.GetPin("tls:" + transport.Address)
+	if string(pin) != string(SPKIHash(firstCert)) {
+		t.Fatalf("pinned %x, want %x", pin, SPKIHash(firstCert))
+	}
+}
+
+func TestTLSUntrustedCertificate(t *testing.T) {
+	cert, _ := newSelfSignedCert(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	pins := &memoryPinStore{pins: map[string][]byte{}}
+	transport := &TLSTransport{
+		Address:  listener.Addr().String(),
+		RootCAs:  x509.NewCertPool(),
+		PinStore: pins,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = transport.Dial(ctx)
+	if err == nil {
+		t.Fatal("connected to a server signed by an unknown CA")
+	}
+	if len(pins.pins) != 0 {
+		t.Fatal("pinned the key of an untrusted server")
+	}
+}
@@ -0,0 +1,58 @@
+package tcpclient
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const DIAL_TIMEOUT = 10 * time.Second
+
+// Transport opens the byte stream packets are exchanged over. The framing, auth
+// and handler logic of TCPServer is the same for every transport.
+type Transport interface {
+	Dial(ctx context.Context) (net.Conn, error)
+}
+
+// TCPTransport connects to the relay over plain TCP.
+type TCPTransport struct {
+	Address string // host:port
+	Proxy   *Proxy // optional
+}
+
+func (t *TCPTransport) Dial(ctx context.Context) (net.Conn, error) {
+	return dialTCP(ctx, t.Proxy, t.Address)
+}
+
+func (t *TCPTransport) setProxy(proxy *Proxy) {
+	t.Proxy = proxy
+}
+
+// UnixTransport connects to a relay listening on a Unix domain socket.
+type UnixTransport struct {
+	Path string
+}
+
+func (t *UnixTransport) Dial(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "unix", t.Path)
+}
+
+// PipeTransport connects to an in-memory server without opening a socket. Every
+// dial creates a new net.Pipe and hands the server end to Serve.
+type PipeTransport struct {
+	Serve func(conn net.Conn)
+}
+
+func (t *PipeTransport) Dial(ctx context.Context) (net.Conn, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, serverConn := net.Pipe()
+
+	go t.Serve(serverConn)
+
+	return clientConn, nil
+}
@@ -0,0 +1,353 @@
+package tcpclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBSOCKET_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocketTransport tunnels the packet stream through binary WebSocket
+// messages, so the relay can be reached through HTTP reverse proxies. Both
+// ws:// and wss:// URLs are supported.
+type WebSocketTransport struct {
+	URL    string
+	Header http.Header
+	// TLSConfig is used for wss:// URLs, nil uses the system defaults.
+	TLSConfig *tls.Config
+	Proxy     *Proxy // optional
+}
+
+func (t *WebSocketTransport) Dial(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	conn, err := dialTCP(ctx, t.Proxy, host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		config := &tls.Config{}
+		if t.TLSConfig != nil {
+			config = t.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+
+		tlsConn := tls.Client(conn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tlsConn
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unsupported websocket scheme: %s", u.Scheme)
+	}
+
+	wsConn, err := websocketHandshake(ctx, conn, u, t.Header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return wsConn, nil
+}
+
+func (t *WebSocketTransport) setProxy(proxy *Proxy) {
+	t.Proxy = proxy
+}
+
+func websocketHandshake(ctx context.Context, conn net.Conn, u *url.URL, header http.Header) (*websocketConn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	keyBytes := make([]byte, 16)
+	rand.Read(keyBytes)
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+
+	h := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(h[:]) {
+		return nil, fmt.Errorf("websocket handshake failed: invalid accept key")
+	}
+
+	return &websocketConn{Conn: conn, reader: reader}, nil
+}
+
+// AcceptWebSocket answers the handshake of a WebSocket client and returns the
+// hijacked connection, for relays serving WebSocketTransport clients. Unlike the
+// client end, the server end writes unmasked frames.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket handshake failed: not an upgrade request")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket handshake failed: connection cannot be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.Sum([]byte(key + WEBSOCKET_GUID))
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(h[:]))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{Conn: conn, reader: rw.Reader, server: true}, nil
+}
+
+// websocketConn presents the payloads of incoming WebSocket messages as one
+// continuous byte stream and writes every Write as a single binary message.
+type websocketConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte
+	writeMu sync.Mutex
+	closed  bool
+	server  bool // frames are written unmasked
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.pending = payload
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return 0, err
+			}
+		case wsOpPong:
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("unknown websocket opcode: %d", opcode)
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *websocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(c.reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(c.reader, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(c.reader, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// a single websocket frame never needs to carry more than one full packet.
+	// Skipping the frame would leave part of a packet in the stream, so unlike
+	// FrameSizeError this ends the connection.
+	if length > uint64(MAX_FRAME_SIZE+SEND_LENGTH_NR_BYTES) {
+		return 0, nil, fmt.Errorf("websocket frame length exceeds maximum: %d > %d", length, MAX_FRAME_SIZE+SEND_LENGTH_NR_BYTES)
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return opcode, payload, nil
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsOpBinary, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// writeFrame writes a single frame, masked as required for frames sent by a
+// client.
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+
+	maskBit := byte(0x80)
+	if c.server {
+		maskBit = 0
+	}
+
+	frame := []byte{0x80 | opcode}
+
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if c.server {
+		frame = append(frame, payload...)
+	} else {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+
+		offset := len(frame)
+		frame = append(frame, payload...)
+		for i := range payload {
+			frame[offset+i] ^= mask[i%4]
+		}
+	}
+
+	if opcode == wsOpClose {
+		c.closed = true
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *websocketConn) Close() error {
+	// normal closure
+	c.writeFrame(wsOpClose, []byte{0x03, 0xE8})
+
+	return c.Conn.Close()
+}
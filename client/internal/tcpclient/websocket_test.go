@@ -0,0 +1,34 @@
+package tcpclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestWebSocketOversizeFrame(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	ws := &websocketConn{Conn: clientConn, reader: bufio.NewReader(clientConn)}
+	reader := NewFrameReader(ws, RECV_LENGTH_NR_BYTES)
+
+	// a binary frame announcing more than a packet, the payload never arrives
+	header := binary.BigEndian.AppendUint64([]byte{0x80 | wsOpBinary, 127}, uint64(MAX_FRAME_SIZE+SEND_LENGTH_NR_BYTES+1))
+	go serverConn.Write(header)
+
+	_, err := reader.ReadFrame()
+	if err == nil {
+		t.Fatal("oversize websocket frame read")
+	}
+
+	// the listener skips a FrameSizeError and keeps reading, which would
+	// parse the payload as the next frame header
+	var sizeErr *FrameSizeError
+	if errors.As(err, &sizeErr) {
+		t.Fatalf("oversize websocket frame reported as recoverable: %v", err)
+	}
+}
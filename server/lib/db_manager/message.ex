@@ -16,6 +16,7 @@ defmodule DbManager.Message do
 
   schema("messages") do
     field(:message_data, :binary)
+    field(:packet_id, :binary)
     field(:inserted_at, :integer)
 
     belongs_to(:sender, User, foreign_key: :sender_id, references: :user_id)
@@ -26,7 +27,7 @@ defmodule DbManager.Message do
     message
     |> Changeset.cast(
       params,
-      [:message_data, :sender_id, :receiver_id]
+      [:message_data, :sender_id, :receiver_id, :packet_id]
     )
     |> Changeset.validate_required([
       :message_data,
@@ -36,7 +37,7 @@ defmodule DbManager.Message do
     |> Changeset.put_change(:inserted_at, :os.system_time(:microsecond))
   end
 
-  def receive(message_data, sender_id_hash, receiver_id_hash) do
+  def receive(message_data, sender_id_hash, receiver_id_hash, packet_id) do
     {:ok, sender_id} = Ecto.UUID.cast(sender_id_hash)
     {:ok, receiver_id} = Ecto.UUID.cast(receiver_id_hash)
 
@@ -47,6 +48,7 @@ defmodule DbManager.Message do
                message_data: message_data,
                sender_id: sender_id,
                receiver_id: receiver_id,
+               packet_id: packet_id,
              })
 
            Repo.insert(changset)
@@ -61,6 +63,21 @@ defmodule DbManager.Message do
     end
   end
 
+  @doc """
+  Returns the message a sender stored with a send_message packet of the given
+  message ID, or nil. The client resends a message under the same ID when the
+  response to it was lost.
+  """
+  def get_by_packet_id(sender_id_hash, packet_id) do
+    {:ok, sender_id} = Ecto.UUID.cast(sender_id_hash)
+
+    Repo.one(
+      Query.from(m in Message,
+        where: m.sender_id == ^sender_id and m.packet_id == ^packet_id
+      )
+    )
+  end
+
   def get_messages(receiver_id_hash, nil, last_us_timestamp) do
     {:ok, receiver_id} = Ecto.UUID.cast(receiver_id_hash)
 
@@ -0,0 +1,84 @@
+defmodule DbManager.OneTimePrekey do
+  use Ecto.Schema
+
+  require Logger
+  require Ecto.Query
+
+  alias DbManager.Repo, as: Repo
+  alias DbManager.OneTimePrekey, as: OneTimePrekey
+
+  alias Ecto.Changeset, as: Changeset
+  alias Ecto.Query, as: Query
+
+  schema("one_time_prekeys") do
+    field(:user_id, :binary_id)
+    field(:prekey_id, :integer)
+    field(:public_key, :binary)
+
+    field(:inserted_at, :integer)
+  end
+
+  def changeset(prekey, attrs) do
+    prekey
+    |> Changeset.cast(attrs, [:user_id, :prekey_id, :public_key])
+    |> Changeset.validate_required([:user_id, :prekey_id, :public_key])
+    |> Changeset.unique_constraint([:user_id, :prekey_id])
+    |> Changeset.put_change(:inserted_at, :os.system_time(:microsecond))
+  end
+
+  @doc """
+  Adds one-time prekeys given as <<prekey_id::32, public_key::binary-size(32)>>
+  entries. Prekeys whose ID was uploaded before are kept as they are.
+  """
+  def add(user_id, prekeys_data) do
+    inserted_at = :os.system_time(:microsecond)
+
+    entries =
+      for <<prekey_id::32, public_key::binary-size(32) <- prekeys_data>> do
+        %{
+          user_id: user_id,
+          prekey_id: prekey_id,
+          public_key: public_key,
+          inserted_at: inserted_at
+        }
+      end
+
+    Repo.insert_all(OneTimePrekey, entries, on_conflict: :nothing)
+  end
+
+  def count(user_id) do
+    Repo.aggregate(Query.from(p in OneTimePrekey, where: p.user_id == ^user_id), :count)
+  end
+
+  @doc """
+  Removes the oldest one-time prekey of a user and returns it encoded as
+  uploaded, or nil once none are left. Every prekey is handed out only once.
+  """
+  def take(user_id) do
+    Repo.transaction(fn ->
+      prekey =
+        Repo.one(
+          Query.from(p in OneTimePrekey,
+            where: p.user_id == ^user_id,
+            order_by: [asc: p.id],
+            limit: 1,
+            lock: "FOR UPDATE SKIP LOCKED"
+          )
+        )
+
+      case prekey do
+        nil ->
+          nil
+
+        prekey ->
+          Repo.delete!(prekey)
+
+          <<prekey.prekey_id::32, prekey.public_key::binary>>
+      end
+    end)
+    |> case do
+      {:ok, prekey_data} -> prekey_data
+      {:error, _} -> nil
+    end
+  end
+end
@@ -0,0 +1,99 @@
+defmodule DbManager.SignedPrekey do
+  use Ecto.Schema
+
+  require Logger
+  require Ecto.Query
+
+  alias DbManager.Repo, as: Repo
+  alias DbManager.SignedPrekey, as: SignedPrekey
+  alias DbManager.OneTimePrekey, as: OneTimePrekey
+
+  alias Ecto.Changeset, as: Changeset
+
+  # signing key, identity key signature, prekey ID, prekey and its signature
+  @signed_prekey_length 32 + 64 + 4 + 32 + 64
+  # prekey ID and prekey
+  @one_time_prekey_length 4 + 32
+
+  schema("signed_prekeys") do
+    field(:user_id, :binary_id)
+    field(:prekey_data, :binary)
+
+    field(:inserted_at, :integer)
+  end
+
+  def changeset(prekey, attrs) do
+    prekey
+    |> Changeset.cast(attrs, [:user_id, :prekey_data])
+    |> Changeset.validate_required([:user_id, :prekey_data])
+    |> Changeset.unique_constraint(:user_id)
+    |> Changeset.put_change(:inserted_at, :os.system_time(:microsecond))
+  end
+
+  @doc """
+  Stores an UploadPrekeys request: the signed prekey replaces the previous one
+  and the one-time prekeys are added to those left. Returns the number of
+  one-time prekeys the user has left.
+  """
+  def upload(id_hash, <<prekey_data::binary-size(@signed_prekey_length), one_time_prekeys::binary>>)
+      when rem(byte_size(one_time_prekeys), @one_time_prekey_length) == 0 do
+    {:ok, user_id} = Ecto.UUID.cast(id_hash)
+
+    case transaction_wrapper(fn ->
+           result =
+             %SignedPrekey{}
+             |> SignedPrekey.changeset(%{user_id: user_id, prekey_data: prekey_data})
+             |> Repo.insert(
+               on_conflict: {:replace, [:prekey_data, :inserted_at]},
+               conflict_target: :user_id
+             )
+
+           with {:ok, _} <- result do
+             OneTimePrekey.add(user_id, one_time_prekeys)
+
+             {:ok, OneTimePrekey.count(user_id)}
+           end
+         end) do
+      {:ok, remaining} -> {:ok, remaining}
+      _ -> {:error, :internal_error}
+    end
+  end
+
+  def upload(_id_hash, _data), do: {:error, :invalid_prekeys}
+
+  @doc """
+  Returns the prekey bundle of a user: the signed prekey followed by one of the
+  one-time prekeys while any are left, or nil if the user never uploaded
+  prekeys.
+  """
+  def bundle(id_hash) do
+    {:ok, user_id} = Ecto.UUID.cast(id_hash)
+
+    case Repo.get_by(SignedPrekey, user_id: user_id) do
+      nil ->
+        nil
+
+      signed_prekey ->
+        case OneTimePrekey.take(user_id) do
+          nil -> signed_prekey.prekey_data
+          one_time_prekey -> signed_prekey.prekey_data <> one_time_prekey
+        end
+    end
+  end
+
+  defp transaction_wrapper(fun) do
+    case Repo.transaction(fn ->
+           with {:ok, result} <- fun.() do
+             {:ok, result}
+           else
+             {:error, changeset} ->
+               Repo.rollback(changeset)
+
+               {:error, :failed_transaction}
+           end
+         end) do
+      {_, result} ->
+        result
+    end
+  end
+end
@@ -44,6 +44,22 @@ defmodule TCPServer.DataHandler do
       {:error, _packet_data} ->
         nil
 
+      {:handshake, {_id_hash, data}} ->
+        case Utils.negotiate_handshake(data) do
+          {:ok, version, features} ->
+            Logger.info("Negotiated protocol version #{version}, features #{features}")
+            GenServer.cast(TCPServer, {:update_features, conn_uuid, features})
+
+          {:error, reason} ->
+            GenServer.call(TCPServer, {:send_data, :error, conn_uuid, message_id, reason})
+        end
+
+      {:ping, {_id_hash, data}} ->
+        GenServer.call(TCPServer, {:send_data, :pong, conn_uuid, message_id, data})
+
+      {:pong, _packet_data} ->
+        nil
+
       {:req_key, {_id_hash, req_id_hash}} ->
         case DbManager.Key.key(req_id_hash) do
           {:ok, key} ->
@@ -91,9 +107,16 @@ defmodule TCPServer.DataHandler do
               {:send_data, :error, conn_uuid, message_id, :invalid_message_receiver}
             )
 
+          # a resend of a stored message is answered without delivering it again
+          (resent = DbManager.Message.get_by_packet_id(id_hash, message_id)) != nil ->
+            GenServer.call(
+              TCPServer,
+              {:send_data, :send_message, conn_uuid, message_id, resent.message_id}
+            )
+
           true ->
             message_uuid =
-              DbManager.Message.receive(message_data, id_hash, receiver_id_hash)
+              DbManager.Message.receive(message_data, id_hash, receiver_id_hash, message_id)
 
             GenServer.call(
               TCPServer,
@@ -143,9 +166,43 @@ defmodule TCPServer.DataHandler do
       {:req_pub_key, {_id_hash, req_id_hash}} ->
         case DbManager.User.pub_key(req_id_hash) do
           {:ok, public_key} ->
+            features = GenServer.call(TCPServer, {:get_features, conn_uuid})
+
+            # only clients that negotiated prekeys expect a bundle after the key
+            bundle =
+              if Utils.prekeys_enabled?(features) do
+                DbManager.SignedPrekey.bundle(req_id_hash) || <<>>
+              else
+                <<>>
+              end
+
+            GenServer.call(
+              TCPServer,
+              {:send_data, type, conn_uuid, message_id, public_key <> bundle}
+            )
+
+          {:error, reason} ->
+            GenServer.call(
+              TCPServer,
+              {:send_data, :error, conn_uuid, message_id, reason}
+            )
+        end
+
+      {:upload_prekeys, {id_hash, data}} ->
+        features = GenServer.call(TCPServer, {:get_features, conn_uuid})
+
+        result =
+          if Utils.prekeys_enabled?(features) do
+            DbManager.SignedPrekey.upload(id_hash, data)
+          else
+            {:error, :prekeys_not_negotiated}
+          end
+
+        case result do
+          {:ok, remaining} ->
             GenServer.call(
               TCPServer,
-              {:send_data, type, conn_uuid, message_id, public_key}
+              {:send_data, type, conn_uuid, message_id, <<remaining::32>>}
             )
 
           {:error, reason} ->
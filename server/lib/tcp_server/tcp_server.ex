@@ -14,7 +14,7 @@ defmodule TCPServer do
 
   @impl true
   def handle_cast({:add_connection, conn_uuid, pid}, state) do
-    new_state = Map.put(state, conn_uuid, %{pid: pid, user_id_hash: nil})
+    new_state = Map.put(state, conn_uuid, %{pid: pid, user_id_hash: nil, features: 0})
 
     {:noreply, new_state}
   end
@@ -37,6 +37,17 @@ defmodule TCPServer do
     end
   end
 
+  @impl true
+  def handle_cast({:update_features, conn_uuid, features}, state) do
+    if Map.has_key?(state, conn_uuid) do
+      new_state = put_in(state, [conn_uuid, :features], features)
+
+      {:noreply, new_state}
+    else
+      {:noreply, state}
+    end
+  end
+
   @impl true
   def handle_cast(request, state) do
     Logger.error("Unknown cast request tcp_server -> #{inspect(request)}")
@@ -68,6 +79,14 @@ defmodule TCPServer do
     {:reply, conn_uuid, state}
   end
 
+  @impl true
+  def handle_call({:get_features, conn_uuid}, _from, state) do
+    case Map.get(state, conn_uuid) do
+      %{features: features} -> {:reply, features, state}
+      _ -> {:reply, 0, state}
+    end
+  end
+
   @impl true
   def handle_call(request, _from, state) do
     Logger.error("Unknown call request tcp_server -> #{inspect(request)}")
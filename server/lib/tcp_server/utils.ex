@@ -13,6 +13,9 @@ defmodule TCPServer.Utils do
           | :recv_message
           | :req_messages
           | :req_pub_key
+          | :ping
+          | :pong
+          | :upload_prekeys
 
   @type packet_response_type ::
           :plain
@@ -21,7 +24,7 @@ defmodule TCPServer.Utils do
 
   def get_packet_response_type(packet_type) do
     case packet_type do
-      type when type == :ack or type == :error or type == :req_key ->
+      type when type in [:ack, :error, :handshake, :req_key, :ping, :pong] ->
         :plain
 
       type when type == :req_login or type == :req_signup ->
@@ -45,6 +48,9 @@ defmodule TCPServer.Utils do
       :recv_message -> 8
       :req_messages -> 9
       :req_pub_key -> 10
+      :ping -> 11
+      :pong -> 12
+      :upload_prekeys -> 14
       _ -> nil
     end
   end
@@ -62,10 +68,56 @@ defmodule TCPServer.Utils do
       <<8>> -> :recv_message
       <<9>> -> :req_messages
       <<10>> -> :req_pub_key
+      <<11>> -> :ping
+      <<12>> -> :pong
+      <<14>> -> :upload_prekeys
       _ -> nil
     end
   end
 
+  @protocol_versions [1]
+
+  # feature bits of the handshake, chunking (1) and deflate (2) are not
+  # supported yet
+  @feature_prekeys 4
+  @features @feature_prekeys
+
+  @doc """
+  Handshake data sent on connect: conn_uuid, the number of supported protocol
+  versions, the versions and an 8 byte feature bit set.
+  """
+  def handshake_data(conn_uuid) do
+    versions = :binary.list_to_bin(@protocol_versions)
+
+    <<conn_uuid::binary, length(@protocol_versions)::8, versions::binary, @features::64>>
+  end
+
+  @doc """
+  Parses the handshake a client answers with and returns the highest common
+  version and the common features.
+  """
+  def negotiate_handshake(<<count::8, rest::binary>>) when byte_size(rest) == count + 8 do
+    <<versions::binary-size(count), features::64>> = rest
+
+    common =
+      versions
+      |> :binary.bin_to_list()
+      |> Enum.filter(&(&1 in @protocol_versions))
+
+    case common do
+      [] -> {:error, :invalid_handshake_version}
+      _ -> {:ok, Enum.max(common), band(features, @features)}
+    end
+  end
+
+  def negotiate_handshake(_data), do: {:error, :invalid_handshake}
+
+  @doc """
+  Whether the negotiated features allow uploading prekeys and include a prekey
+  bundle in the req_pub_key response.
+  """
+  def prekeys_enabled?(features), do: band(features, @feature_prekeys) != 0
+
   def uuid() do
     perf_counter = :os.perf_counter()
     random = :rand.uniform(1_000_000)
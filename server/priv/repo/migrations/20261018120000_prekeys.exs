@@ -0,0 +1,25 @@
+defmodule DbManager.Repo.Migrations.Prekeys do
+  use Ecto.Migration
+
+  def change() do
+    create(table(:signed_prekeys)) do
+      add(:user_id, :binary_id, null: false)
+      # signing key, identity key signature, prekey ID, prekey and its signature
+      add(:prekey_data, :binary, null: false)
+
+      add(:inserted_at, :bigint, null: false)
+    end
+
+    create(unique_index(:signed_prekeys, [:user_id]))
+
+    create(table(:one_time_prekeys)) do
+      add(:user_id, :binary_id, null: false)
+      add(:prekey_id, :bigint, null: false)
+      add(:public_key, :binary, null: false)
+
+      add(:inserted_at, :bigint, null: false)
+    end
+
+    create(unique_index(:one_time_prekeys, [:user_id, :prekey_id]))
+  end
+end
@@ -0,0 +1,12 @@
+defmodule DbManager.Repo.Migrations.MessagePacketId do
+  use Ecto.Migration
+
+  def change() do
+    alter(table(:messages)) do
+      # message ID of the send_message packet, a resend carries the same ID
+      add(:packet_id, :binary, null: true)
+    end
+
+    create(unique_index(:messages, [:sender_id, :packet_id]))
+  end
+end